@@ -0,0 +1,227 @@
+// This file contains tracking and retransmission of acked messages.
+package mysensors
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ackTimeout = flag.Duration("ack_timeout", 2*time.Second, "Time to wait for the echo of a message sent with ack set before retransmitting")
+	ackRetries = flag.Int("ack_retries", 3, "Retransmissions of a message sent with ack set before giving up")
+)
+
+var (
+	ackDeliveredCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_tx_ack_delivered_total",
+		Help: "Messages sent with ack set whose echo was received",
+	}, []string{"gateway"})
+	ackFailedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_tx_ack_failed_total",
+		Help: "Messages sent with ack set given up on after all retransmissions",
+	}, []string{"gateway"})
+	ackRetransmitCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_tx_retransmits_total",
+		Help: "Retransmissions of messages sent with ack set",
+	}, []string{"gateway"})
+	ackEchoCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_rx_ack_echoes_total",
+		Help: "Echoes of sent messages received, which are not processed as values",
+	}, []string{"gateway"})
+)
+
+func init() {
+	mustRegister(ackDeliveredCount, ackFailedCount, ackRetransmitCount, ackEchoCount)
+}
+
+// CheckAckTimeout returns an error if --ack_timeout is not positive.
+func CheckAckTimeout() error {
+	if *ackTimeout <= 0 {
+		return fmt.Errorf("invalid --ack_timeout %v, want > 0", *ackTimeout)
+	}
+	return nil
+}
+
+// ErrNoAck is returned by SendWithAck when the node didn't echo the message
+// after all retransmissions.
+var ErrNoAck = errors.New("no ack from node")
+
+// pendingAck is a sent message awaiting its echo.
+type pendingAck struct {
+	m        *Message
+	tries    int
+	deadline time.Time
+	// sent is when the last transmission was written.
+	sent time.Time
+}
+
+// ackKey identifies a message and its echo.
+func ackKey(m *Message) string {
+	return fmt.Sprintf("%d;%d;%d;%d;%s", m.NodeID, m.ChildSensorID, m.Type, m.SubType.Value(), m.Payload)
+}
+
+// trackAck records that m, with ack set, was sent.
+func (h *Handler) trackAck(m *Message) {
+	h.ackMux.Lock()
+	defer h.ackMux.Unlock()
+	if h.acks == nil {
+		h.acks = make(map[string]*pendingAck)
+	}
+	k := ackKey(m)
+	p, ok := h.acks[k]
+	if !ok {
+		p = &pendingAck{m: m}
+		h.acks[k] = p
+	}
+	p.tries++
+	p.sent = time.Now()
+	p.deadline = p.sent.Add(*ackTimeout)
+	if h.echoes == nil {
+		h.echoes = make(map[string]time.Time)
+	}
+	// Each transmission may be echoed, until after the last retry.
+	h.echoes[k] = p.deadline.Add(time.Duration(*ackRetries+1) * *ackTimeout)
+}
+
+// confirmAck handles a received message with ack set, and reports whether
+// it is the echo of a sent message, either awaited or late, eg of a
+// retransmission.
+func (h *Handler) confirmAck(m *Message) bool {
+	h.ackMux.Lock()
+	defer h.ackMux.Unlock()
+	k := ackKey(m)
+	if p, ok := h.acks[k]; ok {
+		delete(h.acks, k)
+		ackDeliveredCount.WithLabelValues(h.Gateway).Inc()
+		observeLatency(h.Gateway, m.NodeID, "ack", p.sent)
+		h.notifyAck(k, nil)
+	} else if expiry, ok := h.echoes[k]; !ok || time.Now().After(expiry) {
+		return false
+	}
+	ackEchoCount.WithLabelValues(h.Gateway).Inc()
+	logf(modHandler, LevelDebug, "Echo: %s\n", m)
+	return true
+}
+
+// notifyAck tells the SendWithAck callers waiting for the message with key
+// k whether it was delivered. h.ackMux must be held.
+func (h *Handler) notifyAck(k string, err error) {
+	for _, c := range h.ackWaiters[k] {
+		c <- err
+	}
+	delete(h.ackWaiters, k)
+}
+
+// SendWithAck sends m with ack set, and waits until the node echoes it,
+// retransmitting per --ack_timeout and --ack_retries. It returns ErrNoAck
+// if the node never does, or the error of ctx if done first.
+func (h *Handler) SendWithAck(ctx context.Context, m *Message) error {
+	m = m.Copy()
+	m.Ack = Ack
+	k := ackKey(m)
+	c := make(chan error, 1)
+	h.ackMux.Lock()
+	if h.ackWaiters == nil {
+		h.ackWaiters = make(map[string][]chan error)
+	}
+	h.ackWaiters[k] = append(h.ackWaiters[k], c)
+	h.ackMux.Unlock()
+	defer func() {
+		h.ackMux.Lock()
+		defer h.ackMux.Unlock()
+		waiters := h.ackWaiters[k]
+		for i, w := range waiters {
+			if w == c {
+				h.ackWaiters[k] = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(h.ackWaiters[k]) == 0 {
+			delete(h.ackWaiters, k)
+		}
+	}()
+	if !Enqueue("tx", h.Tx, m, ctx.Done()) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return errors.New("transmit queue full")
+	}
+	select {
+	case err := <-c:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SendWithAck sends m with ack set via the gateway the node was last heard
+// on, and waits until the node echoes it. See Handler.SendWithAck.
+func (n *Network) SendWithAck(ctx context.Context, m *Message) error {
+	n.mux.Lock()
+	tx, err := n.gatewayTx(m)
+	var h *Handler
+	for _, gh := range n.handlers {
+		if gh.Tx == tx {
+			h = gh
+		}
+	}
+	n.mux.Unlock()
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		return fmt.Errorf("no handler for the gateway of node %d", m.NodeID)
+	}
+	return h.SendWithAck(ctx, m)
+}
+
+// ackRetransmitter periodically retransmits messages whose echo is overdue,
+// giving up after --ack_retries retransmissions.
+func (h *Handler) ackRetransmitter() {
+	t := time.NewTicker(*ackTimeout / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-h.done:
+			return
+		}
+		now := time.Now()
+		resend := []*Message{}
+		h.ackMux.Lock()
+		for k, expiry := range h.echoes {
+			if now.After(expiry) {
+				delete(h.echoes, k)
+			}
+		}
+		h.expireReqs(now)
+		for k, p := range h.acks {
+			if now.Before(p.deadline) {
+				continue
+			}
+			if p.tries > *ackRetries {
+				delete(h.acks, k)
+				ackFailedCount.WithLabelValues(h.Gateway).Inc()
+				h.notifyAck(k, ErrNoAck)
+				logf(modHandler, LevelWarn, "No ack after %d tries, giving up: %s", p.tries, p.m)
+				continue
+			}
+			// Push the deadline out until the retransmission is written.
+			p.deadline = now.Add(*ackTimeout)
+			resend = append(resend, p.m)
+		}
+		h.ackMux.Unlock()
+		for _, m := range resend {
+			ackRetransmitCount.WithLabelValues(h.Gateway).Inc()
+			logf(modHandler, LevelInfo, "No ack, retransmitting: %s", m)
+			if !h.send(h.Tx, m) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// This file contains CO2 and VOC air quality sensor handling.
+package mysensors
+
+import (
+	"flag"
+	"sort"
+	"strings"
+)
+
+var (
+	co2Moderate = flag.Float64("co2_moderate_ppm", 1000, "CO2 level from which air quality is moderate")
+	co2Poor     = flag.Float64("co2_poor_ppm", 2000, "CO2 level from which air quality is poor")
+	vocModerate = flag.Float64("voc_moderate_ppb", 220, "VOC level from which air quality is moderate")
+	vocPoor     = flag.Float64("voc_poor_ppb", 660, "VOC level from which air quality is poor")
+)
+
+var airLabels = sensorLabels
+
+func init() {
+	fixedGauges["mysensors_co2_ppm"] = fixedVec{
+		help:   "CO2 level from S_AIR_QUALITY sensors",
+		labels: airLabels,
+	}
+	fixedGauges["mysensors_voc_ppb"] = fixedVec{
+		help:   "VOC level from S_AIR_QUALITY sensors with a ppb or voc unit prefix",
+		labels: airLabels,
+	}
+	fixedGauges["mysensors_air_quality_band"] = fixedVec{
+		help:   "Air quality band: 0 good, 1 moderate, 2 poor",
+		labels: append(airLabels, "pollutant"),
+	}
+}
+
+// airBands are the air quality bands, by value of mysensors_air_quality_band.
+var airBands = []string{"good", "moderate", "poor"}
+
+// airQuality returns whether the variable is an air quality level.
+func (s *Sensor) airQuality(t SubTypeSetReq) bool {
+	return t == V_LEVEL && s.Presentation != nil && *s.Presentation == S_AIR_QUALITY
+}
+
+// pollutant returns "voc" if the sensor's unit prefix is ppb or mentions VOC,
+// else "co2".
+func (s *Sensor) pollutant() string {
+	if v, ok := s.Vars[V_UNIT_PREFIX.String()]; ok {
+		unit := strings.ToLower(v.Value())
+		if strings.Contains(unit, "ppb") || strings.Contains(unit, "voc") {
+			return "voc"
+		}
+	}
+	return "co2"
+}
+
+// airBand returns the air quality band of a level of the pollutant.
+func airBand(pollutant string, level float64) int {
+	moderate, poor := *co2Moderate, *co2Poor
+	if pollutant == "voc" {
+		moderate, poor = *vocModerate, *vocPoor
+	}
+	switch {
+	case level >= poor:
+		return 2
+	case level >= moderate:
+		return 1
+	}
+	return 0
+}
+
+// updateAirQuality exports an air quality level and its band.
+func (s *Sensor) updateAirQuality(level float64) {
+	p := s.pollutant()
+	metric := "mysensors_co2_ppm"
+	if p == "voc" {
+		metric = "mysensors_voc_ppb"
+	}
+	s.export(metric, s.labels(), level)
+	s.export("mysensors_air_quality_band", append(s.labels(), p), float64(airBand(p, level)))
+}
+
+// RoomSummary summarises the sensors of a location.
+type RoomSummary struct {
+	Location string
+	// Temperature and Humidity are averages, or nil if unknown.
+	Temperature *float64 `json:",omitempty"`
+	Humidity    *float64 `json:",omitempty"`
+	// CO2 and VOC are the highest levels, or nil if unknown.
+	CO2 *float64 `json:",omitempty"`
+	VOC *float64 `json:",omitempty"`
+	// AirQuality is the worst air quality band, or empty if unknown.
+	AirQuality string `json:",omitempty"`
+}
+
+// Summary returns a summary of each location, with air quality.
+func (n *Network) Summary() []RoomSummary {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	type sums struct {
+		temp, hum   float64
+		nTemp, nHum int
+		band        int
+		summary     RoomSummary
+	}
+	rooms := map[string]*sums{}
+	for _, nd := range n.Nodes {
+		r, ok := rooms[nd.Location]
+		if !ok {
+			r = &sums{band: -1, summary: RoomSummary{Location: nd.Location}}
+			rooms[nd.Location] = r
+		}
+		for _, s := range nd.Sensors {
+			if s.Ignored {
+				continue
+			}
+			for _, v := range s.Vars {
+				if v.Type != varFloat {
+					continue
+				}
+				switch {
+				case v.SubType == V_TEMP:
+					r.temp += v.FloatVal
+					r.nTemp++
+				case v.SubType == V_HUM:
+					r.hum += v.FloatVal
+					r.nHum++
+				case s.airQuality(v.SubType):
+					p := s.pollutant()
+					level := &r.summary.CO2
+					if p == "voc" {
+						level = &r.summary.VOC
+					}
+					if *level == nil || v.FloatVal > **level {
+						val := v.FloatVal
+						*level = &val
+					}
+					if b := airBand(p, v.FloatVal); b > r.band {
+						r.band = b
+					}
+				}
+			}
+		}
+	}
+	summary := []RoomSummary{}
+	for _, r := range rooms {
+		if r.nTemp > 0 {
+			t := r.temp / float64(r.nTemp)
+			r.summary.Temperature = &t
+		}
+		if r.nHum > 0 {
+			h := r.hum / float64(r.nHum)
+			r.summary.Humidity = &h
+		}
+		if r.band >= 0 {
+			r.summary.AirQuality = airBands[r.band]
+		}
+		summary = append(summary, r.summary)
+	}
+	sort.Slice(summary, func(i, j int) bool { return summary[i].Location < summary[j].Location })
+	return summary
+}
@@ -0,0 +1,195 @@
+// This file contains immediate alerts for fast events, such as leaks.
+package mysensors
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	alertWebhook       = flag.String("alert_webhook", "", "URL to POST leak and smoke alerts to, as JSON")
+	alertTopic         = flag.String("alert_topic", "", "MQTT topic on --broker to publish leak and smoke alerts to")
+	alertRetries       = flag.Int("alert_retries", 5, "Retries of failed alert deliveries")
+	alertRetryInterval = flag.Duration("alert_retry_interval", 2*time.Second, "Initial delay between alert delivery retries, doubled on each retry")
+)
+
+var (
+	alertSentCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_alerts_sent_total",
+		Help: "Alerts delivered",
+	}, []string{"channel"})
+	alertFailedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_alerts_failed_total",
+		Help: "Alerts given up on after all retries",
+	}, []string{"channel"})
+)
+
+func init() {
+	mustRegister(alertSentCount, alertFailedCount)
+}
+
+// alertPresentations are the sensors whose V_TRIPPED changes raise alerts.
+var alertPresentations = map[SubTypePresentation]bool{
+	S_WATER_LEAK: true,
+	S_SMOKE:      true,
+}
+
+// Alert is a change of state of a leak or smoke sensor.
+type Alert struct {
+	Time     time.Time
+	Node     uint8
+	Sensor   uint8
+	Location string `json:",omitempty"`
+	Gateway  string `json:",omitempty"`
+	// Type is the sensor presentation, eg S_WATER_LEAK.
+	Type    string
+	Tripped bool
+	// Synthetic marks alerts raised by injected test messages.
+	Synthetic bool `json:",omitempty"`
+}
+
+// Alerts returns a channel receiving alerts as soon as they are received,
+// bypassing pausing. Alerts are dropped if the receiver falls behind.
+func (n *Network) Alerts() <-chan Alert {
+	return n.alerts
+}
+
+// alertable returns whether m is for a sensor raising alerts.
+func (n *Network) alertable(m *Message) bool {
+	if m.Type != MsgSet || m.SubType != V_TRIPPED {
+		return false
+	}
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	s := n.sensor(m.Gateway, m.NodeID, m.ChildSensorID)
+	return s != nil && !s.Ignored && s.Presentation != nil && alertPresentations[*s.Presentation]
+}
+
+// raiseAlert sends an alert for the sensor if its tripped state changed.
+func (s *Sensor) raiseAlert(previous *Var, v *Var, synthetic bool) {
+	if s.Ignored || s.Presentation == nil || !alertPresentations[*s.Presentation] {
+		return
+	}
+	tripped := v.Value() == "1"
+	if previous == nil && !tripped || previous != nil && previous.Value() == v.Value() {
+		return
+	}
+	a := Alert{
+		Time:      time.Now(),
+		Node:      s.node.ID,
+		Sensor:    s.ID,
+		Location:  s.node.Location,
+		Gateway:   s.node.Gateway,
+		Type:      s.Presentation.String(),
+		Tripped:   tripped,
+		Synthetic: synthetic,
+	}
+	logf(modNetwork, LevelWarn, "ALERT: %s node %d sensor %d tripped: %t", a.Type, a.Node, a.Sensor, a.Tripped)
+	select {
+	case s.node.network.alerts <- a:
+	default:
+		logf(modNetwork, LevelError, "Alert queue full, dropped alert.")
+	}
+}
+
+// Alerter delivers alerts to --alert_webhook and --alert_topic, retrying
+// failed deliveries.
+type Alerter struct {
+	client mqtt.Client
+}
+
+// Start delivers the alerts received on ch until ctx is done.
+func (a *Alerter) Start(ctx context.Context, ch <-chan Alert) error {
+	if *alertWebhook == "" && *alertTopic == "" {
+		return nil
+	}
+	if *alertTopic != "" {
+		if *broker == "" {
+			return fmt.Errorf("--alert_topic requires --broker")
+		}
+		options := mqtt.NewClientOptions().AddBroker(*broker)
+		options.SetClientID(*clientPrefix + "alerts")
+		options.SetAutoReconnect(true)
+		a.client = mqtt.NewClient(options)
+		if token := a.client.Connect(); token.Wait() && token.Error() != nil {
+			return token.Error()
+		}
+	}
+	go func() {
+		for {
+			select {
+			case alert := <-ch:
+				a.deliver(ctx, alert)
+			case <-ctx.Done():
+				if a.client != nil {
+					a.client.Disconnect(250)
+				}
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// deliver sends an alert to all configured channels, in the background so
+// retries don't delay later alerts.
+func (a *Alerter) deliver(ctx context.Context, alert Alert) {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		logf(modNetwork, LevelError, "Error encoding alert: %v", err)
+		return
+	}
+	if *alertWebhook != "" {
+		go a.retry(ctx, "webhook", func() error {
+			resp, err := http.Post(*alertWebhook, "application/json", bytes.NewReader(payload))
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				return fmt.Errorf("webhook returned %s", resp.Status)
+			}
+			return nil
+		})
+	}
+	if a.client != nil {
+		go a.retry(ctx, "mqtt", func() error {
+			token := a.client.Publish(*alertTopic, 1, false, payload)
+			token.Wait()
+			return token.Error()
+		})
+	}
+}
+
+// retry calls send until it succeeds, up to --alert_retries retries with
+// exponential backoff.
+func (a *Alerter) retry(ctx context.Context, channel string, send func() error) {
+	backoff := *alertRetryInterval
+	for try := 0; ; try++ {
+		err := send()
+		if err == nil {
+			alertSentCount.WithLabelValues(channel).Inc()
+			return
+		}
+		if try >= *alertRetries {
+			alertFailedCount.WithLabelValues(channel).Inc()
+			logf(modNetwork, LevelError, "Giving up on %s alert after %d tries: %v", channel, try+1, err)
+			return
+		}
+		logf(modNetwork, LevelWarn, "Error sending %s alert, retrying in %v: %v", channel, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+	}
+}
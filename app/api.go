@@ -0,0 +1,619 @@
+// This file contains the HTTP API of the exporter.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buxtronix/mysensors-prom"
+)
+
+// gatewayHandler returns the handler of the named gateway, or the only one
+// if name is empty, or nil.
+func gatewayHandler(handlers []*mysensors.Handler, name string) *mysensors.Handler {
+	for _, h := range handlers {
+		if h.Gateway == name || len(handlers) == 1 && name == "" {
+			return h
+		}
+	}
+	return nil
+}
+
+// registerAPI registers the /api endpoints on the default mux.
+func registerAPI(handlers []*mysensors.Handler, net *mysensors.Network) {
+	http.HandleFunc("/api/pause", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			for _, h := range handlers {
+				h.Pause()
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writePaused(w, handlers)
+	})
+	http.HandleFunc("/api/resume", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		for _, h := range handlers {
+			h.Resume()
+		}
+		writePaused(w, handlers)
+	})
+	http.HandleFunc("/api/export/homeassistant", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/yaml; charset=utf-8")
+		if err := net.HomeAssistantYAML(w); err != nil {
+			log.Printf("Home Assistant export: %v", err)
+		}
+	})
+	http.HandleFunc("/api/export/grafana", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := net.GrafanaDashboard(w); err != nil {
+			log.Printf("Grafana export: %v", err)
+		}
+	})
+	http.HandleFunc("/api/tail", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		frames := make(chan mysensors.Frame)
+		for _, h := range handlers {
+			ch, stop := h.Tail()
+			defer stop()
+			go func() {
+				for {
+					select {
+					case f := <-ch:
+						select {
+						case frames <- f:
+						case <-r.Context().Done():
+							return
+						}
+					case <-r.Context().Done():
+						return
+					}
+				}
+			}()
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		flusher.Flush()
+		for {
+			select {
+			case f := <-frames:
+				fmt.Fprintf(w, "data: %s\n\n", f)
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+	http.HandleFunc("/api/nodes/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseUint(r.FormValue("node"), 10, 8)
+		if err != nil {
+			http.Error(w, "invalid node: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		timeout := 2 * time.Minute
+		if t := r.FormValue("timeout"); t != "" {
+			if timeout, err = time.ParseDuration(t); err != nil {
+				http.Error(w, "invalid timeout: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		flusher, _ := w.(http.Flusher)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		err = net.ResetNode(ctx, r.FormValue("gateway"), uint8(id), func(step string) {
+			fmt.Fprintln(w, step)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		})
+		if err != nil {
+			fmt.Fprintf(w, "reset failed: %v\n", err)
+			return
+		}
+		fmt.Fprintln(w, "reset complete")
+	})
+	http.HandleFunc("/api/loglevel", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			spec, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := mysensors.SetLogLevel(strings.TrimSpace(string(spec))); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintln(w, mysensors.LogLevel())
+	})
+	http.HandleFunc("/api/nodes", func(w http.ResponseWriter, r *http.Request) {
+		data, err := net.Json()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+	http.HandleFunc("/api/sensors/ignore", func(w http.ResponseWriter, r *http.Request) {
+		var ignored bool
+		switch r.Method {
+		case http.MethodPost:
+			ignored = true
+		case http.MethodDelete:
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		node, err := strconv.ParseUint(r.FormValue("node"), 10, 8)
+		if err != nil {
+			http.Error(w, "invalid node: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		sensor, err := strconv.ParseUint(r.FormValue("sensor"), 10, 8)
+		if err != nil {
+			http.Error(w, "invalid sensor: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := net.SetIgnored(r.FormValue("gateway"), uint8(node), uint8(sensor), ignored); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "sensor %d/%d ignored: %t\n", node, sensor, ignored)
+	})
+	http.HandleFunc("/api/watermarks/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		node, err := optionalID(r, "node")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sensor, err := optionalID(r, "sensor")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		count, err := net.ResetWatermarks(r.FormValue("gateway"), node, sensor)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "reset %d watermarks\n", count)
+	})
+	http.HandleFunc("/api/wind", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(net.Wind())
+	})
+	http.HandleFunc("/api/mappings", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var m mysensors.Mappings
+			if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+				http.Error(w, "invalid mappings: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := net.SetMappings(m); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(net.Mappings())
+	})
+	http.HandleFunc("/api/history", func(w http.ResponseWriter, r *http.Request) {
+		if net.History == nil {
+			http.Error(w, "history is not enabled", http.StatusNotFound)
+			return
+		}
+		to := time.Now()
+		from := to.Add(-24 * time.Hour)
+		for _, p := range []struct {
+			name string
+			t    *time.Time
+		}{{"from", &from}, {"to", &to}} {
+			if v := r.FormValue(p.name); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					http.Error(w, "invalid "+p.name+": "+err.Error(), http.StatusBadRequest)
+					return
+				}
+				*p.t = t
+			}
+		}
+		node, err := optionalID(r, "node")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sensor, err := optionalID(r, "sensor")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		readings, err := net.History.Query(from, to, r.FormValue("gateway"), node, sensor)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(readings)
+	})
+	http.HandleFunc("/api/gateways/transport", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h := gatewayHandler(handlers, r.FormValue("gateway"))
+		if h == nil {
+			http.Error(w, "unknown gateway", http.StatusNotFound)
+			return
+		}
+		// A serial device path can be given alone, eg after a USB hub
+		// reset renumbers the port.
+		kind := r.FormValue("type")
+		if kind == "" {
+			kind = "serial"
+		}
+		t, err := newTransport(kind, r.FormValue("address"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.SetTransport(t); err != nil {
+			http.Error(w, "error opening transport: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintf(w, "gateway %s now on %s %s\n", h.Gateway, kind, r.FormValue("address"))
+	})
+	if *injectAPI {
+		http.HandleFunc("/api/test/inject", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			h := gatewayHandler(handlers, r.FormValue("gateway"))
+			if h == nil {
+				http.Error(w, "unknown gateway", http.StatusNotFound)
+				return
+			}
+			node, err := strconv.ParseUint(r.FormValue("node"), 10, 8)
+			if err != nil {
+				http.Error(w, "invalid node: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			child, err := strconv.ParseUint(r.FormValue("child"), 10, 8)
+			if err != nil {
+				http.Error(w, "invalid child: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			t, st, err := mysensors.ParseSubType(r.FormValue("subtype"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if t != mysensors.MsgSet {
+				http.Error(w, "only set sub types can be injected", http.StatusBadRequest)
+				return
+			}
+			m := &mysensors.Message{NodeID: uint8(node), ChildSensorID: uint8(child), Type: t, SubType: st, Payload: []byte(r.FormValue("value"))}
+			if err := h.Inject(m); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintf(w, "injected %s\n", m)
+		})
+	}
+	http.HandleFunc("/api/groups", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var g mysensors.Group
+			if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+				http.Error(w, "invalid group: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := net.SetGroup(g); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case http.MethodDelete:
+			if err := net.DeleteGroup(r.FormValue("name")); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(net.GroupStates())
+	})
+	http.HandleFunc("/api/groups/command", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		t, st, err := mysensors.ParseSubType(r.FormValue("subtype"))
+		if err != nil || t != mysensors.MsgSet {
+			http.Error(w, "invalid subtype, want eg V_STATUS", http.StatusBadRequest)
+			return
+		}
+		n, err := net.GroupCommand(r.FormValue("name"), st.(mysensors.SubTypeSetReq), r.FormValue("value"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "sent to %d sensors\n", n)
+	})
+	http.HandleFunc("/api/quarantine", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost, http.MethodDelete:
+			node, err := optionalID(r, "node")
+			if err == nil && node == -1 {
+				err = fmt.Errorf("missing node")
+			}
+			sensor, serr := optionalID(r, "sensor")
+			if err == nil {
+				err = serr
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if sensor == -1 {
+				sensor = mysensors.NoChild
+			}
+			gateway := r.FormValue("gateway")
+			if r.Method == http.MethodDelete {
+				err = net.Reject(gateway, uint8(node), uint8(sensor))
+			} else {
+				err = net.Approve(gateway, uint8(node), uint8(sensor))
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(net.Quarantine())
+	})
+	http.HandleFunc("/api/summary", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(net.Summary())
+	})
+	http.HandleFunc("/api/firmware", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			// The body is the image, so only the query has parameters.
+			q := r.URL.Query()
+			if err := addFirmware(net.OTA, q.Get("type"), q.Get("version"), r.Body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(net.OTA.Status())
+	})
+	http.HandleFunc("/api/firmware/target", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		node, err := strconv.ParseUint(r.FormValue("node"), 10, 8)
+		if err != nil {
+			http.Error(w, "invalid node: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		typ, err := strconv.ParseUint(r.FormValue("type"), 10, 16)
+		if err != nil {
+			http.Error(w, "invalid type: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		version, err := strconv.ParseUint(r.FormValue("version"), 10, 16)
+		if err != nil {
+			http.Error(w, "invalid version: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := net.OTA.Target(r.FormValue("gateway"), uint8(node), uint16(typ), uint16(version)); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "node %d will update when it reboots\n", node)
+	})
+	http.HandleFunc("/api/conformance", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(net.Conformance())
+	})
+	http.HandleFunc("/api/joins", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(net.Joins())
+	})
+	http.HandleFunc("/api/subtypes", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var c mysensors.CustomSubType
+			if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+				http.Error(w, "invalid variable: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := mysensors.RegisterSubType(c); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mysensors.SubTypes())
+	})
+	http.HandleFunc("/api/backups", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			net.BackupNow(r.Context())
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(net.Backups())
+	})
+	http.HandleFunc("/api/nodes/signal", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseUint(r.FormValue("node"), 10, 8)
+		if err != nil {
+			http.Error(w, "invalid node: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := net.RequestSignalReport(r.FormValue("gateway"), uint8(id)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintf(w, "requested signal report from node %d\n", id)
+	})
+	http.HandleFunc("/api/gateways/log", func(w http.ResponseWriter, r *http.Request) {
+		logs := []mysensors.GatewayLog{}
+		for _, h := range handlers {
+			if gw := r.FormValue("gateway"); gw == "" || gw == h.Gateway {
+				logs = append(logs, h.Logs()...)
+			}
+		}
+		sort.SliceStable(logs, func(i, j int) bool { return logs[i].Time.Before(logs[j].Time) })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(logs)
+	})
+	http.HandleFunc("/api/registrations", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost, http.MethodDelete:
+			node, err := optionalID(r, "node")
+			if err == nil && node == -1 {
+				err = fmt.Errorf("missing node")
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := net.Register(r.FormValue("gateway"), uint8(node), r.Method == http.MethodPost); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(net.Registrations())
+	})
+	http.HandleFunc("/api/nodes/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		node, err := optionalID(r, "node")
+		if err == nil && node == -1 {
+			err = fmt.Errorf("missing node")
+		}
+		if err == nil {
+			err = net.SetNodeConfig(r.FormValue("gateway"), uint8(node), r.FormValue("config"))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "ok, restart the node to apply")
+	})
+	http.HandleFunc("/api/nodes/name", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		node, err := optionalID(r, "node")
+		if err == nil && node == -1 {
+			err = fmt.Errorf("missing node")
+		}
+		sensor := -1
+		if err == nil {
+			sensor, err = optionalID(r, "sensor")
+		}
+		if sensor == -1 {
+			sensor = mysensors.NoChild
+		}
+		if err == nil {
+			err = net.SetName(r.FormValue("gateway"), uint8(node), uint8(sensor), r.FormValue("name"))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+func writePaused(w http.ResponseWriter, handlers []*mysensors.Handler) {
+	for _, h := range handlers {
+		fmt.Fprintf(w, "%s paused: %t\n", h.Gateway, h.Paused())
+	}
+}
+
+// optionalID parses an optional node or sensor ID parameter, returning -1 if
+// it is not given.
+func optionalID(r *http.Request, name string) (int, error) {
+	s := r.FormValue(name)
+	if s == "" {
+		return -1, nil
+	}
+	v, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return int(v), nil
+}
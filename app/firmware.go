@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/buxtronix/mysensors-prom"
+)
+
+// loadFirmware loads a firmware image given as type:version:file.hex.
+func loadFirmware(ota *mysensors.OTA, spec string) error {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 {
+		return fmt.Errorf("want type:version:file.hex")
+	}
+	f, err := os.Open(parts[2])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return addFirmware(ota, parts[0], parts[1], f)
+}
+
+// addFirmware adds the firmware of the given type and version, read in
+// Intel HEX format from r.
+func addFirmware(ota *mysensors.OTA, typ, version string, r io.Reader) error {
+	t, err := strconv.ParseUint(typ, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid type: %v", err)
+	}
+	v, err := strconv.ParseUint(version, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid version: %v", err)
+	}
+	data, err := mysensors.ParseIntelHex(r)
+	if err != nil {
+		return err
+	}
+	fw, err := mysensors.NewFirmware(uint16(t), uint16(v), data)
+	if err != nil {
+		return err
+	}
+	ota.AddFirmware(fw)
+	return nil
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"html/template"
@@ -8,19 +10,56 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/buxtronix/mysensors-prom"
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/tarm/serial"
 )
 
 var (
 	addr      = flag.String("listen", ":9001", "Address to listen on")
 	baud      = flag.Int("baud", 115200, "Baud rate")
-	port      = flag.String("port", "/dev/ttyUSB0", "Serial port to open")
+	port      = flag.String("port", "/dev/ttyUSB0", "Serial port to open, or a comma separated list for multiple gateways")
+	parity    = flag.String("parity", "N", "Serial parity: N, E, O, M or S")
+	stopBits  = flag.Int("stop_bits", 1, "Serial stop bits: 1 or 2")
+	readTO    = flag.Duration("serial_read_timeout", 0, "Reopen the serial port if nothing is received for this long, at most 25.5s, 0 to disable")
+	dtr       = flag.String("serial_dtr", "", "Set the serial DTR line after opening: on, off, or empty to leave it")
+	rts       = flag.String("serial_rts", "", "Set the serial RTS line after opening: on, off, or empty to leave it")
+	settle    = flag.Duration("serial_settle", 0, "Time to wait after opening the serial port, for gateways that reboot on open")
+	portGlob  = flag.String("port_glob", "", "Scan for the serial port matching this glob on every (re)connect, eg /dev/serial/by-id/*")
+	gwAddr    = flag.String("gateway_addr", "", "Address of an ethernet gateway to use instead of the serial port, eg 192.168.0.2:5003")
+	gwSocket  = flag.String("gateway_socket", "", "Unix socket of a bridged serial gateway (eg socat) to use instead of the serial port")
+	gwRFCOMM  = flag.String("gateway_rfcomm", "", "Bluetooth address of a paired serial adapter to use instead of the serial port, eg 00:11:22:33:44:55")
+	gwChannel = flag.Int("gateway_rfcomm_channel", 1, "RFCOMM channel of the Bluetooth serial adapter")
+	gwTLS     = flag.Bool("gateway_tls", false, "Connect to the ethernet gateway with TLS")
+	gwCA      = flag.String("gateway_tls_ca", "", "PEM file of CA certificates to verify the ethernet gateway, defaults to the system roots")
+	gwCert    = flag.String("gateway_tls_cert", "", "PEM client certificate to present to the ethernet gateway")
+	gwKey     = flag.String("gateway_tls_key", "", "PEM key of the client certificate")
+	gwName    = flag.String("gateway_tls_server_name", "", "Server name to verify in the ethernet gateway's certificate")
+	replay    = flag.String("replay", "", "Replay a file of captured gateway lines instead of using a gateway")
+	replayAt  = flag.Bool("replay_timing", false, "Replay captured lines with their original timing")
+	simulate  = flag.Bool("simulate", false, "Simulate a gateway with virtual nodes instead of using a gateway")
+	simNodes  = flag.Int("simulate_nodes", 3, "Number of simulated nodes")
+	simEvery  = flag.Duration("simulate_interval", 10*time.Second, "Interval between simulated readings")
+	scenario  = flag.String("scenario", "", "Scenario file for the simulated gateway to play instead of simulating nodes")
+	lockFile  = flag.String("leader_lock", "", "Lock file on shared storage, to elect the one of several instances sharing a gateway that writes to it")
+	rxQueue   = flag.Int("rx_queue_size", 0, "Buffer size of the queue of messages received from the gateways")
+	mqttQueue = flag.Int("mqtt_queue_size", 0, "Buffer size of the queue of messages to publish to MQTT")
+	histDir   = flag.String("history_dir", "", "Directory to store the history of sensor readings in, empty to disable")
+	histEvery = flag.Duration("history_segment", time.Hour, "Period of readings written to each history segment")
+	firmware  = flag.String("firmware", "", "Comma separated firmware images to serve to nodes, as type:version:file.hex")
+	statusInt = flag.Duration("status_interval", 30*time.Second, "Interval between printing the sensor status to stdout, 0 to disable")
+	inventory = flag.String("inventory", "", "File of the declared nodes and sensors, enabling strict mode where others are quarantined")
+	subTypes  = flag.String("subtypes", "", "JSON file of custom variables to register, eg for V_VAR1..5 of custom sketches")
 	stateFile = flag.String("state_file", ".mysensors-state", "File to save/read state")
+	idFile    = flag.String("id_file", ".mysensors-ids", "File of the node IDs allocated, kept apart from the state so IDs are not reissued if the state is lost, empty to not persist them")
+	reserved  = flag.String("reserved_ids", "", "Static node IDs never to assign, as a comma separated list of IDs and ranges, eg 1-10,42")
+	mapFile   = flag.String("mapping_file", "", "JSON or YAML file of rules mapping variables to metric names, types and scales")
+	injectAPI = flag.Bool("inject_api", false, "Enable POST /api/test/inject, which injects synthetic readings to test dashboards and alerts")
 	index     = template.Must(template.New("index").Parse(
 		`<!doctype html>
 		 <title>MySensors Prometheus Exporter</title>
@@ -29,34 +68,169 @@ var (
 		 <pre>{{.}}</pre>`))
 )
 
-var p *serial.Port
-
 func main() {
 	flag.Parse()
 
 	var err error
 
-	// Open serial port.
-	c := &serial.Config{Name: *port, Baud: *baud}
-	p, err = serial.OpenPort(c)
-	if err != nil {
-		log.Fatalf("Error opening serial port %s: %v", *port, err)
+	if *subTypes != "" {
+		if err := mysensors.LoadSubTypes(*subTypes); err != nil {
+			log.Fatalf("Error loading custom variables: %v", err)
+		}
+	}
+
+	if err = checkSerialFlags(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Open the gateways, either a simulator, a replay, an MQTT gateway, an
+	// ethernet gateway, a unix socket, a Bluetooth adapter or the serial ports.
+	transports := map[string]mysensors.GatewayTransport{}
+	if *simulate {
+		if *simEvery <= 0 {
+			log.Fatalf("invalid --simulate_interval %v, want > 0", *simEvery)
+		}
+		sim := &mysensors.Simulator{Nodes: *simNodes, Interval: *simEvery}
+		if *scenario != "" {
+			if sim.Scenario, err = mysensors.LoadScenario(*scenario); err != nil {
+				log.Fatalf("Error loading scenario: %v", err)
+			}
+		}
+		transports["simulator"] = sim
+	} else if *replay != "" {
+		transports["replay"] = &mysensors.ReplayTransport{Path: *replay, Timing: *replayAt}
+	} else if mqttGw := (&mysensors.MQTTGateway{}); mqttGw.Enabled() {
+		transports["mqtt"] = mqttGw
+	} else if *gwAddr != "" {
+		if transports[*gwAddr], err = newTransport("tcp", *gwAddr); err != nil {
+			log.Fatalf("Error loading TLS configuration: %v", err)
+		}
+	} else if *gwSocket != "" {
+		transports[*gwSocket], _ = newTransport("unix", *gwSocket)
+	} else if *gwRFCOMM != "" {
+		transports[*gwRFCOMM], _ = newTransport("rfcomm", *gwRFCOMM)
+	} else if *portGlob != "" {
+		transports[*portGlob], _ = serialTransport(mysensors.NewSerialGlobTransport(*portGlob, *baud))
+	} else {
+		for _, name := range strings.Split(*port, ",") {
+			transports[name], _ = newTransport("serial", name)
+		}
+	}
+	for name, t := range transports {
+		if err = t.Open(); err != nil {
+			log.Fatalf("Error opening gateway %s: %v", name, err)
+		}
+	}
+
+	if err = mysensors.CheckQueuePolicy(map[string]int{"rx": *rxQueue, "mqtt": *mqttQueue}); err != nil {
+		log.Fatal(err)
+	}
+	if err = mysensors.CheckAckTimeout(); err != nil {
+		log.Fatal(err)
+	}
+	if err = mysensors.CheckRemoteWrite(); err != nil {
+		log.Fatal(err)
+	}
+	if err = mysensors.CheckNodeConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err = mysensors.CheckTemperatureUnit(); err != nil {
+		log.Fatal(err)
+	}
+	if err = mysensors.CheckValueTTLs(); err != nil {
+		log.Fatal(err)
 	}
 
+	// Cancelled on SIGINT/SIGTERM to shut down.
+	ctx, cancel := context.WithCancel(context.Background())
+
 	// Start MQTT client to send sensor data.
-	mqttCh := make(chan *mysensors.Message)
+	mqttCh := make(chan *mysensors.Message, *mqttQueue)
 	mqtt := &mysensors.MQTTClient{}
-	if err := mqtt.Start(mqttCh); err != nil {
-			log.Fatalf("Error starting MQTT client: %v", err)
+	if err := mqtt.StartContext(ctx, mqttCh); err != nil {
+		log.Fatalf("Error starting MQTT client: %v", err)
 	}
 
 	// Initialise a new network handler.
-	ch := make(chan *mysensors.Message)
+	ch := make(chan *mysensors.Message, *rxQueue)
 	net := mysensors.NewNetwork()
 	if err = net.LoadJson(*stateFile); err != nil {
 		log.Fatalf("Error loading state: %v", err)
 	}
-	h := mysensors.NewHandler(p, p, ch, net)
+	if *mapFile != "" {
+		rules, err := mysensors.LoadMappingFile(*mapFile)
+		if err != nil {
+			log.Fatalf("Error loading mapping file: %v", err)
+		}
+		if err := net.SetMappingRules(rules); err != nil {
+			log.Fatalf("Error applying mapping file: %v", err)
+		}
+	}
+	ids := mysensors.NewIDAllocator()
+	if *idFile != "" || *reserved != "" {
+		if ids, err = mysensors.LoadIDAllocator(*idFile, *reserved); err != nil {
+			log.Fatalf("Error loading node IDs: %v", err)
+		}
+	}
+	if err := net.SetIDAllocator(ids); err != nil {
+		log.Fatalf("Error saving node IDs: %v", err)
+	}
+	go net.Autosave(ctx, *stateFile)
+	go net.Backup(ctx)
+	go net.SignalReports(ctx)
+	go net.Heartbeats(ctx)
+	go net.ExpireValues(ctx)
+	go mysensors.RemoteWrite(ctx)
+	net.OTA = mysensors.NewOTA()
+	for _, f := range strings.Split(*firmware, ",") {
+		if f == "" {
+			continue
+		}
+		if err := loadFirmware(net.OTA, f); err != nil {
+			log.Fatalf("Error loading firmware %s: %v", f, err)
+		}
+	}
+	if *inventory != "" {
+		inv, err := mysensors.LoadInventory(*inventory)
+		if err != nil {
+			log.Fatalf("Error loading inventory: %v", err)
+		}
+		net.SetInventory(inv)
+	}
+	if *histDir != "" {
+		if net.History, err = mysensors.OpenHistory(*histDir, *histEvery); err != nil {
+			log.Fatalf("Error opening history: %v", err)
+		}
+		go net.History.Run(ctx)
+	}
+	handlers := []*mysensors.Handler{}
+	txs := map[string]chan *mysensors.Message{}
+	for name, t := range transports {
+		h := mysensors.NewHandler(t, ch, net)
+		h.Gateway = name
+		net.AddGateway(name, h.Tx)
+		handlers = append(handlers, h)
+		txs[name] = h.Tx
+	}
+
+	// Deliver leak and smoke alerts immediately.
+	alerter := &mysensors.Alerter{}
+	if err := alerter.Start(ctx, net.Alerts()); err != nil {
+		log.Fatalf("Error starting alerter: %v", err)
+	}
+
+	// Only the leader writes to the gateways, if several instances share them.
+	if *lockFile != "" {
+		e := &mysensors.FileLockElector{Path: *lockFile, Interval: 5 * time.Second}
+		for _, h := range handlers {
+			h.Elector = e
+		}
+		go func() {
+			if err := e.Run(ctx); err != nil {
+				log.Fatalf("Error taking leader lock: %v", err)
+			}
+		}()
+	}
 
 	// Start the web server (for serving prometheus metrics)
 	go func() {
@@ -64,37 +238,176 @@ func main() {
 			w.Header().Set("Content-Type", "text/html; charset=utf-8")
 			index.Execute(w, net.StatusString())
 		})
-		http.Handle("/metrics", prometheus.Handler())
+		http.Handle("/metrics", promhttp.Handler())
+		registerAPI(handlers, net)
 		if err := http.ListenAndServe(*addr, nil); err != nil {
 			panic(err)
 		}
 	}()
 
-	// Catch SIGINT/SIGTERM and save state before exiting.
+	// Catch SIGINT/SIGTERM to shut down and save state, saving at once on
+	// SIGTERM as power may be about to go. Power failure signals and MQTT
+	// announcements save state and warn the nodes, but keep running.
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigCh, append(powerSignals, syscall.SIGINT, syscall.SIGTERM)...)
 	go func() {
-		for range sigCh {
-			if err = net.SaveJson(*stateFile); err != nil {
-				log.Printf("Error writing state file [%s]: %v", *stateFile, err)
+		for sig := range sigCh {
+			switch sig {
+			case syscall.SIGINT:
+			case syscall.SIGTERM:
+				saveState(net)
+			default:
+				powerFail(net)
+				continue
 			}
-			os.Exit(0)
+			cancel()
+			return
 		}
 	}()
+	if *powerTopic != "" {
+		err := mqtt.Subscribe(*powerTopic, func(payload []byte) {
+			if powerFailing(payload) {
+				powerFail(net)
+			}
+		})
+		if err != nil {
+			log.Printf("Error subscribing to %s: %v", *powerTopic, err)
+		}
+	}
 
 	// Periodically print sensor status to stdout.
-	go func() {
-		for range time.Tick(30 * time.Second) {
-			fmt.Println(net.StatusString())
-		}
-	}()
+	if *statusInt > 0 {
+		go func() {
+			for range time.Tick(*statusInt) {
+				fmt.Println(net.StatusString())
+			}
+		}()
+	}
 
-	// Start serial handler and pass messages to the Network.
-	go h.Start()
-	for m := range ch {
-		mqttCh <- m
-		if err := net.HandleMessage(m, h.Tx); err != nil {
+	// Start gateway handlers and pass messages to the Network.
+	// Exit if any gateway fails and cannot be reopened.
+	var wg sync.WaitGroup
+	failed := make(chan error, len(handlers))
+	for _, h := range handlers {
+		wg.Add(1)
+		go func(h *mysensors.Handler) {
+			defer wg.Done()
+			h.StartContext(ctx)
+			select {
+			case err := <-h.Errors():
+				log.Printf("Gateway %s stopped: %v", h.Gateway, err)
+				failed <- err
+				cancel()
+			default:
+			}
+		}(h)
+	}
+	for {
+		var m *mysensors.Message
+		select {
+		case m = <-ch:
+		case <-ctx.Done():
+			wg.Wait()
+			if net.History != nil {
+				if err = net.History.Flush(); err != nil {
+					log.Printf("Error writing history: %v", err)
+				}
+			}
+			if err = net.SaveJson(*stateFile); err != nil {
+				log.Fatalf("Error writing state file [%s]: %v", *stateFile, err)
+			}
+			if len(failed) > 0 {
+				os.Exit(1)
+			}
+			return
+		}
+		if m.Synthetic {
+			// Injected test values aren't published, so MQTT consumers
+			// don't take them for real readings.
+			if err := net.HandleMessage(m, nil); err != nil {
+				log.Printf("HandleMessage: %v\n", err)
+			}
+			continue
+		}
+		if net.Accepted(m) && !net.Ignored(m) {
+			mysensors.Enqueue("mqtt", mqttCh, m, ctx.Done())
+		}
+		if err := net.HandleMessage(m, txs[m.Gateway]); err != nil {
 			log.Printf("HandleMessage: %v\n", err)
 		}
+		for name, snapshot := range net.GroupSnapshots(m) {
+			if err := mqtt.Publish("group/"+name, snapshot); err != nil {
+				log.Printf("Error publishing group %s: %v", name, err)
+			}
+		}
+	}
+}
+
+// newTransport returns an unopened gateway transport of the given kind:
+// serial, tcp, unix or rfcomm.
+func newTransport(kind, address string) (mysensors.GatewayTransport, error) {
+	switch kind {
+	case "serial":
+		return serialTransport(mysensors.NewSerialTransport(address, *baud))
+	case "tcp":
+		var config *tls.Config
+		if *gwTLS {
+			var err error
+			if config, err = mysensors.LoadTLSConfig(*gwCA, *gwCert, *gwKey, *gwName); err != nil {
+				return nil, err
+			}
+		}
+		return mysensors.NewNetTransport("tcp", address, config), nil
+	case "unix":
+		return mysensors.NewNetTransport("unix", address, nil), nil
+	case "rfcomm":
+		return mysensors.NewRFCOMMTransport(address, uint8(*gwChannel)), nil
+	}
+	return nil, fmt.Errorf("unknown transport %q, want serial, tcp, unix or rfcomm", kind)
+}
+
+// checkSerialFlags returns an error if the serial flags are invalid. They
+// are checked at startup whatever the transport, as the API can swap to a
+// serial one later.
+func checkSerialFlags() error {
+	_, err := serialTransport(mysensors.NewSerialTransport("", *baud))
+	return err
+}
+
+// serialTransport applies the serial flags to t.
+func serialTransport(t *mysensors.SerialTransport) (*mysensors.SerialTransport, error) {
+	if len(*parity) != 1 || !strings.Contains("NEOMS", *parity) {
+		return nil, fmt.Errorf("invalid --parity %q, want N, E, O, M or S", *parity)
+	}
+	t.Config.Parity = serial.Parity((*parity)[0])
+	t.Config.StopBits = serial.StopBits(*stopBits)
+	if *readTO > 25500*time.Millisecond {
+		// The timeout is set in VTIME, in tenths of a second up to 255.
+		return nil, fmt.Errorf("invalid --serial_read_timeout %v, want at most 25.5s", *readTO)
+	}
+	t.Config.ReadTimeout = *readTO
+	var err error
+	if t.DTR, err = modemLine("serial_dtr", *dtr); err != nil {
+		return nil, err
+	}
+	if t.RTS, err = modemLine("serial_rts", *rts); err != nil {
+		return nil, err
+	}
+	t.Settle = *settle
+	return t, nil
+}
+
+// modemLine parses a modem line flag.
+func modemLine(name, v string) (*bool, error) {
+	switch v {
+	case "":
+		return nil, nil
+	case "on":
+		on := true
+		return &on, nil
+	case "off":
+		on := false
+		return &on, nil
 	}
+	return nil, fmt.Errorf("invalid --%s %q, want on or off", name, v)
 }
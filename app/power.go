@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+
+	"github.com/buxtronix/mysensors-prom"
+)
+
+var (
+	powerTopic = flag.String("power_topic", "", "MQTT topic under --topic_prefix announcing power failure with a payload of 1 or failing, eg from a UPS monitor")
+	powerText  = flag.String("power_fail_text", "", "Text to broadcast to the nodes as V_TEXT when power is failing, empty to not notify")
+)
+
+// powerFailing reports whether an MQTT power status payload announces
+// power failure.
+func powerFailing(payload []byte) bool {
+	switch strings.ToLower(strings.TrimSpace(string(payload))) {
+	case "1", "failing", "true", "on battery":
+		return true
+	}
+	return false
+}
+
+// saveState saves the history and state at once, eg before power is lost.
+func saveState(net *mysensors.Network) {
+	if net.History != nil {
+		if err := net.History.Flush(); err != nil {
+			log.Printf("Error writing history: %v", err)
+		}
+	}
+	if err := net.SaveJson(*stateFile); err != nil {
+		log.Printf("Error writing state file [%s]: %v", *stateFile, err)
+	}
+}
+
+// powerFail saves the state and warns the nodes that power is failing.
+func powerFail(net *mysensors.Network) {
+	log.Printf("Power failing, saving state.")
+	saveState(net)
+	if *powerText != "" {
+		net.Broadcast(&mysensors.Message{
+			ChildSensorID: mysensors.NoChild,
+			Type:          mysensors.MsgSet,
+			SubType:       mysensors.V_TEXT,
+			Payload:       []byte(*powerText),
+		})
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// powerSignals announce power failure, eg SIGPWR from a UPS daemon.
+var powerSignals = []os.Signal{syscall.SIGPWR}
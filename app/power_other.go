@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// powerSignals announce power failure. There are none on this system.
+var powerSignals = []os.Signal{}
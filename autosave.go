@@ -0,0 +1,108 @@
+// This file contains periodic saving of the network state.
+package mysensors
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	autosaveDelay    = flag.Duration("autosave_delay", 30*time.Second, "Save the state file once it has been unchanged for this long, 0 to only save on exit")
+	autosaveMaxDelay = flag.Duration("autosave_max_delay", 10*time.Minute, "Save the state file at least this often while it keeps changing")
+)
+
+var (
+	stateSaveDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mysensors_state_save_duration_seconds",
+		Help:    "Time taken to save the state file",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+	stateSaveCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_state_saves_total",
+		Help: "State saves, by result: written, unchanged or error",
+	}, []string{"result"})
+	stateSizeGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mysensors_state_size_bytes",
+		Help: "Size of the last saved state file",
+	})
+)
+
+func init() {
+	mustRegister(stateSaveDuration, stateSaveCount, stateSizeGauge)
+}
+
+// changed marks the state as needing saving. n.mux must be held.
+func (n *Network) changed() {
+	now := time.Now()
+	if n.dirtySince.IsZero() {
+		n.dirtySince = now
+	}
+	n.lastChange = now
+}
+
+// Autosave saves the state to path when it has changed, once it settles for
+// --autosave_delay or at least every --autosave_max_delay, until ctx is
+// done. Save once more on exit with SaveJson.
+func (n *Network) Autosave(ctx context.Context, path string) {
+	if *autosaveDelay <= 0 {
+		return
+	}
+	interval := *autosaveDelay / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		n.mux.Lock()
+		due := !n.dirtySince.IsZero() &&
+			(time.Since(n.lastChange) >= *autosaveDelay || time.Since(n.dirtySince) >= *autosaveMaxDelay)
+		n.mux.Unlock()
+		if !due {
+			continue
+		}
+		if err := n.SaveJson(path); err != nil {
+			logf(modNetwork, LevelError, "Error saving state to %s: %v", path, err)
+		}
+	}
+}
+
+// writeState writes data to path, unless it is unchanged since the last
+// save. The file is replaced atomically so a crash leaves the old state.
+func (n *Network) writeState(path string, data []byte) error {
+	start := time.Now()
+	sum := sha256.Sum256(data)
+	n.saveMux.Lock()
+	defer n.saveMux.Unlock()
+	if bytes.Equal(sum[:], n.savedSum) && n.savedPath == path {
+		stateSaveCount.WithLabelValues("unchanged").Inc()
+		return nil
+	}
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, data, os.ModePerm)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		stateSaveCount.WithLabelValues("error").Inc()
+		return err
+	}
+	n.savedSum, n.savedPath = sum[:], path
+	stateSaveDuration.Observe(time.Since(start).Seconds())
+	stateSaveCount.WithLabelValues("written").Inc()
+	stateSizeGauge.Set(float64(len(data)))
+	return nil
+}
@@ -0,0 +1,306 @@
+// This file contains nightly backups of the network state.
+package mysensors
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	backupDir        = flag.String("backup_dir", "", "Directory to back up the state to nightly, empty to disable")
+	backupS3         = flag.String("backup_s3", "", "S3 location to back up the state to nightly, eg s3://bucket/mysensors, with credentials from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	backupS3Region   = flag.String("backup_s3_region", "us-east-1", "Region of the --backup_s3 bucket")
+	backupS3Endpoint = flag.String("backup_s3_endpoint", "", "S3 endpoint, eg for a local S3 compatible store, defaults to AWS")
+	backupTime       = flag.String("backup_time", "03:00", "Local time of day to back up the state at")
+	backupKeep       = flag.Int("backup_keep", 14, "Backups to keep in --backup_dir, 0 to keep all; use a lifecycle rule for S3")
+	backupWebhook    = flag.String("backup_webhook", "", "URL to POST a JSON summary of each backup run to")
+)
+
+// maxBackupResults is the number of backup results kept for Backups.
+const maxBackupResults = 30
+
+var (
+	backupCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_state_backups_total",
+		Help: "State backups, by target and result: ok or error",
+	}, []string{"target", "result"})
+	backupSuccessGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mysensors_state_backup_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful state backup",
+	}, []string{"target"})
+)
+
+func init() {
+	mustRegister(backupCount, backupSuccessGauge)
+}
+
+// BackupResult is the outcome of backing up the state to a target.
+type BackupResult struct {
+	Time time.Time
+	// Target is "dir" or "s3".
+	Target string
+	// Location is the file or URL written.
+	Location string
+	Size     int
+	Error    string `json:",omitempty"`
+}
+
+// Backup backs up the state every day at --backup_time, until ctx is done.
+// It does nothing if neither --backup_dir nor --backup_s3 is set.
+func (n *Network) Backup(ctx context.Context) {
+	if *backupDir == "" && *backupS3 == "" {
+		return
+	}
+	for {
+		next, err := nextBackup(time.Now(), *backupTime)
+		if err != nil {
+			logf(modNetwork, LevelError, "Backups disabled: %v", err)
+			return
+		}
+		select {
+		case <-time.After(time.Until(next)):
+		case <-ctx.Done():
+			return
+		}
+		n.BackupNow(ctx)
+	}
+}
+
+// nextBackup returns the next time after now at the time of day clock, eg
+// "03:00".
+func nextBackup(now time.Time, clock string) (time.Time, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --backup_time %q", clock)
+	}
+	next := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next, nil
+}
+
+// BackupNow backs up the state to the configured targets, after checking it
+// loads cleanly, and returns the results.
+func (n *Network) BackupNow(ctx context.Context) []BackupResult {
+	now := time.Now()
+	name := "mysensors-state-" + now.Format("20060102T150405") + ".json"
+	data, err := n.Json()
+	if err == nil {
+		err = verifyState(data)
+	}
+	var results []BackupResult
+	if *backupDir != "" {
+		r := BackupResult{Time: now, Target: "dir", Location: filepath.Join(*backupDir, name), Size: len(data)}
+		if err == nil {
+			err = backupToDir(r.Location, data)
+		}
+		results = append(results, finishBackup(r, err))
+	}
+	if *backupS3 != "" {
+		r := BackupResult{Time: now, Target: "s3", Size: len(data)}
+		if err == nil {
+			r.Location, err = backupToS3(ctx, name, data)
+		}
+		results = append(results, finishBackup(r, err))
+	}
+	n.mux.Lock()
+	n.backups = append(n.backups, results...)
+	if len(n.backups) > maxBackupResults {
+		n.backups = n.backups[len(n.backups)-maxBackupResults:]
+	}
+	n.mux.Unlock()
+	if *backupWebhook != "" {
+		notifyBackup(results)
+	}
+	return results
+}
+
+// Backups returns the results of recent backups, newest first.
+func (n *Network) Backups() []BackupResult {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	results := append([]BackupResult{}, n.backups...)
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Time.After(results[j].Time) })
+	return results
+}
+
+// finishBackup records the outcome of a backup.
+func finishBackup(r BackupResult, err error) BackupResult {
+	if err != nil {
+		r.Error = err.Error()
+		backupCount.WithLabelValues(r.Target, "error").Inc()
+		logf(modNetwork, LevelError, "Error backing up state to %s: %v", r.Target, err)
+		return r
+	}
+	backupCount.WithLabelValues(r.Target, "ok").Inc()
+	backupSuccessGauge.WithLabelValues(r.Target).Set(float64(r.Time.Unix()))
+	logf(modNetwork, LevelInfo, "Backed up state to %s.", r.Location)
+	return r
+}
+
+// verifyState checks that a state snapshot loads cleanly.
+func verifyState(data []byte) error {
+	var check Network
+	if err := json.Unmarshal(data, &check); err != nil {
+		return fmt.Errorf("state does not load: %v", err)
+	}
+	if check.CustomMappings != nil {
+		if _, err := parseMappings(check.CustomMappings.Gauges); err != nil {
+			return fmt.Errorf("state mappings do not load: %v", err)
+		}
+	}
+	return nil
+}
+
+// backupToDir writes a backup to path, checks it reads back, and removes
+// the oldest backups beyond --backup_keep.
+func backupToDir(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	written, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := verifyState(written); err != nil {
+		return fmt.Errorf("written backup: %v", err)
+	}
+	if *backupKeep <= 0 {
+		return nil
+	}
+	old, err := filepath.Glob(filepath.Join(filepath.Dir(path), "mysensors-state-*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(old)
+	for len(old) > *backupKeep {
+		if err := os.Remove(old[0]); err != nil {
+			return err
+		}
+		old = old[1:]
+	}
+	return nil
+}
+
+// backupToS3 uploads a backup under --backup_s3, returning its URL.
+func backupToS3(ctx context.Context, name string, data []byte) (string, error) {
+	u, err := url.Parse(*backupS3)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return "", fmt.Errorf("invalid --backup_s3 %q, want s3://bucket/prefix", *backupS3)
+	}
+	key := strings.Trim(u.Path, "/")
+	if key != "" {
+		key += "/"
+	}
+	key += name
+	endpoint := *backupS3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + *backupS3Region + ".amazonaws.com"
+	}
+	target := strings.TrimRight(endpoint, "/") + "/" + u.Host + "/" + key
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := signS3(req, data, time.Now()); err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("S3 returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return "s3://" + u.Host + "/" + key, nil
+}
+
+// signS3 signs an S3 request with AWS signature version 4.
+func signS3(r *http.Request, body []byte, now time.Time) error {
+	id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	stamp := now.UTC().Format("20060102T150405Z")
+	day := stamp[:8]
+	bodySum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(bodySum[:])
+	r.Header.Set("X-Amz-Date", stamp)
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	headers := []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		r.Header.Set("X-Amz-Security-Token", token)
+		headers = append(headers, "x-amz-security-token")
+	}
+	var canonical strings.Builder
+	fmt.Fprintf(&canonical, "%s\n%s\n%s\n", r.Method, r.URL.EscapedPath(), r.URL.RawQuery)
+	for _, h := range headers {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.URL.Host
+		}
+		fmt.Fprintf(&canonical, "%s:%s\n", h, strings.TrimSpace(v))
+	}
+	signed := strings.Join(headers, ";")
+	fmt.Fprintf(&canonical, "\n%s\n%s", signed, payloadHash)
+	scope := day + "/" + *backupS3Region + "/s3/aws4_request"
+	canonicalSum := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{day, *backupS3Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		id, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// notifyBackup posts the results of a backup run to --backup_webhook.
+func notifyBackup(results []BackupResult) {
+	payload, err := json.Marshal(results)
+	if err != nil {
+		logf(modNetwork, LevelError, "Error encoding backup summary: %v", err)
+		return
+	}
+	resp, err := http.Post(*backupWebhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		logf(modNetwork, LevelError, "Error sending backup summary: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		logf(modNetwork, LevelError, "Backup webhook returned %s", resp.Status)
+	}
+}
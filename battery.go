@@ -0,0 +1,49 @@
+// This file contains the battery metrics of nodes.
+package mysensors
+
+import "flag"
+
+var batteryVoltsSensor = flag.Int("battery_volts_sensor", -1, "Child sensor ID whose V_VOLTAGE is its node's battery voltage, exported as mysensors_node_battery_volts, eg 255 for the node itself; -1 for none")
+
+const (
+	batteryRatioMetric = "mysensors_node_battery_ratio"
+	batteryVoltsMetric = "mysensors_node_battery_volts"
+)
+
+func init() {
+	fixedGauges[batteryRatioMetric] = fixedVec{
+		help:   "Battery level reported by the node with I_BATTERY_LEVEL, 0 to 1",
+		labels: nodeLabels,
+	}
+	fixedGauges[batteryVoltsMetric] = fixedVec{
+		help:   "Battery voltage reported by the node as V_VOLTAGE of the --battery_volts_sensor child",
+		labels: nodeLabels,
+	}
+}
+
+// exportBattery exports the battery level and voltage of the node, if known.
+func (n *Node) exportBattery() {
+	l := n.labels()
+	if n.Battery != nil {
+		n.gauge(batteryRatioMetric).WithLabelValues(l...).Set(float64(*n.Battery) / 100)
+	}
+	if n.BatteryVolts != nil {
+		n.gauge(batteryVoltsMetric).WithLabelValues(l...).Set(*n.BatteryVolts)
+	}
+}
+
+// batteryVolts records V_VOLTAGE as the node's battery voltage, if the sensor
+// is the --battery_volts_sensor child. Other voltages, eg of multimeters, are
+// only exported as voltage_volts.
+func (s *Sensor) batteryVolts(v *Var) {
+	if v.Type != varFloat || s.Ignored || int(s.ID) != *batteryVoltsSensor {
+		return
+	}
+	s.node.setBatteryVolts(v.FloatVal)
+}
+
+// setBatteryVolts records the node's battery voltage.
+func (n *Node) setBatteryVolts(volts float64) {
+	n.BatteryVolts = &volts
+	n.exportBattery()
+}
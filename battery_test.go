@@ -0,0 +1,58 @@
+package mysensors
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBatteryVolts(t *testing.T) {
+	sensor := *batteryVoltsSensor
+	defer func() { *batteryVoltsSensor = sensor }()
+	for _, tc := range []struct {
+		sensor int
+		line   string
+		want   float64
+	}{
+		{-1, "5;1;1;0;38;3.3", 0},
+		{1, "5;1;1;0;38;3.3", 3.3},
+		{1, "5;2;1;0;38;3.3", 0},
+		{255, "5;255;1;0;38;3.3", 3.3},
+		{255, "5;1;1;0;38;3.3", 0},
+		{-1, "5;255;1;0;38;3.3", 0},
+	} {
+		*batteryVoltsSensor = tc.sensor
+		n := NewNetwork()
+		m := &Message{}
+		if err := m.Unmarshal([]byte(tc.line)); err != nil {
+			t.Fatal(err)
+		}
+		n.HandleMessage(m, nil)
+		got := 0.0
+		if v := n.Nodes[nodeKey("", 5)].BatteryVolts; v != nil {
+			got = *v
+		}
+		if got != tc.want {
+			t.Errorf("--battery_volts_sensor=%d, %s: battery volts %g, want %g", tc.sensor, tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestBatteryRegisterer(t *testing.T) {
+	// Each network's node gauges are on its own registry.
+	for _, level := range []string{"50", "80"} {
+		r := prometheus.NewRegistry()
+		n := NewNetwork(WithRegisterer(r))
+		n.HandleMessage(&Message{NodeID: 5, ChildSensorID: NoChild, Type: MsgInternal, SubType: I_BATTERY_LEVEL, Payload: []byte(level)}, nil)
+		want := `
+# HELP mysensors_node_battery_ratio Battery level reported by the node with I_BATTERY_LEVEL, 0 to 1
+# TYPE mysensors_node_battery_ratio gauge
+mysensors_node_battery_ratio{gateway="",location="",name="",node="5"} 0.` + level[:1] + `
+`
+		if err := testutil.GatherAndCompare(r, strings.NewReader(want), "mysensors_node_battery_ratio"); err != nil {
+			t.Errorf("battery level %s: %v", level, err)
+		}
+	}
+}
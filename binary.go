@@ -0,0 +1,47 @@
+// This file contains the export of on/off variables.
+package mysensors
+
+import "strings"
+
+// binaryMetrics maps on/off variables to the metrics they are exported as,
+// 0 or 1.
+var binaryMetrics = map[SubTypeSetReq]string{
+	V_STATUS:      "mysensors_status",
+	V_TRIPPED:     "mysensors_tripped",
+	V_ARMED:       "mysensors_armed",
+	V_LOCK_STATUS: "mysensors_lock_status",
+}
+
+func init() {
+	for t, name := range binaryMetrics {
+		fixedGauges[name] = fixedVec{help: "MYSENSORS " + t.String() + ", 0 or 1", labels: sensorLabels}
+	}
+}
+
+// parseBinary parses an on/off payload.
+func parseBinary(payload string) (float64, bool) {
+	switch strings.ToLower(strings.TrimSpace(payload)) {
+	case "0", "false", "off":
+		return 0, true
+	case "1", "true", "on":
+		return 1, true
+	}
+	return 0, false
+}
+
+// exportBinary exports an on/off variable as 0 or 1. Other payloads remove
+// the series, rather than leaving the previous state.
+func (s *Sensor) exportBinary(v *Var) {
+	name, ok := binaryMetrics[v.SubType]
+	if !ok {
+		return
+	}
+	se := Series{Metric: name, Labels: s.labels()}
+	f, ok := parseBinary(v.Value())
+	if !ok {
+		logf(modNetwork, LevelDebug, "Node %d sensor %d sent %s %q, want 0 or 1", s.node.ID, s.ID, v.SubType, v.Value())
+		s.unexport(se)
+		return
+	}
+	s.export(name, se.Labels, f)
+}
@@ -0,0 +1,103 @@
+// This file contains the collection of sensor values at scrape time.
+package mysensors
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	scrapeTimeMetrics = flag.Bool("scrape_time_metrics", false, "Generate the sensor value metrics from the network state when scraped, rather than updating gauges as values arrive, so nodes removed from the state disappear")
+	metricTimestamps  = flag.Bool("metric_timestamps", false, "With --scrape_time_metrics, timestamp values with when they were received. Prometheus hides values older than its lookback delta, 5m by default")
+)
+
+// Describe implements prometheus.Collector. The metrics depend on the
+// sensors, so none are described and the network is an unchecked collector.
+func (n *Network) Describe(chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector, sending the sensor values as
+// gauges named as by Gauges.
+func (n *Network) Collect(ch chan<- prometheus.Metric) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.collect(ch)
+}
+
+// collect sends the sensor values. n.mux must be held.
+func (n *Network) collect(ch chan<- prometheus.Metric) {
+	g := n.gauges
+	labels := g.Labels
+	if g.profile.labels != nil {
+		labels = g.profile.labels
+	}
+	// The first help of a name is used for all its series, and each series
+	// is sent once, as a registry fails the scrape otherwise.
+	descs := map[string]*prometheus.Desc{}
+	sent := map[string]bool{}
+	now := time.Now()
+	for _, nd := range n.Nodes {
+		for _, s := range nd.Sensors {
+			if s.Ignored || s.stale(now) {
+				continue
+			}
+			for _, v := range s.Vars {
+				name, help, value := "", "", s.converted(v.SubType, v.FloatVal)
+				if r := s.rule(v.SubType); r != nil {
+					// Mapped counters are kept by the Counters.
+					f, ok := r.value(v)
+					if r.Type == "counter" || !ok {
+						continue
+					}
+					name, help, value = r.Metric, fmt.Sprintf("MYSENSORS %s", v.SubType), f
+				} else if v.Type != varFloat || s.airQuality(v.SubType) || (nd.legacy() && v.SubType == V_LEVEL) {
+					// Air quality and 1.4 dust levels have their own gauges.
+					continue
+				} else if name, help, _ = g.metric(v.SubType, s.metricUnit(v.SubType)); name == "" {
+					continue
+				}
+				values := g.profile.values(v.SubType, s.labels())
+				key := name + "\xff" + strings.Join(values, "\xff")
+				if sent[key] {
+					continue
+				}
+				sent[key] = true
+				desc, ok := descs[name]
+				if !ok {
+					desc = prometheus.NewDesc(name, help, labels, g.constLabels)
+					descs[name] = desc
+				}
+				m, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, value, values...)
+				if err != nil {
+					logf(modNetwork, LevelDebug, "Error collecting %s: %v", name, err)
+					continue
+				}
+				if *metricTimestamps && !v.Updated.IsZero() {
+					m = prometheus.NewMetricWithTimestamp(v.Updated, m)
+				}
+				ch <- m
+			}
+		}
+	}
+}
+
+// networkCollector collects the network's sensor values for the registry
+// it was registered with. Unchecked collectors can't be unregistered, so it
+// collects nothing once the network moves to another registry.
+type networkCollector struct {
+	n        *Network
+	registry prometheus.Registerer
+}
+
+func (c *networkCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c *networkCollector) Collect(ch chan<- prometheus.Metric) {
+	c.n.mux.Lock()
+	defer c.n.mux.Unlock()
+	if c.n.registry == c.registry {
+		c.n.collect(ch)
+	}
+}
@@ -0,0 +1,76 @@
+// This file contains the I_CONFIG replies telling nodes which units to
+// report in.
+package mysensors
+
+import (
+	"flag"
+	"fmt"
+)
+
+var nodeConfig = flag.String("node_config", "M", "I_CONFIG reply telling nodes which units to use: M for metric or I for imperial. Nodes can override it with Config in the state file")
+
+// unitSystems are the valid I_CONFIG payloads, and their names in
+// mysensors_node_info.
+var unitSystems = map[string]string{
+	"M": "metric",
+	"I": "imperial",
+}
+
+// CheckNodeConfig returns an error if --node_config is invalid.
+func CheckNodeConfig() error {
+	if _, ok := unitSystems[*nodeConfig]; !ok {
+		return fmt.Errorf("invalid --node_config %q, want M or I", *nodeConfig)
+	}
+	return nil
+}
+
+// defaultConfig returns --node_config, or M if it is invalid. See
+// CheckNodeConfig.
+func defaultConfig() string {
+	if _, ok := unitSystems[*nodeConfig]; ok {
+		return *nodeConfig
+	}
+	return "M"
+}
+
+// config returns the I_CONFIG reply for the node: its Config, or
+// --node_config.
+func (n *Node) config() string {
+	if _, ok := unitSystems[n.Config]; ok {
+		return n.Config
+	}
+	return defaultConfig()
+}
+
+// NodeConfig returns the I_CONFIG reply for a node on the gateway, and
+// records that the node uses it.
+func (n *Network) NodeConfig(gateway string, id uint8) string {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	nd, err := n.node(gateway, id)
+	if err != nil {
+		return defaultConfig()
+	}
+	nd.exportInfo()
+	return nd.config()
+}
+
+// SetNodeConfig sets the I_CONFIG reply for a node on the gateway, which may
+// be empty if the ID is only on one, to M or I, or empty for --node_config.
+// Nodes only request it when starting, so must be restarted for it to take
+// effect.
+func (n *Network) SetNodeConfig(gateway string, id uint8, config string) error {
+	if _, ok := unitSystems[config]; !ok && config != "" {
+		return fmt.Errorf("invalid config %q, want M or I", config)
+	}
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	nd, err := n.node(gateway, id)
+	if err != nil {
+		return err
+	}
+	nd.Config = config
+	nd.exportInfo()
+	n.changed()
+	return nil
+}
@@ -0,0 +1,217 @@
+// This file contains validation of messages against the MySensors serial
+// API 2.x specification.
+package mysensors
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxNodeID is the highest node ID; BroadcastID addresses all nodes.
+const maxNodeID = 254
+
+var nonconformantCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mysensors_nonconformant_messages_total",
+	Help: "Received messages not conforming to the serial API specification",
+}, []string{"gateway"})
+
+func init() {
+	mustRegister(nonconformantCount)
+}
+
+// payloadFormat validates a payload, returning a description of the
+// problem or "".
+type payloadFormat func(p string) string
+
+// numeric accepts decimal numbers within min and max.
+func numeric(min, max float64) payloadFormat {
+	return func(p string) string {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return "payload is not a number"
+		}
+		if v < min || v > max {
+			return fmt.Sprintf("payload %v outside %v to %v", v, min, max)
+		}
+		return ""
+	}
+}
+
+// anyNumber accepts any decimal number.
+var anyNumber = numeric(-1e308, 1e308)
+
+// boolean accepts 0 and 1.
+func boolean(p string) string {
+	if p != "0" && p != "1" {
+		return "payload is not 0 or 1"
+	}
+	return ""
+}
+
+// hexBytes accepts n bytes in hex, optionally prefixed with #.
+func hexBytes(n int) payloadFormat {
+	return func(p string) string {
+		b, err := hex.DecodeString(strings.TrimPrefix(p, "#"))
+		if err != nil || len(b) != n {
+			return fmt.Sprintf("payload is not %d hex bytes", n)
+		}
+		return ""
+	}
+}
+
+// setReqFormats are the payload formats of set messages, per the serial API.
+var setReqFormats = map[SubTypeSetReq]payloadFormat{
+	V_TEMP:               anyNumber,
+	V_HUM:                numeric(0, 100),
+	V_STATUS:             boolean,
+	V_PERCENTAGE:         numeric(0, 100),
+	V_PRESSURE:           anyNumber,
+	V_RAIN:               anyNumber,
+	V_RAINRATE:           anyNumber,
+	V_WIND:               anyNumber,
+	V_GUST:               anyNumber,
+	V_DIRECTION:          numeric(0, 360),
+	V_UV:                 anyNumber,
+	V_WEIGHT:             anyNumber,
+	V_DISTANCE:           anyNumber,
+	V_IMPEDANCE:          anyNumber,
+	V_ARMED:              boolean,
+	V_TRIPPED:            boolean,
+	V_WATT:               anyNumber,
+	V_KWH:                anyNumber,
+	V_LIGHT_LEVEL:        numeric(0, 100),
+	V_FLOW:               anyNumber,
+	V_VOLUME:             anyNumber,
+	V_LOCK_STATUS:        boolean,
+	V_LEVEL:              anyNumber,
+	V_VOLTAGE:            anyNumber,
+	V_CURRENT:            anyNumber,
+	V_RGB:                hexBytes(3),
+	V_RGBW:               hexBytes(4),
+	V_HVAC_SETPOINT_COOL: anyNumber,
+	V_HVAC_SETPOINT_HEAT: anyNumber,
+	V_PH:                 numeric(0, 14),
+	V_ORP:                anyNumber,
+	V_EC:                 anyNumber,
+	V_VAR:                anyNumber,
+	V_VA:                 anyNumber,
+	V_POWER_FACTOR:       numeric(-1, 1),
+}
+
+// internalFormats are the payload formats of internal messages from nodes.
+var internalFormats = map[SubTypeInternal]payloadFormat{
+	I_BATTERY_LEVEL: numeric(0, 100),
+	I_TIME:          numeric(0, 1<<32-1),
+}
+
+// Conform returns the ways a received message violates the serial API
+// specification, or nil if it conforms.
+func Conform(m *Message) []string {
+	var v []string
+	if m.NodeID > maxNodeID {
+		v = append(v, fmt.Sprintf("node id %d is reserved for broadcasts", m.NodeID))
+	}
+	if len(m.Payload) > MaxPayload*2 || (m.Type != MsgStream && len(m.Payload) > MaxPayload) {
+		v = append(v, fmt.Sprintf("payload of %d bytes exceeds %d", len(m.Payload), MaxPayload))
+	}
+	p := string(m.Payload)
+	switch st := m.SubType.(type) {
+	case SubTypePresentation:
+		if int(st) >= len(subTypePresentation) {
+			v = append(v, fmt.Sprintf("unknown presentation %d", st))
+		}
+	case SubTypeSetReq:
+		if !st.known() {
+			v = append(v, fmt.Sprintf("unknown variable %d", st))
+		} else if f, ok := setReqFormats[st]; ok && m.Type == MsgSet {
+			if problem := f(p); problem != "" {
+				v = append(v, st.String()+" "+problem)
+			}
+		}
+		if m.ChildSensorID == NoChild {
+			v = append(v, fmt.Sprintf("%s message to the node itself", m.Type))
+		}
+	case SubTypeInternal:
+		if int(st) >= len(subTypeInternal) {
+			v = append(v, fmt.Sprintf("unknown internal %d", st))
+		} else if f, ok := internalFormats[st]; ok && p != "" {
+			if problem := f(p); problem != "" {
+				v = append(v, st.String()+" "+problem)
+			}
+		}
+	case SubTypeStream:
+		if int(st) >= len(subTypeStream) {
+			v = append(v, fmt.Sprintf("unknown stream %d", st))
+		}
+		if _, err := hex.DecodeString(p); err != nil {
+			v = append(v, "stream payload is not hex")
+		}
+	default:
+		v = append(v, fmt.Sprintf("unknown message type %d", m.Type))
+	}
+	return v
+}
+
+// Violation is a kind of non-conformant traffic seen from a node.
+type Violation struct {
+	Node        uint8
+	Problem     string
+	Count       int
+	LastSeen    time.Time
+	LastMessage string
+}
+
+// checkConformance records the ways m violates the specification, and
+// returns whether it does. n.mux must be held.
+func (n *Network) checkConformance(m *Message) bool {
+	problems := Conform(m)
+	if len(problems) == 0 {
+		return true
+	}
+	nonconformantCount.WithLabelValues(m.Gateway).Inc()
+	if n.violations == nil {
+		n.violations = map[uint8]map[string]*Violation{}
+	}
+	vs, ok := n.violations[m.NodeID]
+	if !ok {
+		vs = map[string]*Violation{}
+		n.violations[m.NodeID] = vs
+	}
+	for _, p := range problems {
+		v, ok := vs[p]
+		if !ok {
+			v = &Violation{Node: m.NodeID, Problem: p}
+			vs[p] = v
+			logf(modNetwork, LevelWarn, "Non-conformant message from node %d: %s", m.NodeID, p)
+		}
+		v.Count++
+		v.LastSeen = time.Now()
+		v.LastMessage = strings.TrimSpace(string(m.Marshal()))
+	}
+	return false
+}
+
+// Conformance returns the non-conformant traffic seen, by node.
+func (n *Network) Conformance() []Violation {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	report := []Violation{}
+	for _, vs := range n.violations {
+		for _, v := range vs {
+			report = append(report, *v)
+		}
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Node != report[j].Node {
+			return report[i].Node < report[j].Node
+		}
+		return report[i].Problem < report[j].Problem
+	})
+	return report
+}
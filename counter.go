@@ -0,0 +1,85 @@
+// This file contains the counters of cumulative variables, eg the volume of
+// water meters.
+package mysensors
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const counterResetsMetric = "mysensors_counter_resets_total"
+
+func init() {
+	fixedCounters[counterResetsMetric] = fixedVec{
+		help:   "Cumulative totals that went down, eg as the node restarted",
+		labels: []string{"node", "sensor", "gateway"},
+	}
+}
+
+// resetLabels are the labels of the sensor's counter resets series.
+func (s *Sensor) resetLabels() []string {
+	return []string{strconv.Itoa(int(s.node.ID)), strconv.Itoa(int(s.ID)), s.node.Gateway}
+}
+
+// counted returns the total the variable reports, if it is counted: in
+// CounterMap, or mapped to a counter, in which case the total is scaled per
+// the rule.
+func (s *Sensor) counted(v *Var) (float64, bool) {
+	if r := s.rule(v.SubType); r != nil {
+		if r.Type != "counter" {
+			return 0, false
+		}
+		return r.value(v)
+	}
+	if _, ok := CounterMap[v.SubType]; !ok || v.Type != varFloat {
+		return 0, false
+	}
+	return v.FloatVal, true
+}
+
+// count adds the increase of the total reported in v since the previous
+// value to its counter, and exports it. The first total is the baseline, and
+// a lower total means the node restarted counting from 0, so all of it is
+// added, unless negative. A negative total is a glitch, so counting restarts
+// from 0 after it too.
+func (s *Sensor) count(previous, v *Var) {
+	f, ok := s.counted(v)
+	if !ok {
+		return
+	}
+	var p float64
+	if previous != nil {
+		p, ok = s.counted(previous)
+	}
+	switch {
+	case previous == nil || !ok:
+	case p < 0:
+		if f > 0 {
+			v.Total += f
+		}
+	case f >= p:
+		v.Total += f - p
+	default:
+		logf(modNetwork, LevelInfo, "Node %d sensor %d %s went down from %g to %g, counting from 0.", s.node.ID, s.ID, v.SubType, p, f)
+		s.node.counter(counterResetsMetric).WithLabelValues(s.resetLabels()...).Inc()
+		if f > 0 {
+			v.Total += f
+		}
+	}
+	s.exportCounter(v)
+}
+
+// exportCounter exports the counter of the variable, if in CounterMap or
+// mapped to a counter.
+func (s *Sensor) exportCounter(v *Var) {
+	if _, ok := s.counted(v); !ok || s.Ignored {
+		return
+	}
+	if r := s.rule(v.SubType); r != nil {
+		if s.node.network.counters.set(r.Metric, fmt.Sprintf("MYSENSORS %s", v.SubType), s.labels(), v.Total) != nil {
+			s.track(Series{Metric: r.Metric, Labels: s.labels()})
+		}
+		return
+	}
+	s.track(s.node.network.counters.Set(v.SubType, s.labels(), v.Total)...)
+}
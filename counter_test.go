@@ -0,0 +1,35 @@
+package mysensors
+
+import "testing"
+
+func TestCount(t *testing.T) {
+	n := NewNetwork()
+	set := func(payload string) float64 {
+		m := &Message{NodeID: 5, ChildSensorID: 1, Type: MsgSet, SubType: V_VOLUME, Payload: []byte(payload)}
+		if err := n.HandleMessage(m, nil); err != nil {
+			t.Fatalf("HandleMessage(%s): %v", m, err)
+		}
+		return n.Nodes[nodeKey("", 5)].Sensors["1"].Vars[V_VOLUME.String()].Total
+	}
+	for _, tc := range []struct {
+		payload string
+		total   float64
+	}{
+		// The first total is the baseline.
+		{"100", 0},
+		{"110", 10},
+		{"110", 10},
+		{"112.5", 12.5},
+		// The node restarted counting from 0.
+		{"3", 15.5},
+		{"4", 16.5},
+		// Negative totals are not counted, and counting restarts from 0.
+		{"-2", 16.5},
+		{"1", 17.5},
+		{"2", 18.5},
+	} {
+		if got := set(tc.payload); got != tc.total {
+			t.Errorf("after %s, total = %g, want %g", tc.payload, got, tc.total)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// This file contains duplicate message suppression.
+package mysensors
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	txDedupWindow = flag.Duration("tx_dedup_window", 0, "Collapse a set command repeating the last one sent for the same node, sensor and variable within this window, 0 to disable")
+	rxDedupWindow = flag.Duration("rx_dedup_window", 0, "Suppress a set message repeating the last value received for the same node, sensor and variable within this window, 0 to disable")
+)
+
+var (
+	txCollapsedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_tx_collapsed_total",
+		Help: "Identical set commands collapsed within the dedup window",
+	}, []string{"gateway"})
+	rxSuppressedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_duplicates_suppressed_total",
+		Help: "Identical set messages received within the dedup window and suppressed",
+	}, []string{"gateway"})
+)
+
+func init() {
+	mustRegister(txCollapsedCount, rxSuppressedCount)
+}
+
+// dedup tracks the last payload seen for each key, to suppress repeats of
+// it within a window.
+type dedup struct {
+	window time.Duration
+	mux    sync.Mutex
+	seen   map[string]dedupEntry
+}
+
+// dedupEntry is the last payload seen for a key, and when it was first seen.
+type dedupEntry struct {
+	payload string
+	t       time.Time
+}
+
+func newDedup(window time.Duration) *dedup {
+	return &dedup{window: window, seen: make(map[string]dedupEntry)}
+}
+
+// duplicate reports whether payload is the last one seen for key, and was
+// first seen within the window. Otherwise it records payload for key.
+func (d *dedup) duplicate(key, payload string, now time.Time) bool {
+	if d.window <= 0 {
+		return false
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if len(d.seen) > 1000 {
+		for k, e := range d.seen {
+			if now.Sub(e.t) > d.window {
+				delete(d.seen, k)
+			}
+		}
+	}
+	e, ok := d.seen[key]
+	if ok && e.payload == payload && now.Sub(e.t) <= d.window {
+		return true
+	}
+	d.seen[key] = dedupEntry{payload: payload, t: now}
+	return false
+}
+
+// dedupKey identifies the variable a set message is for.
+func dedupKey(m *Message) string {
+	return string([]byte{m.NodeID, m.ChildSensorID, m.SubType.Value()})
+}
+
+// collapseTx reports whether an outbound message repeats the last command
+// sent for its variable within the window, and should not be sent. Messages
+// with ack set are never collapsed, as they may be retransmissions.
+func (h *Handler) collapseTx(m *Message, frame []byte) bool {
+	if m.Type != MsgSet || m.Ack == Ack || !h.txDedup.duplicate(dedupKey(m), string(m.Payload), time.Now()) {
+		return false
+	}
+	txCollapsedCount.WithLabelValues(h.Gateway).Inc()
+	logf(modHandler, LevelDebug, "TX collapsed: %s", frame)
+	return true
+}
+
+// suppressRx reports whether a received message repeats the last value
+// from the node for its variable within the window, and should be dropped.
+// Ack echoes are never suppressed.
+func (h *Handler) suppressRx(m *Message) bool {
+	if h.rxDedup.window <= 0 || m.Type != MsgSet || m.Ack == Ack {
+		return false
+	}
+	if !h.rxDedup.duplicate(m.Gateway+"\xff"+dedupKey(m), string(m.Payload), time.Now()) {
+		return false
+	}
+	rxSuppressedCount.WithLabelValues(h.Gateway).Inc()
+	logf(modHandler, LevelDebug, "RX duplicate suppressed: %s", m)
+	return true
+}
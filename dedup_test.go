@@ -0,0 +1,46 @@
+package mysensors
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCollapseTx(t *testing.T) {
+	h := &Handler{txDedup: newDedup(time.Minute)}
+	for _, tc := range []struct {
+		m    *Message
+		want bool
+	}{
+		{&Message{NodeID: 1, ChildSensorID: 2, Type: MsgSet, SubType: V_STATUS, Payload: []byte("1")}, false},
+		{&Message{NodeID: 1, ChildSensorID: 2, Type: MsgSet, SubType: V_STATUS, Payload: []byte("1")}, true},
+		{&Message{NodeID: 1, ChildSensorID: 2, Type: MsgSet, SubType: V_STATUS, Payload: []byte("0")}, false},
+		// Switching back on must be sent, though "1" was sent recently.
+		{&Message{NodeID: 1, ChildSensorID: 2, Type: MsgSet, SubType: V_STATUS, Payload: []byte("1")}, false},
+		{&Message{NodeID: 1, ChildSensorID: 3, Type: MsgSet, SubType: V_STATUS, Payload: []byte("1")}, false},
+		{&Message{NodeID: 1, ChildSensorID: 2, Type: MsgSet, SubType: V_STATUS, Ack: Ack, Payload: []byte("1")}, false},
+	} {
+		if got := h.collapseTx(tc.m, tc.m.Marshal()); got != tc.want {
+			t.Errorf("collapseTx(%s) = %v, want %v", tc.m, got, tc.want)
+		}
+	}
+}
+
+func TestSuppressRx(t *testing.T) {
+	h := &Handler{rxDedup: newDedup(time.Minute)}
+	for _, tc := range []struct {
+		m    *Message
+		want bool
+	}{
+		{&Message{NodeID: 1, ChildSensorID: 2, Type: MsgSet, SubType: V_TRIPPED, Payload: []byte("1")}, false},
+		{&Message{NodeID: 1, ChildSensorID: 2, Type: MsgSet, SubType: V_TRIPPED, Payload: []byte("1")}, true},
+		{&Message{NodeID: 1, ChildSensorID: 2, Type: MsgSet, SubType: V_TRIPPED, Payload: []byte("0")}, false},
+		// Opening again must be kept, though "1" was received recently.
+		{&Message{NodeID: 1, ChildSensorID: 2, Type: MsgSet, SubType: V_TRIPPED, Payload: []byte("1")}, false},
+		{&Message{NodeID: 1, ChildSensorID: 2, Type: MsgSet, SubType: V_TRIPPED, Payload: []byte("1"), Gateway: "gw2"}, false},
+		{&Message{NodeID: 1, ChildSensorID: 2, Type: MsgSet, SubType: V_TRIPPED, Ack: Ack, Payload: []byte("1")}, false},
+	} {
+		if got := h.suppressRx(tc.m); got != tc.want {
+			t.Errorf("suppressRx(%s) = %v, want %v", tc.m, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// This file contains the expiry of values from silent sensors.
+package mysensors
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	valueTTL       = flag.Duration("value_ttl", 0, "Stop exporting the values of sensors silent for this long, 0 to export them forever")
+	valueTTLByType = flag.String("value_ttl_by_type", "", "Comma separated --value_ttl overrides per presentation type, eg S_DOOR=24h,S_TEMP=30m")
+)
+
+// expiryInterval is the interval between checks for expired values.
+const expiryInterval = time.Minute
+
+var expiredCount = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "mysensors_expired_sensors_total",
+	Help: "Sensors whose values stopped being exported, as they were silent for longer than their TTL",
+})
+
+func init() {
+	mustRegister(expiredCount)
+}
+
+// ttlByType is the parsed --value_ttl_by_type, see CheckValueTTLs.
+var ttlByType map[SubTypePresentation]time.Duration
+
+// CheckValueTTLs parses --value_ttl_by_type, returning an error if it is
+// invalid. It must be called before ExpireValues.
+func CheckValueTTLs() error {
+	ttls, err := parseTTLs(*valueTTLByType)
+	if err != nil {
+		return fmt.Errorf("invalid --value_ttl_by_type: %v", err)
+	}
+	ttlByType = ttls
+	return nil
+}
+
+// parseTTLs parses --value_ttl_by_type.
+func parseTTLs(spec string) (map[SubTypePresentation]time.Duration, error) {
+	ttls := map[SubTypePresentation]time.Duration{}
+	for _, kv := range strings.Split(spec, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid TTL %q, want eg S_TEMP=30m", kv)
+		}
+		st, err := parseSubType(MsgPresentation, parts[0])
+		if err != nil {
+			return nil, err
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		ttls[st.(SubTypePresentation)] = d
+	}
+	return ttls, nil
+}
+
+// ttl returns how long the sensor's values are exported after it was last
+// heard from, or 0 for forever.
+func (s *Sensor) ttl() time.Duration {
+	if s.Presentation != nil {
+		if d, ok := ttlByType[*s.Presentation]; ok {
+			return d
+		}
+	}
+	return *valueTTL
+}
+
+// stale returns whether the sensor's values have expired.
+func (s *Sensor) stale(now time.Time) bool {
+	ttl := s.ttl()
+	return ttl > 0 && !s.LastSeen.IsZero() && now.Sub(s.LastSeen) > ttl
+}
+
+// ExpireValues stops exporting the values of silent sensors, per
+// --value_ttl and --value_ttl_by_type, until ctx is done. Values are
+// exported again as they are received. The sensors' last seen times are
+// kept, so silent sensors can be alerted on. The series of nodes silent for
+// --value_ttl, including their last seen time, are expired too.
+func (n *Network) ExpireValues(ctx context.Context) {
+	if *valueTTL <= 0 && *valueTTLByType == "" {
+		return
+	}
+	t := time.NewTicker(expiryInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			n.expire(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// stale returns whether the node's series have expired.
+func (nd *Node) stale(now time.Time) bool {
+	return *valueTTL > 0 && !nd.LastSeen.IsZero() && now.Sub(nd.LastSeen) > *valueTTL
+}
+
+// expire unexports the series of stale nodes, and of stale sensors except
+// when last seen.
+func (n *Network) expire(now time.Time) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	for _, nd := range n.Nodes {
+		if !nd.expired && nd.stale(now) {
+			nd.unexportSeries()
+			nd.expired = true
+			logf(modNetwork, LevelInfo, "Node %d silent since %s, expired its series.", nd.ID, nd.LastSeen.Format(time.RFC3339))
+		}
+		for _, s := range nd.Sensors {
+			if !s.stale(now) {
+				continue
+			}
+			expired := false
+			for _, se := range s.Series {
+				if se.Metric != lastSeenMetric {
+					s.unexport(se)
+					expired = true
+				}
+			}
+			if expired {
+				s.unexportResets()
+				expiredCount.Inc()
+				logf(modNetwork, LevelInfo, "Sensor %d/%d silent since %s, expired its values.", nd.ID, s.ID, s.LastSeen.Format(time.RFC3339))
+			}
+		}
+	}
+}
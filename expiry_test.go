@@ -0,0 +1,44 @@
+package mysensors
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestExpireNode(t *testing.T) {
+	ttl := *valueTTL
+	defer func() { *valueTTL = ttl }()
+	*valueTTL = time.Hour
+	r := prometheus.NewRegistry()
+	n := NewNetwork(WithRegisterer(r))
+	heartbeat := &Message{NodeID: 5, ChildSensorID: NoChild, Type: MsgInternal, SubType: I_HEARTBEAT_RESPONSE, Payload: []byte("")}
+	battery := &Message{NodeID: 5, ChildSensorID: NoChild, Type: MsgInternal, SubType: I_BATTERY_LEVEL, Payload: []byte("50")}
+	n.HandleMessage(heartbeat, nil)
+	n.HandleMessage(battery, nil)
+	count := func() int {
+		c, err := testutil.GatherAndCount(r, batteryRatioMetric, heartbeatMetric, lastSeenMetric)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	if got := count(); got != 3 {
+		t.Fatalf("%d battery, heartbeat and last seen series, want 3", got)
+	}
+	n.expire(time.Now().Add(30 * time.Minute))
+	if got := count(); got != 3 {
+		t.Errorf("%d battery, heartbeat and last seen series before the TTL, want 3", got)
+	}
+	n.expire(time.Now().Add(2 * time.Hour))
+	if got := count(); got != 0 {
+		t.Errorf("%d battery, heartbeat and last seen series after the TTL, want 0", got)
+	}
+	// Any message exports the node's series again.
+	n.HandleMessage(heartbeat, nil)
+	if got := count(); got != 3 {
+		t.Errorf("%d battery, heartbeat and last seen series after the node reported, want 3", got)
+	}
+}
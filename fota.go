@@ -0,0 +1,282 @@
+// This file contains over the air firmware updates of nodes.
+package mysensors
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// firmwareBlockSize is the firmware bytes sent per message.
+	firmwareBlockSize = 16
+	// firmwarePadding is the size images are padded to, with 0xff.
+	firmwarePadding = 128
+)
+
+var (
+	firmwareProgressGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mysensors_firmware_update_progress_ratio",
+		Help: "Progress of the firmware update of a node, from 0 to 1",
+	}, []string{"node", "gateway"})
+	firmwareBlocksCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_firmware_blocks_sent_total",
+		Help: "Firmware blocks sent to a node",
+	}, []string{"node", "gateway"})
+)
+
+func init() {
+	mustRegister(firmwareProgressGauge, firmwareBlocksCount)
+}
+
+// Firmware is a firmware image for nodes.
+type Firmware struct {
+	Type    uint16
+	Version uint16
+	Blocks  uint16
+	CRC     uint16
+
+	data []byte
+}
+
+// NewFirmware returns the firmware of the given type and version with the
+// binary image data, padded as nodes expect.
+func NewFirmware(typ, version uint16, data []byte) (*Firmware, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty firmware")
+	}
+	padded := len(data)
+	if padded%firmwarePadding != 0 {
+		padded += firmwarePadding - padded%firmwarePadding
+	}
+	if padded/firmwareBlockSize > 0xffff {
+		return nil, fmt.Errorf("firmware too large: %d bytes", len(data))
+	}
+	d := make([]byte, padded)
+	copy(d, data)
+	for i := len(data); i < padded; i++ {
+		d[i] = 0xff
+	}
+	return &Firmware{
+		Type:    typ,
+		Version: version,
+		Blocks:  uint16(padded / firmwareBlockSize),
+		CRC:     firmwareCRC(d),
+		data:    d,
+	}, nil
+}
+
+// firmwareCRC returns the CRC16 nodes check the image against.
+func firmwareCRC(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// ParseIntelHex reads a firmware image in Intel HEX format, as built by
+// the Arduino IDE.
+func ParseIntelHex(r io.Reader) ([]byte, error) {
+	var data []byte
+	var base uint32
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		l := strings.TrimSpace(s.Text())
+		if l == "" {
+			continue
+		}
+		if !strings.HasPrefix(l, ":") {
+			return nil, fmt.Errorf("line %d: missing start code", line)
+		}
+		rec, err := hex.DecodeString(l[1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if len(rec) < 5 || len(rec) != int(rec[0])+5 {
+			return nil, fmt.Errorf("line %d: bad record length", line)
+		}
+		var sum byte
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0 {
+			return nil, fmt.Errorf("line %d: bad checksum", line)
+		}
+		payload := rec[4 : len(rec)-1]
+		switch rec[3] {
+		case 0x00:
+			addr := base + uint32(binary.BigEndian.Uint16(rec[1:]))
+			if end := int(addr) + len(payload); end > len(data) {
+				for len(data) < end {
+					data = append(data, 0xff)
+				}
+			}
+			copy(data[addr:], payload)
+		case 0x01:
+			return data, nil
+		case 0x02:
+			if len(payload) != 2 {
+				return nil, fmt.Errorf("line %d: bad segment address", line)
+			}
+			base = uint32(binary.BigEndian.Uint16(payload)) << 4
+		case 0x04:
+			if len(payload) != 2 {
+				return nil, fmt.Errorf("line %d: bad linear address", line)
+			}
+			base = uint32(binary.BigEndian.Uint16(payload)) << 16
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("missing end of file record")
+}
+
+// firmwareKey identifies a firmware by type and version.
+type firmwareKey struct{ typ, version uint16 }
+
+// OTA serves firmware updates to nodes requesting them. Nodes are only
+// updated once targeted with a firmware.
+type OTA struct {
+	mux       sync.Mutex
+	firmwares map[firmwareKey]*Firmware
+	// targets and progress are by nodeKey.
+	targets  map[string]firmwareTarget
+	progress map[string]float64
+}
+
+// firmwareTarget is the firmware a node is to be updated to.
+type firmwareTarget struct {
+	firmwareKey
+	gateway string
+	node    uint8
+}
+
+// NewOTA returns an OTA without firmware.
+func NewOTA() *OTA {
+	return &OTA{
+		firmwares: map[firmwareKey]*Firmware{},
+		targets:   map[string]firmwareTarget{},
+		progress:  map[string]float64{},
+	}
+}
+
+// AddFirmware stores a firmware, replacing any of the same type and version.
+func (o *OTA) AddFirmware(fw *Firmware) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.firmwares[firmwareKey{fw.Type, fw.Version}] = fw
+	logf(modNetwork, LevelInfo, "Loaded firmware type %d version %d, %d blocks.", fw.Type, fw.Version, fw.Blocks)
+}
+
+// Target updates the node on the gateway to the given firmware when it next
+// requests its firmware config, usually when it reboots. If gateway is
+// empty, the node ID is updated on whichever gateway it is requested from,
+// unless targeted on that gateway.
+func (o *OTA) Target(gateway string, node uint8, typ, version uint16) error {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if _, ok := o.firmwares[firmwareKey{typ, version}]; !ok {
+		return fmt.Errorf("no firmware type %d version %d", typ, version)
+	}
+	o.targets[nodeKey(gateway, node)] = firmwareTarget{firmwareKey{typ, version}, gateway, node}
+	return nil
+}
+
+// FirmwareStatus is the update state of a targeted node.
+type FirmwareStatus struct {
+	Gateway string `json:",omitempty"`
+	Node    uint8
+	Type    uint16
+	Version uint16
+	// Progress is the ratio of blocks sent, from 0 to 1.
+	Progress float64
+}
+
+// Status returns the update state of the targeted nodes.
+func (o *OTA) Status() []FirmwareStatus {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	status := []FirmwareStatus{}
+	for key, t := range o.targets {
+		status = append(status, FirmwareStatus{Gateway: t.gateway, Node: t.node, Type: t.typ, Version: t.version, Progress: o.progress[key]})
+	}
+	sort.Slice(status, func(i, j int) bool {
+		if status[i].Gateway != status[j].Gateway {
+			return status[i].Gateway < status[j].Gateway
+		}
+		return status[i].Node < status[j].Node
+	})
+	return status
+}
+
+// handle returns the reply to a firmware stream message from the gateway, or
+// nil.
+func (o *OTA) handle(gateway string, m *Message, b []byte) *Message {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	key := nodeKey(gateway, m.NodeID)
+	t, ok := o.targets[key]
+	if !ok {
+		// Targeted without a gateway.
+		key = nodeKey("", m.NodeID)
+		if t, ok = o.targets[key]; !ok {
+			return nil
+		}
+	}
+	fw := o.firmwares[t.firmwareKey]
+	labels := []string{fmt.Sprint(m.NodeID), gateway}
+	var payload []byte
+	switch m.SubType {
+	case ST_FIRMWARE_CONFIG_REQUEST:
+		payload = make([]byte, 8)
+		binary.LittleEndian.PutUint16(payload[0:], fw.Type)
+		binary.LittleEndian.PutUint16(payload[2:], fw.Version)
+		binary.LittleEndian.PutUint16(payload[4:], fw.Blocks)
+		binary.LittleEndian.PutUint16(payload[6:], fw.CRC)
+		if c, err := ParseFirmwareConfig(b); err == nil && c.Type == fw.Type && c.Version == fw.Version && c.CRC == fw.CRC {
+			logf(modNetwork, LevelInfo, "Node %d is running firmware type %d version %d.", m.NodeID, fw.Type, fw.Version)
+			o.progress[key] = 1
+		} else {
+			logf(modNetwork, LevelInfo, "Updating node %d to firmware type %d version %d.", m.NodeID, fw.Type, fw.Version)
+			o.progress[key] = 0
+		}
+	case ST_FIRMWARE_REQUEST:
+		fb, _, err := ParseFirmwareBlock(b)
+		if err != nil || fb.Type != fw.Type || fb.Version != fw.Version || fb.Block >= fw.Blocks {
+			logf(modNetwork, LevelWarn, "Node %d requested unknown firmware block: %x", m.NodeID, b)
+			return nil
+		}
+		payload = append([]byte{}, b[:6]...)
+		start := int(fb.Block) * firmwareBlockSize
+		payload = append(payload, fw.data[start:start+firmwareBlockSize]...)
+		firmwareBlocksCount.WithLabelValues(labels...).Inc()
+		// Nodes request the blocks from last to first.
+		o.progress[key] = float64(fw.Blocks-fb.Block) / float64(fw.Blocks)
+		if fb.Block == 0 {
+			logf(modNetwork, LevelInfo, "Sent firmware type %d version %d to node %d.", fw.Type, fw.Version, m.NodeID)
+		}
+	default:
+		return nil
+	}
+	firmwareProgressGauge.WithLabelValues(labels...).Set(o.progress[key])
+	r := m.Copy()
+	r.SubType = m.SubType.(SubTypeStream) + 1
+	r.Payload = []byte(strings.ToUpper(hex.EncodeToString(payload)))
+	return r
+}
@@ -0,0 +1,37 @@
+package mysensors
+
+import "testing"
+
+func TestOTATarget(t *testing.T) {
+	o := NewOTA()
+	fw, err := NewFirmware(1, 2, []byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.AddFirmware(fw)
+	if err := o.Target("A", 5, 1, 2); err != nil {
+		t.Fatalf("Target: %v", err)
+	}
+	if err := o.Target("", 6, 1, 2); err != nil {
+		t.Fatalf("Target: %v", err)
+	}
+	for _, tc := range []struct {
+		gateway string
+		node    uint8
+		update  bool
+	}{
+		{"A", 5, true},
+		{"B", 5, false},
+		{"A", 6, true},
+		{"B", 6, true},
+		{"A", 7, false},
+	} {
+		m := &Message{NodeID: tc.node, ChildSensorID: NoChild, Type: MsgStream, SubType: ST_FIRMWARE_CONFIG_REQUEST}
+		if r := o.handle(tc.gateway, m, make([]byte, 10)); (r != nil) != tc.update {
+			t.Errorf("node %d on gateway %s answered %v, want %v", tc.node, tc.gateway, r != nil, tc.update)
+		}
+	}
+	if s := o.Status(); len(s) != 2 || s[0].Gateway != "" || s[1].Gateway != "A" || s[1].Node != 5 {
+		t.Errorf("Status = %+v", s)
+	}
+}
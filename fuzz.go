@@ -0,0 +1,41 @@
+//go:build gofuzz
+// +build gofuzz
+
+// This file contains the go-fuzz target for the serial format parser. Run
+// with:
+//
+//	go-fuzz-build && go-fuzz -workdir=testdata
+package mysensors
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Fuzz parses data as a serial message, and checks that messages which
+// parse marshal back to an equivalent message.
+func Fuzz(data []byte) int {
+	m := &Message{}
+	if err := m.Unmarshal(data); err != nil && !errors.Is(err, ErrUnknownType) {
+		return 0
+	}
+	_ = m.String()
+	line := m.Marshal()
+	m2 := &Message{}
+	if err := m2.Unmarshal(line); err != nil && !errors.Is(err, ErrUnknownType) {
+		panic(fmt.Sprintf("%q parsed but its marshalled form %q did not: %v", data, line, err))
+	}
+	if !bytes.Equal(m2.Marshal(), line) {
+		panic(fmt.Sprintf("%q marshalled as %q then %q", data, line, m2.Marshal()))
+	}
+	j, err := m.MarshalJSON()
+	if err != nil {
+		panic(err)
+	}
+	m3 := &Message{}
+	if err := m3.UnmarshalJSON(j); err != nil && !errors.Is(err, ErrUnknownType) {
+		panic(fmt.Sprintf("%q parsed but its JSON %s did not: %v", data, j, err))
+	}
+	return 1
+}
@@ -0,0 +1,32 @@
+// This file contains the generic value metric for unmapped variables.
+package mysensors
+
+import (
+	"flag"
+	"strconv"
+)
+
+var genericValues = flag.Bool("generic_values", false, "Export numeric variables without a metric mapping as mysensors_value")
+
+func init() {
+	fixedGauges["mysensors_value"] = fixedVec{
+		help:   "Numeric value of variables without a dedicated metric",
+		labels: append(sensorLabels, "subtype"),
+	}
+}
+
+// exportValue exports a numeric variable as mysensors_value if generic
+// values are enabled and no dedicated metric exports it.
+func (s *Sensor) exportValue(v *Var) {
+	if !*genericValues || s.node.network.gauges.name(v.SubType) != "" || binaryMetrics[v.SubType] != "" || s.airQuality(v.SubType) || s.rule(v.SubType) != nil {
+		return
+	}
+	f, err := strconv.ParseFloat(v.Value(), 64)
+	if err != nil {
+		return
+	}
+	if v.Type == varFloat {
+		f = v.FloatVal
+	}
+	s.export("mysensors_value", append(s.labels(), v.SubType.String()), f)
+}
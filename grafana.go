@@ -0,0 +1,250 @@
+// This file contains a Grafana dashboard generator.
+package mysensors
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// grafanaUnits maps variables to Grafana units.
+var grafanaUnits = map[SubTypeSetReq]string{
+	V_TEMP:        "celsius",
+	V_HUM:         "humidity",
+	V_PRESSURE:    "pressurehpa",
+	V_VOLTAGE:     "volt",
+	V_CURRENT:     "amp",
+	V_WATT:        "watt",
+	V_KWH:         "kwatth",
+	V_LEVEL:       "lux",
+	V_LIGHT_LEVEL: "percent",
+	V_PERCENTAGE:  "percentunit",
+	V_DISTANCE:    "lengthm",
+	V_WIND:        "velocityms",
+	V_GUST:        "velocityms",
+	V_DIRECTION:   "degree",
+	V_ORP:         "mvolt",
+	V_VA:          "voltamp",
+	V_VAR:         "voltampreact",
+	V_IMPEDANCE:   "ohm",
+	V_WEIGHT:      "masskg",
+	V_RAIN:        "lengthmm",
+	V_FLOW:        "lengthm",
+}
+
+// grafanaUnit returns the Grafana unit of the variable, as exported.
+func grafanaUnit(t SubTypeSetReq) string {
+	if t == V_TEMP && tempUnit() == "F" {
+		return "fahrenheit"
+	}
+	return grafanaUnits[t]
+}
+
+type grafanaDashboard struct {
+	Inputs        []grafanaInput `json:"__inputs"`
+	Title         string         `json:"title"`
+	UID           string         `json:"uid"`
+	Tags          []string       `json:"tags"`
+	Refresh       string         `json:"refresh"`
+	Time          grafanaRange   `json:"time"`
+	SchemaVersion int            `json:"schemaVersion"`
+	Panels        []grafanaPanel `json:"panels"`
+}
+
+type grafanaInput struct {
+	Name     string `json:"name"`
+	Label    string `json:"label"`
+	Type     string `json:"type"`
+	PluginID string `json:"pluginId"`
+}
+
+type grafanaRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type grafanaPanel struct {
+	ID          int               `json:"id"`
+	Type        string            `json:"type"`
+	Title       string            `json:"title"`
+	GridPos     grafanaGridPos    `json:"gridPos"`
+	Datasource  *grafanaSource    `json:"datasource,omitempty"`
+	Targets     []grafanaTarget   `json:"targets,omitempty"`
+	FieldConfig *grafanaFieldConf `json:"fieldConfig,omitempty"`
+}
+
+type grafanaGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type grafanaSource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type grafanaTarget struct {
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat,omitempty"`
+	Instant      bool   `json:"instant,omitempty"`
+	Format       string `json:"format,omitempty"`
+	RefID        string `json:"refId"`
+}
+
+type grafanaFieldConf struct {
+	Defaults grafanaDefaults `json:"defaults"`
+}
+
+type grafanaDefaults struct {
+	Unit string   `json:"unit,omitempty"`
+	Min  *float64 `json:"min,omitempty"`
+	Max  *float64 `json:"max,omitempty"`
+}
+
+// grafanaLayout places panels on the dashboard grid, 24 units wide.
+type grafanaLayout struct {
+	panels []grafanaPanel
+	x, y   int
+}
+
+func (l *grafanaLayout) add(p grafanaPanel, w, h int) {
+	if l.x+w > 24 {
+		l.x, l.y = 0, l.y+h
+	}
+	p.ID = len(l.panels) + 1
+	p.GridPos = grafanaGridPos{H: h, W: w, X: l.x, Y: l.y}
+	if p.Type != "row" {
+		p.Datasource = &grafanaSource{Type: "prometheus", UID: "${DS_PROMETHEUS}"}
+	}
+	l.panels = append(l.panels, p)
+	l.x += w
+	if l.x >= 24 {
+		l.x, l.y = 0, l.y+h
+	}
+}
+
+// row starts a new row of panels.
+func (l *grafanaLayout) row(title string) {
+	if l.x > 0 {
+		l.x, l.y = 0, l.y+8
+	}
+	l.add(grafanaPanel{Type: "row", Title: title}, 24, 1)
+}
+
+// GrafanaDashboard writes a Grafana dashboard for the current network, to
+// import with a Prometheus data source: a battery overview, a table of
+// tripped and armed sensors (exported with --generic_values), and a row of
+// graphs per location.
+func (n *Network) GrafanaDashboard(w io.Writer) error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	// The naming profile decides whether series have a location label.
+	byLocation := n.gauges.profile.labels == nil
+	metrics := map[string]map[string]SubTypeSetReq{}
+	for _, nd := range n.Nodes {
+		loc := nd.Location
+		if !byLocation {
+			loc = ""
+		}
+		for _, s := range nd.Sensors {
+			if s.Ignored {
+				continue
+			}
+			for _, v := range s.Vars {
+				if v.Type != varFloat {
+					continue
+				}
+				name := n.gauges.name(v.SubType)
+				if s.airQuality(v.SubType) {
+					name = "mysensors_co2_ppm"
+					if s.pollutant() == "voc" {
+						name = "mysensors_voc_ppb"
+					}
+				}
+				if name == "" {
+					continue
+				}
+				if metrics[loc] == nil {
+					metrics[loc] = map[string]SubTypeSetReq{}
+				}
+				metrics[loc][name] = v.SubType
+			}
+		}
+	}
+
+	var l grafanaLayout
+	l.row("Overview")
+	zero, one := 0.0, 1.0
+	l.add(grafanaPanel{
+		Type:        "bargauge",
+		Title:       "Battery levels",
+		Targets:     []grafanaTarget{{Expr: "mysensors_node_battery_ratio", LegendFormat: "{{location}} node {{node}}", Instant: true, RefID: "A"}},
+		FieldConfig: &grafanaFieldConf{Defaults: grafanaDefaults{Unit: "percentunit", Min: &zero, Max: &one}},
+	}, 12, 8)
+	l.add(grafanaPanel{
+		Type:  "table",
+		Title: "Alarms",
+		Targets: []grafanaTarget{{
+			Expr:    `{__name__=~"mysensors_tripped|mysensors_armed"}`,
+			Instant: true,
+			Format:  "table",
+			RefID:   "A",
+		}},
+	}, 12, 8)
+
+	locations := []string{}
+	for loc := range metrics {
+		locations = append(locations, loc)
+	}
+	sort.Strings(locations)
+	for _, loc := range locations {
+		title, selector := loc, "{location="+strconv.Quote(loc)+"}"
+		switch {
+		case !byLocation:
+			title, selector = "Sensors", ""
+		case loc == "":
+			title = "No location"
+		}
+		l.row(title)
+		names := []string{}
+		for name := range metrics[loc] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			legend := "{{entity}}"
+			if byLocation {
+				legend = "node {{node}} sensor {{sensor}}"
+			}
+			l.add(grafanaPanel{
+				Type:        "timeseries",
+				Title:       fmt.Sprintf("%s (%s)", name, metrics[loc][name]),
+				Targets:     []grafanaTarget{{Expr: name + selector, LegendFormat: legend, RefID: "A"}},
+				FieldConfig: &grafanaFieldConf{Defaults: grafanaDefaults{Unit: grafanaUnit(metrics[loc][name])}},
+			}, 12, 8)
+		}
+	}
+
+	d := grafanaDashboard{
+		Inputs: []grafanaInput{{
+			Name:     "DS_PROMETHEUS",
+			Label:    "Prometheus",
+			Type:     "datasource",
+			PluginID: "prometheus",
+		}},
+		Title:         "MySensors",
+		UID:           "mysensors-prom",
+		Tags:          []string{"mysensors"},
+		Refresh:       "1m",
+		Time:          grafanaRange{From: "now-24h", To: "now"},
+		SchemaVersion: 36,
+		Panels:        l.panels,
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
@@ -0,0 +1,144 @@
+// This file contains logical devices, grouping sensors across nodes.
+package mysensors
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Group is a logical device made of sensors on any nodes, eg a greenhouse
+// with a temperature sensor on one node and a valve on another.
+type Group struct {
+	Name    string
+	Members []GroupMember
+}
+
+// GroupMember is a sensor in a Group.
+type GroupMember struct {
+	Node   uint8
+	Sensor uint8
+	// Role optionally names the sensor within the group, eg "valve".
+	Role string `json:",omitempty"`
+}
+
+// GroupState is the current state of a Group.
+type GroupState struct {
+	Name    string
+	Members []GroupMemberState
+}
+
+// GroupMemberState is the current state of a group member.
+type GroupMemberState struct {
+	GroupMember
+	Location     string `json:",omitempty"`
+	Presentation string `json:",omitempty"`
+	// Values are the sensor's values by variable, eg V_TEMP.
+	Values map[string]string
+}
+
+// SetGroup adds or replaces a group.
+func (n *Network) SetGroup(g Group) error {
+	if g.Name == "" {
+		return fmt.Errorf("group has no name")
+	}
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.Groups == nil {
+		n.Groups = make(map[string]*Group)
+	}
+	n.Groups[g.Name] = &g
+	n.changed()
+	return nil
+}
+
+// DeleteGroup removes a group.
+func (n *Network) DeleteGroup(name string) error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if _, ok := n.Groups[name]; !ok {
+		return fmt.Errorf("unknown group %q", name)
+	}
+	delete(n.Groups, name)
+	n.changed()
+	return nil
+}
+
+// GroupStates returns the state of all groups, by name.
+func (n *Network) GroupStates() []GroupState {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	states := []GroupState{}
+	for _, g := range n.Groups {
+		states = append(states, n.groupState(g))
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
+
+// groupState returns the state of g. n.mux must be held.
+func (n *Network) groupState(g *Group) GroupState {
+	gs := GroupState{Name: g.Name, Members: []GroupMemberState{}}
+	for _, m := range g.Members {
+		ms := GroupMemberState{GroupMember: m, Values: map[string]string{}}
+		if s := n.sensor("", m.Node, m.Sensor); s != nil {
+			ms.Location = s.node.Location
+			if s.Presentation != nil {
+				ms.Presentation = s.Presentation.String()
+			}
+			for _, v := range s.Vars {
+				ms.Values[v.SubType.String()] = v.Value()
+			}
+		}
+		gs.Members = append(gs.Members, ms)
+	}
+	return gs
+}
+
+// GroupSnapshots returns the JSON states of the groups containing the
+// sensor the message is from, by group name, eg to publish to MQTT.
+func (n *Network) GroupSnapshots(m *Message) map[string][]byte {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	snapshots := map[string][]byte{}
+	for name, g := range n.Groups {
+		for _, gm := range g.Members {
+			if gm.Node != m.NodeID || gm.Sensor != m.ChildSensorID {
+				continue
+			}
+			if data, err := json.Marshal(n.groupState(g)); err == nil {
+				snapshots[name] = data
+			}
+			break
+		}
+	}
+	return snapshots
+}
+
+// GroupCommand sends a set command to every member of the group which has
+// the variable, eg V_STATUS to open all valves. It returns the number of
+// members sent to.
+func (n *Network) GroupCommand(name string, t SubTypeSetReq, value string) (int, error) {
+	n.mux.Lock()
+	g, ok := n.Groups[name]
+	msgs := []*Message{}
+	if ok {
+		for _, gm := range g.Members {
+			if s := n.sensor("", gm.Node, gm.Sensor); s != nil {
+				if _, ok := s.Vars[t.String()]; ok {
+					msgs = append(msgs, &Message{NodeID: gm.Node, ChildSensorID: gm.Sensor, Type: MsgSet, SubType: t, Payload: []byte(value)})
+				}
+			}
+		}
+	}
+	n.mux.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("unknown group %q", name)
+	}
+	for _, m := range msgs {
+		if err := n.Send(m); err != nil {
+			return 0, err
+		}
+	}
+	return len(msgs), nil
+}
@@ -0,0 +1,127 @@
+// This file contains capture of the gateway's debug log.
+package mysensors
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var gatewayLogLines = flag.Int("gateway_log_lines", 200, "Recent I_LOG_MESSAGE lines kept per gateway")
+
+var (
+	gatewayLogCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_gateway_log_lines_total",
+		Help: "Debug log lines received from the gateway, by module, eg TSF",
+	}, []string{"gateway", "module"})
+	gatewayLogErrorCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_gateway_log_errors_total",
+		Help: "Errors reported in the gateway debug log, by event, eg TSF:MSG:SEND",
+	}, []string{"gateway", "event"})
+	gatewayLogUnparsedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_gateway_log_unparsed_total",
+		Help: "Gateway debug log lines not in the MySensors log format",
+	}, []string{"gateway"})
+)
+
+func init() {
+	mustRegister(gatewayLogCount, gatewayLogErrorCount, gatewayLogUnparsedCount)
+}
+
+// GatewayLog is a line of the gateway's debug log, eg
+// "2542 !TSF:MSG:SEND,0-0-5-5,s=1,c=1,t=2,pt=0,l=1,sg=0,ft=0,st=NACK:1".
+type GatewayLog struct {
+	Time    time.Time
+	Gateway string
+	// Millis is the gateway's uptime in milliseconds, if given.
+	Millis *uint64 `json:",omitempty"`
+	// Error is whether the line reports an error, marked by a "!".
+	Error bool `json:",omitempty"`
+	// Module is the reporting module, eg TSF for the transport, and Event
+	// the module, category and event, eg TSF:MSG:SEND. Both are empty if
+	// the line could not be parsed.
+	Module string `json:",omitempty"`
+	Event  string `json:",omitempty"`
+	Text   string
+}
+
+// parseGatewayLog parses a gateway debug log line.
+func parseGatewayLog(text string) GatewayLog {
+	l := GatewayLog{Text: text}
+	rest := strings.TrimSpace(text)
+	if i := strings.IndexByte(rest, ' '); i > 0 {
+		if ms, err := strconv.ParseUint(rest[:i], 10, 64); err == nil {
+			l.Millis = &ms
+			rest = strings.TrimSpace(rest[i+1:])
+		}
+	}
+	if strings.HasPrefix(rest, "!") {
+		l.Error = true
+		rest = rest[1:]
+	}
+	event := rest
+	if i := strings.IndexAny(event, ", "); i >= 0 {
+		event = event[:i]
+	}
+	parts := strings.Split(event, ":")
+	if len(parts) < 2 || !upperWord(parts[0]) {
+		return l
+	}
+	// The event is at most module:category:event; later fields, and
+	// fields like ID=0, are values.
+	for i, p := range parts {
+		if i == 3 || strings.Contains(p, "=") {
+			parts = parts[:i]
+			break
+		}
+	}
+	l.Module, l.Event = parts[0], strings.Join(parts, ":")
+	return l
+}
+
+// upperWord returns whether s is a word of upper case letters, as log
+// module names are.
+func upperWord(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// recordLog keeps a gateway log line in the ring of recent lines, and
+// counts it.
+func (h *Handler) recordLog(m *Message) {
+	l := parseGatewayLog(string(m.Payload))
+	l.Time, l.Gateway = time.Now(), h.Gateway
+	switch {
+	case l.Module == "":
+		gatewayLogUnparsedCount.WithLabelValues(h.Gateway).Inc()
+	case l.Error:
+		gatewayLogErrorCount.WithLabelValues(h.Gateway, l.Event).Inc()
+		fallthrough
+	default:
+		gatewayLogCount.WithLabelValues(h.Gateway, l.Module).Inc()
+	}
+	logf(modHandler, LevelDebug, "Gateway log: %s\n", l.Text)
+	h.logMux.Lock()
+	defer h.logMux.Unlock()
+	h.logs = append(h.logs, l)
+	if n := len(h.logs) - *gatewayLogLines; n > 0 {
+		h.logs = append(h.logs[:0:0], h.logs[n:]...)
+	}
+}
+
+// Logs returns the recent lines of the gateway's debug log, oldest first.
+func (h *Handler) Logs() []GatewayLog {
+	h.logMux.Lock()
+	defer h.logMux.Unlock()
+	return append([]GatewayLog{}, h.logs...)
+}
@@ -0,0 +1,138 @@
+// Package gwtest is an end-to-end test harness for the MySensors handler. It
+// runs a Handler and Network against one end of a pseudo-terminal, over the
+// real serial transport, and lets tests script the gateway on the other end.
+package gwtest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/buxtronix/mysensors-prom"
+)
+
+// Gateway is a scripted gateway connected to a running Handler and Network.
+type Gateway struct {
+	// Path is the terminal the Handler's serial transport is opened on.
+	Path    string
+	Network *mysensors.Network
+	Handler *mysensors.Handler
+	// Received carries each message after the Network has handled it.
+	Received chan *mysensors.Message
+
+	pty    *os.File
+	lines  chan string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Start opens a pseudo-terminal and runs a Handler and a new Network against
+// it, with a serial transport at baud. Call Close when done.
+func Start(baud int) (*Gateway, error) {
+	pty, path, err := openPTY()
+	if err != nil {
+		return nil, err
+	}
+	t := mysensors.NewSerialTransport(path, baud)
+	if err := t.Open(); err != nil {
+		pty.Close()
+		return nil, fmt.Errorf("opening %s: %v", path, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	g := &Gateway{
+		Path:     path,
+		Network:  mysensors.NewNetwork(),
+		Received: make(chan *mysensors.Message, 100),
+		pty:      pty,
+		lines:    make(chan string, 100),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	ch := make(chan *mysensors.Message)
+	g.Handler = mysensors.NewHandler(t, ch, g.Network)
+	g.Network.AddGateway(g.Handler.Gateway, g.Handler.Tx)
+	go g.readLines()
+	go g.Handler.StartContext(ctx)
+	go func() {
+		defer close(g.done)
+		for {
+			select {
+			case m := <-ch:
+				g.Network.HandleMessage(m, g.Handler.Tx)
+				select {
+				case g.Received <- m:
+				default:
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return g, nil
+}
+
+// readLines passes the lines the Handler writes to lines.
+func (g *Gateway) readLines() {
+	defer close(g.lines)
+	r := bufio.NewReader(g.pty)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		g.lines <- strings.TrimRight(line, "\r\n")
+	}
+}
+
+// Send writes a message line from the gateway, eg "5;1;1;0;0;21.5".
+func (g *Gateway) Send(line string) error {
+	_, err := g.pty.WriteString(line + "\n")
+	return err
+}
+
+// SendChunks writes raw chunks from the gateway with a pause between them,
+// to exercise line framing across partial reads.
+func (g *Gateway) SendChunks(pause time.Duration, chunks ...string) error {
+	for i, c := range chunks {
+		if i > 0 {
+			time.Sleep(pause)
+		}
+		if _, err := g.pty.WriteString(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Expect returns the next line the Handler writes to the gateway.
+func (g *Gateway) Expect(timeout time.Duration) (string, error) {
+	select {
+	case line, ok := <-g.lines:
+		if !ok {
+			return "", fmt.Errorf("%s closed", g.Path)
+		}
+		return line, nil
+	case <-time.After(timeout):
+		return "", fmt.Errorf("nothing written to %s in %v", g.Path, timeout)
+	}
+}
+
+// ExpectMessage returns the next message handled by the Network.
+func (g *Gateway) ExpectMessage(timeout time.Duration) (*mysensors.Message, error) {
+	select {
+	case m := <-g.Received:
+		return m, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("no message handled in %v", timeout)
+	}
+}
+
+// Close stops the Handler and closes the pseudo-terminal.
+func (g *Gateway) Close() error {
+	g.cancel()
+	<-g.done
+	return g.pty.Close()
+}
@@ -0,0 +1,70 @@
+package gwtest
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/buxtronix/mysensors-prom"
+)
+
+func start(t *testing.T) *Gateway {
+	if runtime.GOOS != "linux" {
+		t.Skip("pseudo-terminals are only supported on linux")
+	}
+	g, err := Start(115200)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	return g
+}
+
+func TestPartialReads(t *testing.T) {
+	g := start(t)
+	defer g.Close()
+	// Lines split across reads, several lines in one read, a CRLF line
+	// ending split from its line, and a malformed line in between.
+	if err := g.SendChunks(20*time.Millisecond,
+		"5;1;1;0;0;2", "1.5\n5;2;1;0;1;4", "0\nnot a message\n6;", "1;1;0;2;1\r", "\n",
+	); err != nil {
+		t.Fatalf("SendChunks: %v", err)
+	}
+	for _, want := range []string{"5;1;1;0;0;21.5", "5;2;1;0;1;40", "6;1;1;0;2;1"} {
+		m, err := g.ExpectMessage(2 * time.Second)
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", want, err)
+		}
+		if got := string(m.Marshal()); got != want+"\n" {
+			t.Errorf("handled %q, want %q", got, want)
+		}
+	}
+	if m, err := g.ExpectMessage(100 * time.Millisecond); err == nil {
+		t.Errorf("handled unexpected %s", m)
+	}
+}
+
+func TestSend(t *testing.T) {
+	g := start(t)
+	defer g.Close()
+	if err := g.Send("5;1;0;0;6;"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := g.ExpectMessage(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	m := &mysensors.Message{NodeID: 5, ChildSensorID: 1, Type: mysensors.MsgSet, SubType: mysensors.V_STATUS, Payload: []byte("1")}
+	if err := g.Network.Send(m); err != nil {
+		t.Fatalf("Network.Send: %v", err)
+	}
+	// Skip the handshake and anything else the Handler sends first.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		line, err := g.Expect(time.Until(deadline))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "5;1;1;0;2;1" {
+			return
+		}
+	}
+}
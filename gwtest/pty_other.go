@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+// This file contains the pseudo-terminal stub for other systems.
+package gwtest
+
+import (
+	"errors"
+	"os"
+)
+
+func openPTY() (*os.File, string, error) {
+	return nil, "", errors.New("pseudo-terminals are only supported on linux")
+}
@@ -3,66 +3,368 @@ package mysensors
 
 import (
 	"bufio"
-	"io"
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"strconv"
+	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var pauseBuffer = flag.Int("pause_buffer", 1000, "Maximum number of messages buffered while processing is paused")
+
+var (
+	pausedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mysensors_paused",
+		Help: "Whether message processing is paused",
+	}, []string{"gateway"})
+	pauseBufferedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mysensors_pause_buffered_messages",
+		Help: "Messages buffered while message processing is paused",
+	}, []string{"gateway"})
+	pauseDroppedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_pause_dropped_messages_total",
+		Help: "Messages dropped because the pause buffer was full",
+	}, []string{"gateway"})
+	rxMessageCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_messages_received_total",
+		Help: "Messages received from the gateway, by message type",
+	}, []string{"gateway", "type"})
+	txMessageCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_messages_sent_total",
+		Help: "Messages written to the gateway, by message type",
+	}, []string{"gateway", "type"})
+	unmarshalErrorCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_unmarshal_errors_total",
+		Help: "Lines received from the gateway that are not valid messages",
+	}, []string{"gateway"})
+	unknownSubTypeCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_unknown_subtypes_total",
+		Help: "Messages received from the gateway of unknown type or sub type",
+	}, []string{"gateway"})
 )
 
-func NewHandler(r io.Reader, w io.Writer, c chan *Message, n *Network) *Handler {
-	return &Handler{r: r, w: w, c: c, network: n}
+func init() {
+	mustRegister(pausedGauge, pauseBufferedGauge, pauseDroppedCount, rxMessageCount, txMessageCount, unmarshalErrorCount, unknownSubTypeCount)
+}
+
+// NewHandler returns a Handler for the opened gateway transport t. Received
+// messages are passed to c. On I/O errors the transport is closed and
+// reopened with exponential backoff, keeping the Network state.
+func NewHandler(t GatewayTransport, c chan *Message, n *Network) *Handler {
+	h := &Handler{
+		t:       t,
+		c:       c,
+		network: n,
+		Tx:      make(chan *Message, *txQueueSize),
+		rx:      make(chan *Message),
+		started: make(chan struct{}),
+		resume:  make(chan bool, 1),
+		errs:    make(chan error, 1),
+		txDedup: newDedup(*txDedupWindow),
+		rxDedup: newDedup(*rxDedupWindow),
+	}
+	if n != nil {
+		n.mux.Lock()
+		n.handlers = append(n.handlers, h)
+		n.mux.Unlock()
+	}
+	return h
 }
 
 type Handler struct {
-	r       io.Reader
-	w       io.Writer
+	// Gateway names the gateway in metrics and received messages, when
+	// more than one gateway is in use.
+	Gateway string
+	// Elector, if set, restricts writing to the gateway to the leader
+	// instance. Messages sent while not the leader are dropped.
+	Elector Elector
+
 	c       chan *Message
 	ready   bool
 	network *Network
 	Tx      chan *Message
+	// rx carries received and injected messages to be processed.
+	rx chan *Message
+	// started is closed once StartContext has set done.
+	started chan struct{}
+
+	// connMux protects t, gen and regen, which is closed as gen changes.
+	connMux sync.Mutex
+	t       GatewayTransport
+	gen     int
+	regen   chan struct{}
+	// reconnectMux serializes reconnects by the reader and writer.
+	reconnectMux sync.Mutex
+
+	txDedup *dedup
+	rxDedup *dedup
+	// txTokens are the tokens of the --tx_rate bucket at txLast.
+	txTokens float64
+	txLast   time.Time
+
+	// ackMux protects acks, the sent messages awaiting an echo,
+	// ackWaiters, the SendWithAck callers waiting for them, echoes,
+	// when late echoes of sent messages are no longer expected, and reqs,
+	// when REQs awaiting an answer were sent.
+	ackMux     sync.Mutex
+	acks       map[string]*pendingAck
+	ackWaiters map[string][]chan error
+	echoes     map[string]time.Time
+	reqs       map[string]time.Time
+
+	// logMux protects logs, the recent gateway log lines.
+	logMux sync.Mutex
+	logs   []GatewayLog
+
+	// rxMux protects lastRx and stalled, for the watchdog.
+	rxMux   sync.Mutex
+	lastRx  time.Time
+	stalled bool
+
+	// hsMux protects hsGen, one more than the connection generation the
+	// gateway answered the handshake on, and version.
+	hsMux   sync.Mutex
+	hsGen   int
+	version string
+
+	// mwMux protects the inbound and outbound middleware.
+	mwMux    sync.Mutex
+	inbound  []Middleware
+	outbound []Middleware
+
+	// subMux protects subs.
+	subMux sync.Mutex
+	subs   map[<-chan Traffic]chan Traffic
+
+	// tailMux protects tails.
+	tailMux sync.Mutex
+	tails   map[chan Frame]bool
+
+	// mux protects paused and buffer.
+	mux    sync.Mutex
+	paused bool
+	buffer []*Message
+	resume chan bool
+
+	// done is closed when the Handler is stopped, by cancel or its parent
+	// context.
+	done   <-chan struct{}
+	cancel context.CancelFunc
+	errs   chan error
 }
 
+// Start handles the gateway messages, blocking forever.
 func (h *Handler) Start() {
-	rCh := make(chan *Message)
-	h.Tx = make(chan *Message)
-	go h.messageWriter(h.Tx)
-	go h.messageReader(rCh)
-
-	for m := range rCh {
-		var r *Message
-		switch m.Type {
-		case MsgInternal:
-			r = h.processInternal(m)
-		case MsgSet:
-			r = h.processSet(m)
-			h.ready = true
-		case MsgReq:
-			r = h.processReq(m)
-		case MsgPresentation:
-			r = h.processPresentation(m)
-		default:
-			log.Printf("Unknown msg type: %v\n", m)
-		}
-		if h.ready && r != nil {
-			h.Tx <- r
-		}
-	}
-	log.Printf("Read channel closed.")
-	close(h.c)
+	h.StartContext(context.Background())
+}
+
+// StartContext handles the gateway messages until ctx is done, or the
+// gateway fails and cannot be reopened. The transport is then closed, and
+// StartContext returns once the reader and writer have stopped. Failures are
+// reported on Errors.
+func (h *Handler) StartContext(ctx context.Context) {
+	ctx, h.cancel = context.WithCancel(ctx)
+	defer h.cancel()
+	h.done = ctx.Done()
+	close(h.started)
+	var wg sync.WaitGroup
+	wg.Add(5)
+	go func() {
+		defer wg.Done()
+		h.messageWriter(h.Tx)
+	}()
+	go func() {
+		defer wg.Done()
+		h.messageReader(h.rx)
+	}()
+	go func() {
+		defer wg.Done()
+		h.ackRetransmitter()
+	}()
+	go func() {
+		defer wg.Done()
+		h.watchdog()
+	}()
+	go func() {
+		defer wg.Done()
+		h.handshake()
+	}()
+	defer wg.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logf(modHandler, LevelInfo, "Stopping gateway handler.")
+			// Closing the transport unblocks the reader.
+			h.connMux.Lock()
+			h.t.Close()
+			h.connMux.Unlock()
+			return
+		case m := <-h.rx:
+			if h.hold(m) {
+				continue
+			}
+			// Keep ordering if messages arrive before the resume is seen.
+			for _, b := range h.release() {
+				h.process(b)
+			}
+			h.process(m)
+		case <-h.resume:
+			for _, m := range h.release() {
+				h.process(m)
+			}
+		}
+	}
+}
+
+func (h *Handler) process(m *Message) {
+	var r *Message
+	switch m.Type {
+	case MsgInternal:
+		r = h.processInternal(m)
+	case MsgSet:
+		r = h.processSet(m)
+		h.ready = true
+	case MsgReq:
+		r = h.processReq(m)
+	case MsgPresentation:
+		r = h.processPresentation(m)
+	case MsgStream:
+		r = h.processStream(m)
+	default:
+		logf(modHandler, LevelWarn, "Unknown msg type: %v\n", m)
+	}
+	if h.ready && r != nil {
+		h.send(h.Tx, r)
+	}
+}
+
+// Errors returns a channel receiving the error that stopped the Handler, if
+// the gateway failed. The embedding program decides whether to restart the
+// Handler or exit.
+func (h *Handler) Errors() <-chan error {
+	return h.errs
+}
+
+// fail reports err on Errors and stops the Handler.
+func (h *Handler) fail(err error) {
+	logf(modHandler, LevelError, "Gateway failed: %v", err)
+	select {
+	case h.errs <- err:
+	default:
+	}
+	h.cancel()
+}
+
+// send sends m on c, and reports false instead if the Handler is stopped.
+// Sends to the receive and transmit queues apply --queue_policy.
+func (h *Handler) send(c chan *Message, m *Message) bool {
+	switch c {
+	case h.c:
+		return Enqueue("rx", c, m, h.done)
+	case h.Tx:
+		return Enqueue("tx", c, m, h.done)
+	}
+	select {
+	case c <- m:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// stopped returns whether the Handler is stopped.
+func (h *Handler) stopped() bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Pause stops processing of received messages. Messages received while
+// paused are buffered, up to --pause_buffer, until Resume is called.
+func (h *Handler) Pause() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.paused = true
+	pausedGauge.WithLabelValues(h.Gateway).Set(1)
+	logf(modHandler, LevelInfo, "Message processing paused.")
+}
+
+// Resume processes any buffered messages and resumes normal processing.
+func (h *Handler) Resume() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if !h.paused {
+		return
+	}
+	h.paused = false
+	pausedGauge.WithLabelValues(h.Gateway).Set(0)
+	logf(modHandler, LevelInfo, "Message processing resumed, %d buffered messages.", len(h.buffer))
+	select {
+	case h.resume <- true:
+	default:
+	}
+}
+
+// Paused returns whether message processing is paused.
+func (h *Handler) Paused() bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.paused
+}
+
+// hold buffers the message if processing is paused, and reports whether it did.
+func (h *Handler) hold(m *Message) bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if !h.paused {
+		return false
+	}
+	if h.network != nil && h.network.alertable(m) {
+		// Alerts can't wait for processing to resume.
+		return false
+	}
+	if len(h.buffer) >= *pauseBuffer {
+		pauseDroppedCount.WithLabelValues(h.Gateway).Inc()
+		logf(modHandler, LevelWarn, "Pause buffer full, dropping: %s\n", m)
+		return true
+	}
+	h.buffer = append(h.buffer, m)
+	pauseBufferedGauge.WithLabelValues(h.Gateway).Set(float64(len(h.buffer)))
+	return true
+}
+
+// release returns and clears the buffered messages.
+func (h *Handler) release() []*Message {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	b := h.buffer
+	if len(b) > 0 {
+		h.buffer = nil
+		pauseBufferedGauge.WithLabelValues(h.Gateway).Set(0)
+	}
+	return b
 }
 
 func (h *Handler) processPresentation(m *Message) *Message {
-	h.c <- m
+	h.send(h.c, m)
 	return nil
 }
 
 func (h *Handler) processSet(m *Message) *Message {
-	h.c <- m
+	h.send(h.c, m)
 	return nil
 }
 
 func (h *Handler) processReq(m *Message) *Message {
-	h.c <- m
+	h.send(h.c, m)
 	return nil
 }
 
@@ -71,52 +373,185 @@ func (h *Handler) processInternal(m *Message) *Message {
 	subType := m.SubType.(SubTypeInternal)
 	switch subType {
 	case I_ID_REQUEST:
+		sensorID, err := h.network.NextNodeID(h.Gateway)
+		if err != nil {
+			// Unanswered, the node asks again later.
+			logf(modHandler, LevelError, "Can't assign a node ID: %v\n", err)
+			break
+		}
 		r = m.Copy()
 		r.SubType = I_ID_RESPONSE
-		sensorID := h.network.NextNodeID()
 		r.Payload = []byte(strconv.Itoa(int(sensorID)))
 	case I_CONFIG:
 		r = m.Copy()
 		r.SubType = I_CONFIG
-		r.Payload = []byte("M")
+		r.Payload = []byte(defaultConfig())
+		if h.network != nil {
+			r.Payload = []byte(h.network.NodeConfig(h.Gateway, m.NodeID))
+		}
 	case I_GATEWAY_READY:
 		h.ready = true
-		h.c <- m
-		log.Printf("Gateway ready!\n")
+		h.greet("")
+		h.send(h.c, m)
+		logf(modHandler, LevelInfo, "Gateway ready!\n")
 	case I_TIME:
+		// The payload is set by messageWriter when the reply is sent.
+		r = m.Copy()
+	case I_REQUEST_SIGNING, I_GET_NONCE, I_GET_NONCE_RESPONSE:
+		r = h.processSigning(m)
+	case I_PING:
+		// The payload is the hop count, echoed back.
 		r = m.Copy()
-		r.Payload = []byte(strconv.FormatInt(time.Now().Unix(), 10))
+		r.SubType = I_PONG
+	case I_REGISTRATION_REQUEST:
+		// 2.x nodes wait for registration before sending data. Pending
+		// nodes are denied rather than left unanswered, as nodes that
+		// hear no answer assume they are registered.
+		r = m.Copy()
+		r.SubType = I_REGISTRATION_RESPONSE
+		r.Payload = []byte("1")
+		if h.network != nil && !h.network.register(m) {
+			r.Payload = []byte("0")
+		}
+	case I_DEBUG:
+		logf(modHandler, LevelDebug, "Node %d debug: %s\n", m.NodeID, m.Payload)
+		h.send(h.c, m)
+	case I_LOG_MESSAGE:
+		h.recordLog(m)
+	case I_VERSION:
+		if m.NodeID == GatewayID {
+			h.greet(string(m.Payload))
+		}
+		h.send(h.c, m)
 	default:
-		log.Printf("UNSUPPORTED MSG: %s\n", m)
-		h.c <- m
+		logf(modHandler, LevelDebug, "UNSUPPORTED MSG: %s\n", m)
+		h.send(h.c, m)
 	}
 	return r
 }
 
 func (h *Handler) messageReader(c chan *Message) {
-	r := bufio.NewReader(h.r)
+	t, gen := h.conn()
+	r := bufio.NewReader(t)
 	for {
 		d, err := r.ReadBytes('\x0a')
 		if err != nil {
-			log.Fatalf("Read error: %v\n", err)
-			break
+			if h.stopped() {
+				return
+			}
+			if !h.reconnect(gen) {
+				if h.stopped() {
+					return
+				}
+				h.fail(fmt.Errorf("read error: %v", err))
+				return
+			}
+			logf(modHandler, LevelError, "Read error: %v\n", err)
+			if len(d) > 0 {
+				// Reopening flushes the port, and may reset the gateway,
+				// so the rest of the line is lost.
+				logf(modHandler, LevelWarn, "Dropped partial line [%s]\n", string(d))
+			}
+			t, gen = h.conn()
+			r = bufio.NewReader(t)
+			continue
 		}
+		h.touch()
+		h.tap("rx", d)
 		m := &Message{}
 		if err = m.Unmarshal(d); err != nil {
-			log.Printf("Error parsing [%s]: %v\n", string(d), err)
+			if errors.Is(err, ErrUnknownType) {
+				unknownSubTypeCount.WithLabelValues(h.Gateway).Inc()
+			} else {
+				unmarshalErrorCount.WithLabelValues(h.Gateway).Inc()
+			}
+			logf(modHandler, LevelWarn, "Error parsing [%s]: %v\n", string(d), err)
+			continue
+		}
+		m.Gateway = h.Gateway
+		rxMessageCount.WithLabelValues(h.Gateway, m.Type.String()).Inc()
+		if m = h.middleware(false, m); m == nil {
+			continue
+		}
+		if h.suppressRx(m) {
 			continue
 		}
-		log.Printf("RX: %s\n", m)
-		c <- m
+		logf(modHandler, LevelDebug, "RX: %s\n", m)
+		h.publish("rx", m)
+		if m.Ack == Ack && h.confirmAck(m) {
+			// Echoes of our own messages are not new values.
+			continue
+		}
+		h.answerReq(m)
+		if !h.send(c, m) {
+			return
+		}
 	}
 }
 
+// timePayload returns the current time as an I_TIME payload.
+func timePayload() []byte {
+	return []byte(strconv.FormatInt(timeSeconds(currentTime()), 10))
+}
+
 func (h *Handler) messageWriter(c chan *Message) {
-	for m := range c {
+	var q txQueue
+	for {
+		m := q.next(c, h.done)
+		if m == nil {
+			return
+		}
+		queueDepths.hold("tx", c, q.len())
+		if m = h.middleware(true, m); m == nil {
+			continue
+		}
+		if m.Type == MsgInternal && m.SubType == I_TIME {
+			// Replies may be queued until a sleeping node wakes, so
+			// compute the time when it is actually sent.
+			m.Payload = timePayload()
+		}
+		if err := m.CheckPayload(); err != nil {
+			logf(modHandler, LevelError, "Dropped TX %s: %v\n", m, err)
+			continue
+		}
 		reply := m.Marshal()
-		log.Printf("TX: %s\n", reply)
-		if n, err := h.w.Write(reply); err != nil || n != len(reply) {
-			log.Fatalf("Write error: %v\n", err)
+		if h.collapseTx(m, reply) {
+			continue
+		}
+		if h.Elector != nil && !h.Elector.Leader() {
+			logf(modHandler, LevelDebug, "Not leader, dropped TX: %s\n", reply)
+			continue
+		}
+		if !h.throttle() {
+			return
+		}
+		logf(modHandler, LevelDebug, "TX: %s\n", reply)
+		h.tap("tx", reply)
+		t, gen := h.conn()
+		if n, err := t.Write(reply); err != nil || n != len(reply) {
+			if err == nil {
+				err = fmt.Errorf("short write of %d bytes", n)
+			}
+			if h.stopped() {
+				return
+			}
+			if !h.reconnect(gen) {
+				if h.stopped() {
+					return
+				}
+				h.fail(fmt.Errorf("write error: %v", err))
+				return
+			}
+			logf(modHandler, LevelError, "Write error, dropped [%s]: %v\n", reply, err)
+		} else {
+			txMessageCount.WithLabelValues(h.Gateway, m.Type.String()).Inc()
+			h.publish("tx", m)
+			if m.Type == MsgReq {
+				h.trackReq(m)
+			}
+		}
+		if m.Ack == Ack {
+			h.trackAck(m)
 		}
 	}
 }
@@ -0,0 +1,69 @@
+package mysensors
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptTransport is a GatewayTransport whose reads return reads in turn,
+// with an empty one as io.EOF, then block.
+type scriptTransport struct {
+	mux   sync.Mutex
+	reads []string
+	opens int
+}
+
+func (s *scriptTransport) Open() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.opens++
+	return nil
+}
+
+func (s *scriptTransport) Read(b []byte) (int, error) {
+	s.mux.Lock()
+	if len(s.reads) == 0 {
+		s.mux.Unlock()
+		select {}
+	}
+	r := s.reads[0]
+	s.reads = s.reads[1:]
+	s.mux.Unlock()
+	if r == "" {
+		return 0, io.EOF
+	}
+	return copy(b, r), nil
+}
+
+func (s *scriptTransport) Write(b []byte) (int, error) { return len(b), nil }
+func (s *scriptTransport) Close() error                { return nil }
+
+func TestMessageReaderDropsPartialLine(t *testing.T) {
+	backoff := *reconnectMinBackoff
+	defer func() { *reconnectMinBackoff = backoff }()
+	*reconnectMinBackoff = time.Millisecond
+	// The connection ends part way through a line, and is reopened. The
+	// fragment isn't joined to the first line of the new connection.
+	tr := &scriptTransport{reads: []string{"5;1;1;0;", "", "0;1;1;0;23;42\n", "6;1;1;0;0;21.5\n"}}
+	h := NewHandler(tr, nil, nil)
+	c := make(chan *Message, 2)
+	go h.messageReader(c)
+	for _, want := range []string{"0;1;1;0;23;42", "6;1;1;0;0;21.5"} {
+		select {
+		case m := <-c:
+			if got := strings.TrimSpace(string(m.Marshal())); got != want {
+				t.Errorf("received %s, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not received", want)
+		}
+	}
+	tr.mux.Lock()
+	defer tr.mux.Unlock()
+	if tr.opens != 1 {
+		t.Errorf("reopened %d times, want 1", tr.opens)
+	}
+}
@@ -0,0 +1,95 @@
+// This file contains the gateway startup handshake.
+package mysensors
+
+import (
+	"flag"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var handshakeInterval = flag.Duration("handshake_interval", 5*time.Second, "Interval between version requests to a newly connected gateway until it answers, 0 to disable")
+
+var gatewayInfoGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "mysensors_gateway_info",
+	Help: "Protocol version reported by the gateway",
+}, []string{"gateway", "version"})
+
+func init() {
+	mustRegister(gatewayInfoGauge)
+}
+
+// handshake requests the gateway version on every connection, retrying
+// every --handshake_interval until the gateway reports its version or that
+// it is ready.
+func (h *Handler) handshake() {
+	if *handshakeInterval <= 0 {
+		return
+	}
+	t := time.NewTicker(*handshakeInterval)
+	defer t.Stop()
+	for {
+		if !h.greeted() && (h.Elector == nil || h.Elector.Leader()) {
+			if t, _ := h.conn(); t != nil {
+				if _, ok := t.(unpingable); !ok {
+					logf(modHandler, LevelDebug, "Requesting gateway version.")
+					if !h.send(h.Tx, &Message{NodeID: GatewayID, ChildSensorID: NoChild, Type: MsgInternal, SubType: I_VERSION}) {
+						return
+					}
+				}
+			}
+		}
+		select {
+		case <-t.C:
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// greeted returns whether the gateway answered the handshake on the current
+// connection.
+func (h *Handler) greeted() bool {
+	_, gen := h.conn()
+	h.hsMux.Lock()
+	defer h.hsMux.Unlock()
+	return h.hsGen == gen+1
+}
+
+// greet records that the gateway answered the handshake, with its version
+// if known.
+func (h *Handler) greet(version string) {
+	_, gen := h.conn()
+	h.hsMux.Lock()
+	defer h.hsMux.Unlock()
+	h.hsGen = gen + 1
+	if version == "" || version == h.version {
+		return
+	}
+	if h.version != "" {
+		gatewayInfoGauge.DeleteLabelValues(h.Gateway, h.version)
+	}
+	h.version = version
+	gatewayInfoGauge.WithLabelValues(h.Gateway, version).Set(1)
+	if h.network != nil {
+		h.network.setGatewayVersion(h.Gateway, version)
+	}
+	logf(modHandler, LevelInfo, "Gateway %s protocol version %s.", h.Gateway, version)
+}
+
+// GatewayVersion returns the protocol version reported by the named gateway,
+// or "" if unknown.
+func (n *Network) GatewayVersion(gateway string) string {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.gatewayVersions[gateway]
+}
+
+func (n *Network) setGatewayVersion(gateway, version string) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.gatewayVersions == nil {
+		n.gatewayVersions = make(map[string]string)
+	}
+	n.gatewayVersions[gateway] = version
+}
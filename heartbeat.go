@@ -0,0 +1,74 @@
+// This file contains node heartbeats and uptime.
+package mysensors
+
+import (
+	"context"
+	"flag"
+	"strconv"
+	"time"
+)
+
+var heartbeatInterval = flag.Duration("heartbeat_interval", 0, "Interval between sending heartbeat requests to all known awake nodes, 0 to disable")
+
+const (
+	heartbeatMetric = "mysensors_node_heartbeats_total"
+	uptimeMetric    = "mysensors_node_uptime_seconds"
+)
+
+func init() {
+	fixedCounters[heartbeatMetric] = fixedVec{
+		help:   "I_HEARTBEAT_RESPONSE messages received from the node",
+		labels: nodeLabels,
+	}
+	fixedGauges[uptimeMetric] = fixedVec{
+		help:   "Uptime reported by 2.1 and later nodes in their heartbeats",
+		labels: nodeLabels,
+	}
+}
+
+// heartbeat handles an I_HEARTBEAT_RESPONSE. From 2.1 nodes report the
+// milliseconds their transport has been up, before that a sequence number.
+func (n *Node) heartbeat(payload string) {
+	l := n.labels()
+	n.counter(heartbeatMetric).WithLabelValues(l...).Inc()
+	if major, minor, ok := n.protocol(); !ok || major < 2 || (major == 2 && minor < 1) {
+		return
+	}
+	ms, err := strconv.ParseUint(payload, 10, 32)
+	if err != nil {
+		logf(modNetwork, LevelDebug, "Node %d sent heartbeat %q, want milliseconds", n.ID, payload)
+		return
+	}
+	n.gauge(uptimeMetric).WithLabelValues(l...).Set(float64(ms) / 1000)
+}
+
+// Heartbeats requests heartbeats from all known awake nodes every
+// --heartbeat_interval, until ctx is done.
+func (n *Network) Heartbeats(ctx context.Context) {
+	if *heartbeatInterval <= 0 {
+		return
+	}
+	t := time.NewTicker(*heartbeatInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		n.mux.Lock()
+		ms := []*Message{}
+		for _, nd := range n.Nodes {
+			if !nd.Sleeping && nd.ID != GatewayID {
+				ms = append(ms, &Message{NodeID: nd.ID, ChildSensorID: NoChild, Type: MsgInternal, SubType: I_HEARTBEAT_REQUEST, Gateway: nd.Gateway})
+			}
+		}
+		n.mux.Unlock()
+		sortByNode(ms)
+		for _, m := range ms {
+			if err := n.Send(m); err != nil {
+				logf(modNetwork, LevelWarn, "Error requesting heartbeat from node %d: %v", m.NodeID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package mysensors
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHistoryRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h, err := OpenHistory(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("OpenHistory: %v", err)
+	}
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	reading := func(offset time.Duration, gateway string, node, sensor uint8, t SubTypeSetReq, v float64, synthetic bool) Reading {
+		return Reading{Time: start.Add(offset), Gateway: gateway, Node: node, Sensor: sensor, Variable: t.String(), Value: v, Synthetic: synthetic, subType: t}
+	}
+	// Recorded out of order, as when the clock is set back.
+	recorded := []Reading{
+		reading(2*time.Second, "A", 5, 1, V_TEMP, 21.5, false),
+		reading(time.Second, "B", 5, 2, V_HUM, 40, false),
+		reading(3*time.Second+250*time.Millisecond, "A", 6, 0, V_KWH, -1.25e6, true),
+	}
+	for _, r := range recorded {
+		h.Record(r)
+	}
+	if err := h.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	want := []Reading{recorded[1], recorded[0], recorded[2]}
+
+	// Reopened, the readings are read back from the segment.
+	if h, err = OpenHistory(dir, time.Hour); err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	got, err := h.Query(start, start.Add(time.Minute), "", -1, -1)
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	for i := range got {
+		got[i].Time = got[i].Time.UTC()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Query = %+v, want %+v", got, want)
+	}
+	if got, err := h.Query(start, start.Add(time.Minute), "", 5, 1); err != nil || len(got) != 1 || got[0].Value != 21.5 {
+		t.Errorf("Query of node 5 sensor 1 = %+v, %v", got, err)
+	}
+	if got, err := h.Query(start, start.Add(time.Minute), "B", 5, -1); err != nil || len(got) != 1 || got[0].Value != 40 {
+		t.Errorf("Query of node 5 on gateway B = %+v, %v", got, err)
+	}
+}
+
+func TestHistoryReadV2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var b bytes.Buffer
+	b.WriteString(historyMagicV2)
+	fw, _ := flate.NewWriter(&b, flate.BestCompression)
+	rec := make([]byte, binary.MaxVarintLen64+12)
+	n := binary.PutUvarint(rec, 1577934245000)
+	rec[n], rec[n+1], rec[n+2], rec[n+3] = 5, 1, uint8(V_TEMP), syntheticBit
+	binary.LittleEndian.PutUint64(rec[n+4:], math.Float64bits(21.5))
+	fw.Write(rec[:n+12])
+	fw.Close()
+	path := filepath.Join(dir, "1577934245000-1577934245000.seg")
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readSegment(path)
+	want := []Reading{{Time: msTime(1577934245000), Node: 5, Sensor: 1, Variable: "V_TEMP", Value: 21.5, Synthetic: true, subType: V_TEMP}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("readSegment = %+v, %v, want %+v", got, err, want)
+	}
+}
+
+func TestHistoryCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h, err := OpenHistory(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("OpenHistory: %v", err)
+	}
+	start := time.Date(2020, 1, 2, 3, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		h.Record(Reading{Time: start.Add(time.Duration(i) * time.Hour), Node: 5, Sensor: 1, Variable: "V_TEMP", Value: float64(i), subType: V_TEMP})
+		if err := h.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	done := make(chan error)
+	go func() { done <- h.Compact(start.Add(48 * time.Hour)) }()
+	// Readings are recorded while compacting.
+	h.Record(Reading{Time: start.Add(24 * time.Hour), Node: 5, Sensor: 1, Variable: "V_TEMP", Value: 3, subType: V_TEMP})
+	if err := <-done; err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.seg")); len(files) != 1 {
+		t.Errorf("segments after compacting = %v, want 1", files)
+	}
+	got, err := h.Query(start, start.Add(48*time.Hour), "", -1, -1)
+	if err != nil || len(got) != 4 {
+		t.Fatalf("Query = %+v, %v, want 4 readings", got, err)
+	}
+	for i, r := range got {
+		if r.Value != float64(i) {
+			t.Errorf("reading %d = %g, want %d", i, r.Value, i)
+		}
+	}
+}
+
+func TestHistorySameRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := OpenHistory(dir, 0); err == nil {
+		t.Error("OpenHistory with a 0 segment period succeeded")
+	}
+	h, err := OpenHistory(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("OpenHistory: %v", err)
+	}
+	// Two flushes of readings in the same millisecond write two segments.
+	start := time.Date(2020, 1, 2, 3, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		h.Record(Reading{Time: start, Node: 5, Sensor: 1, Variable: "V_TEMP", Value: float64(i), subType: V_TEMP})
+		if err := h.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	if h, err = OpenHistory(dir, time.Hour); err != nil {
+		t.Fatalf("OpenHistory: %v", err)
+	}
+	if got, err := h.Query(start, start.Add(time.Minute), "", -1, -1); err != nil || len(got) != 2 {
+		t.Errorf("Query = %+v, %v, want 2 readings", got, err)
+	}
+}
@@ -0,0 +1,154 @@
+// This file contains a Home Assistant configuration generator.
+package mysensors
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/template"
+)
+
+var haTemplate = template.Must(template.New("homeassistant").Funcs(template.FuncMap{
+	"quote": strconv.Quote,
+}).Parse(`# Home Assistant MQTT configuration generated by mysensors-prom.
+mqtt:
+{{- range $platform, $entities := .}}
+  {{$platform}}:
+{{- range $entities}}
+    - name: {{quote .Name}}
+      unique_id: {{quote .UniqueID}}
+      state_topic: {{quote .StateTopic}}
+{{- if .CommandTopic}}
+      command_topic: {{quote .CommandTopic}}
+{{- end}}
+{{- if .DeviceClass}}
+      device_class: {{.DeviceClass}}
+{{- end}}
+{{- if .Unit}}
+      unit_of_measurement: {{quote .Unit}}
+{{- end}}
+{{- if ne $platform "sensor"}}
+      payload_on: "1"
+      payload_off: "0"
+{{- end}}
+{{- end}}
+{{- end}}
+`))
+
+// haEntity is a Home Assistant MQTT entity.
+type haEntity struct {
+	Name         string
+	UniqueID     string
+	StateTopic   string
+	CommandTopic string
+	DeviceClass  string
+	Unit         string
+}
+
+// haSensorClasses maps variables to Home Assistant sensor device classes and units.
+var haSensorClasses = map[SubTypeSetReq][2]string{
+	V_TEMP:         {"temperature", "°C"},
+	V_HUM:          {"humidity", "%"},
+	V_PRESSURE:     {"pressure", "hPa"},
+	V_VOLTAGE:      {"voltage", "V"},
+	V_CURRENT:      {"current", "A"},
+	V_WATT:         {"power", "W"},
+	V_KWH:          {"energy", "kWh"},
+	V_LEVEL:        {"illuminance", "lx"},
+	V_LIGHT_LEVEL:  {"", "%"},
+	V_PERCENTAGE:   {"", "%"},
+	V_DISTANCE:     {"distance", "cm"},
+	V_WIND:         {"wind_speed", "m/s"},
+	V_GUST:         {"wind_speed", "m/s"},
+	V_DIRECTION:    {"", "°"},
+	V_PH:           {"", "pH"},
+	V_ORP:          {"", "mV"},
+	V_EC:           {"", "µS/cm"},
+	V_VAR:          {"reactive_power", "var"},
+	V_VA:           {"apparent_power", "VA"},
+	V_POWER_FACTOR: {"power_factor", ""},
+	V_IMPEDANCE:    {"", "Ω"},
+	V_UV:           {"", "UV index"},
+	V_WEIGHT:       {"weight", "kg"},
+	V_RAIN:         {"precipitation", "mm"},
+	V_RAINRATE:     {"precipitation_intensity", "mm/h"},
+	V_FLOW:         {"", "m"},
+}
+
+// haBinaryClasses maps presentations to Home Assistant binary sensor device classes.
+var haBinaryClasses = map[SubTypePresentation]string{
+	S_DOOR:       "door",
+	S_MOTION:     "motion",
+	S_SMOKE:      "smoke",
+	S_WATER_LEAK: "moisture",
+	S_VIBRATION:  "vibration",
+	S_SOUND:      "sound",
+}
+
+// HomeAssistantYAML writes a Home Assistant manual MQTT configuration for
+// all known sensors, using the topics published by MQTTClient. Switches are
+// only generated when reading from an MQTT gateway, which can carry commands.
+func (n *Network) HomeAssistantYAML(w io.Writer) error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	entities := map[string][]haEntity{}
+	nodes := []*Node{}
+	for _, node := range n.Nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	for _, node := range nodes {
+		sensors := []*Sensor{}
+		for _, sensor := range node.Sensors {
+			sensors = append(sensors, sensor)
+		}
+		sort.Slice(sensors, func(i, j int) bool { return sensors[i].ID < sensors[j].ID })
+		for _, s := range sensors {
+			vars := []*Var{}
+			for _, v := range s.Vars {
+				vars = append(vars, v)
+			}
+			sort.Slice(vars, func(i, j int) bool { return vars[i].SubType < vars[j].SubType })
+			for _, v := range vars {
+				m := &Message{NodeID: node.ID, ChildSensorID: s.ID, Type: MsgSet, SubType: v.SubType}
+				e := haEntity{
+					Name:       fmt.Sprintf("Node %d Sensor %d %s", node.ID, s.ID, v.SubType),
+					UniqueID:   fmt.Sprintf("mysensors_%d_%d_%d", node.ID, s.ID, v.SubType),
+					StateTopic: m.Topic(*topicPrefix),
+				}
+				if node.Location != "" {
+					e.Name = fmt.Sprintf("%s %s", node.Location, e.Name)
+				}
+				platform := "sensor"
+				switch v.SubType {
+				case V_TRIPPED, V_ARMED:
+					platform = "binary_sensor"
+					if s.Presentation != nil {
+						e.DeviceClass = haBinaryClasses[*s.Presentation]
+					}
+				case V_STATUS, V_LOCK_STATUS:
+					platform = "binary_sensor"
+					if *gatewayBroker != "" {
+						platform = "switch"
+						e.CommandTopic = m.Topic(*gatewayTopicIn)
+					}
+				default:
+					if v.Type != varFloat {
+						continue
+					}
+					c := haSensorClasses[v.SubType]
+					if s.airQuality(v.SubType) {
+						c = [2]string{"carbon_dioxide", "ppm"}
+						if s.pollutant() == "voc" {
+							c = [2]string{"volatile_organic_compounds", "ppb"}
+						}
+					}
+					e.DeviceClass, e.Unit = c[0], c[1]
+				}
+				entities[platform] = append(entities[platform], e)
+			}
+		}
+	}
+	return haTemplate.Execute(w, entities)
+}
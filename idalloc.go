@@ -0,0 +1,228 @@
+// This file contains the allocation of node IDs.
+package mysensors
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrNoNodeIDs is returned when every node ID is allocated or reserved.
+var ErrNoNodeIDs = errors.New("no free node IDs")
+
+var (
+	idAllocationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_id_allocation_errors_total",
+		Help: "Node ID requests not answered, by reason: exhausted or save",
+	}, []string{"reason"})
+	freeIDGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mysensors_free_node_ids",
+		Help: "Node IDs of the gateway neither allocated, reserved nor in use",
+	}, []string{"gateway"})
+)
+
+func init() {
+	mustRegister(idAllocationErrors, freeIDGauge)
+}
+
+// IDAllocator allocates node IDs, never reissuing an ID allocated or seen
+// before. Each gateway has its own IDs. It is persisted in its own file, so
+// IDs are not reissued to new nodes if the state file is lost.
+type IDAllocator struct {
+	mux  sync.Mutex
+	path string
+	// Allocated are the IDs allocated or seen by versions without IDs per
+	// gateway, and when. They are not allocated on any gateway.
+	Allocated map[uint8]time.Time `json:",omitempty"`
+	// Gateways are the IDs allocated or seen on each gateway, and when.
+	Gateways map[string]map[uint8]time.Time
+	// Reserved are static IDs which are never allocated.
+	Reserved map[uint8]bool `json:"-"`
+}
+
+// NewIDAllocator returns an allocator kept in memory only.
+func NewIDAllocator() *IDAllocator {
+	return &IDAllocator{Allocated: map[uint8]time.Time{}, Gateways: map[string]map[uint8]time.Time{}, Reserved: map[uint8]bool{}}
+}
+
+// LoadIDAllocator returns an allocator persisted to path, reading the
+// allocated IDs if it exists. reserved is a comma separated list of static
+// IDs and ranges, eg "1-10,42", which are never allocated.
+func LoadIDAllocator(path, reserved string) (*IDAllocator, error) {
+	a := NewIDAllocator()
+	a.path = path
+	for _, r := range strings.Split(reserved, ",") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		bounds := strings.SplitN(r, "-", 2)
+		lo, err := parseUint8(bounds[0])
+		hi := lo
+		if err == nil && len(bounds) == 2 {
+			hi, err = parseUint8(bounds[1])
+		}
+		if err != nil || hi < lo {
+			return nil, fmt.Errorf("invalid reserved IDs %q", r)
+		}
+		for id := int(lo); id <= int(hi); id++ {
+			a.Reserved[uint8(id)] = true
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return a, nil
+}
+
+// gateway returns the IDs allocated on the gateway. a.mux must be held.
+func (a *IDAllocator) gateway(gateway string) map[uint8]time.Time {
+	if a.Gateways == nil {
+		a.Gateways = map[string]map[uint8]time.Time{}
+	}
+	ids, ok := a.Gateways[gateway]
+	if !ok {
+		ids = map[uint8]time.Time{}
+		a.Gateways[gateway] = ids
+	}
+	return ids
+}
+
+// allocated returns whether the ID is allocated on the gateway. a.mux must be
+// held.
+func (a *IDAllocator) allocated(gateway string, id uint8) bool {
+	_, legacy := a.Allocated[id]
+	_, ok := a.Gateways[gateway][id]
+	return legacy || ok
+}
+
+// allocate returns the lowest free ID of the gateway, not allocated,
+// reserved or in use, and persists it as allocated.
+func (a *IDAllocator) allocate(gateway string, inUse func(uint8) bool) (uint8, error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	free := a.free(gateway, inUse)
+	if len(free) == 0 {
+		idAllocationErrors.WithLabelValues("exhausted").Inc()
+		return 0, ErrNoNodeIDs
+	}
+	id := free[0]
+	a.gateway(gateway)[id] = time.Now()
+	if err := a.save(); err != nil {
+		// Issuing an ID which may be reissued after a restart risks a
+		// collision, so fail the request. The node retries.
+		delete(a.gateway(gateway), id)
+		idAllocationErrors.WithLabelValues("save").Inc()
+		return 0, fmt.Errorf("saving allocated IDs: %v", err)
+	}
+	freeIDGauge.WithLabelValues(gateway).Set(float64(len(free) - 1))
+	return id, nil
+}
+
+// claim allocates a specific ID of the gateway, eg to reassign it, and
+// persists it.
+func (a *IDAllocator) claim(gateway string, id uint8) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.gateway(gateway)[id] = time.Now()
+	if err := a.save(); err != nil {
+		delete(a.gateway(gateway), id)
+		idAllocationErrors.WithLabelValues("save").Inc()
+		return fmt.Errorf("saving allocated IDs: %v", err)
+	}
+	return nil
+}
+
+// free returns the free IDs of the gateway, in order. a.mux must be held.
+func (a *IDAllocator) free(gateway string, inUse func(uint8) bool) []uint8 {
+	var free []uint8
+	for id := FirstNodeID; id < BroadcastID; id++ {
+		if !a.allocated(gateway, uint8(id)) && !a.Reserved[uint8(id)] && !inUse(uint8(id)) {
+			free = append(free, uint8(id))
+		}
+	}
+	return free
+}
+
+// seen records an ID in use on the gateway, eg by a node with a static ID,
+// so it is not allocated.
+func (a *IDAllocator) seen(gateway string, id uint8) {
+	if id < FirstNodeID || id >= BroadcastID {
+		return
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if a.allocated(gateway, id) {
+		return
+	}
+	a.gateway(gateway)[id] = time.Now()
+	if err := a.save(); err != nil {
+		logf(modNetwork, LevelError, "Error saving allocated IDs: %v", err)
+	}
+}
+
+// save writes the allocated IDs, if persisted. The file is replaced
+// atomically. a.mux must be held.
+func (a *IDAllocator) save() error {
+	if a.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, a.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// release frees an allocated ID of the gateway which the node never used, or
+// gave up. IDs allocated before IDs were kept per gateway stay allocated, as
+// they may be in use on another gateway.
+func (a *IDAllocator) release(gateway string, id uint8) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	delete(a.gateway(gateway), id)
+	if err := a.save(); err != nil {
+		logf(modNetwork, LevelError, "Error saving allocated IDs: %v", err)
+	}
+}
+
+// SetIDAllocator sets the allocator of node IDs, replacing the default
+// one kept in memory. The IDs of known nodes are recorded as allocated.
+func (n *Network) SetIDAllocator(a *IDAllocator) error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.ids = a
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	added := false
+	for _, nd := range n.Nodes {
+		if !a.allocated(nd.Gateway, nd.ID) && nd.ID >= FirstNodeID && nd.ID < BroadcastID {
+			a.gateway(nd.Gateway)[nd.ID] = time.Now()
+			added = true
+		}
+	}
+	if !added {
+		return nil
+	}
+	return a.save()
+}
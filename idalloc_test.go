@@ -0,0 +1,79 @@
+package mysensors
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIDAllocator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idalloc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ids.json")
+	a, err := LoadIDAllocator(path, "1-3,5")
+	if err != nil {
+		t.Fatalf("LoadIDAllocator: %v", err)
+	}
+	inUse := func(id uint8) bool { return id == 4 }
+	for _, want := range []uint8{6, 7} {
+		if id, err := a.allocate("A", inUse); err != nil || id != want {
+			t.Errorf("allocate = %d, %v, want %d", id, err, want)
+		}
+	}
+	// IDs are per gateway.
+	if id, err := a.allocate("B", inUse); err != nil || id != 6 {
+		t.Errorf("allocate on B = %d, %v, want 6", id, err)
+	}
+	a.seen("A", 8)
+	a.release("A", 6)
+	if id, err := a.allocate("A", inUse); err != nil || id != 6 {
+		t.Errorf("allocate after release = %d, %v, want 6", id, err)
+	}
+
+	// Allocations persist, the reserved IDs don't.
+	a, err = LoadIDAllocator(path, "")
+	if err != nil {
+		t.Fatalf("reloading: %v", err)
+	}
+	if id, err := a.allocate("A", inUse); err != nil || id != 1 {
+		t.Errorf("allocate after reload = %d, %v, want 1", id, err)
+	}
+	if id, err := a.allocate("A", func(uint8) bool { return false }); err != nil || id != 2 {
+		t.Errorf("allocate after reload = %d, %v, want 2", id, err)
+	}
+	if got := a.free("A", inUse); len(got) == 0 || got[0] != 3 || got[1] != 5 || got[2] != 9 {
+		t.Errorf("free after reload starts %v, want [3 5 9 ...]", got[:3])
+	}
+}
+
+func TestIDAllocatorLegacy(t *testing.T) {
+	a := NewIDAllocator()
+	a.Allocated[1] = time.Now()
+	if id, err := a.allocate("A", func(uint8) bool { return false }); err != nil || id != 2 {
+		t.Errorf("allocate = %d, %v, want 2", id, err)
+	}
+	a.release("A", 1)
+	if !a.allocated("B", 1) {
+		t.Error("legacy ID 1 was released")
+	}
+}
+
+func TestIDAllocatorExhausted(t *testing.T) {
+	a := NewIDAllocator()
+	if _, err := a.allocate("A", func(uint8) bool { return true }); err != ErrNoNodeIDs {
+		t.Errorf("allocate = %v, want %v", err, ErrNoNodeIDs)
+	}
+}
+
+func TestLoadIDAllocatorReserved(t *testing.T) {
+	for _, r := range []string{"x", "5-3", "1-256", "-1"} {
+		if _, err := LoadIDAllocator("", r); err == nil {
+			t.Errorf("LoadIDAllocator(%q) succeeded", r)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// This file contains handling of ignored sensors.
+package mysensors
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// SetIgnored marks a sensor of a node on the gateway, which may be empty if
+// the ID is only on one, as ignored, or not. Ignored sensors are still
+// tracked, but their values are neither exported nor published.
+func (n *Network) SetIgnored(gateway string, node, sensor uint8, ignored bool) error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	nd, err := n.node(gateway, node)
+	if err != nil {
+		return err
+	}
+	s, ok := nd.Sensors[strconv.Itoa(int(sensor))]
+	if !ok {
+		return fmt.Errorf("unknown sensor %d/%d", node, sensor)
+	}
+	s.Ignored = ignored
+	n.changed()
+	if ignored {
+		s.unexportAll()
+	}
+	return nil
+}
+
+// Ignored reports whether the message is for an ignored sensor.
+func (n *Network) Ignored(m *Message) bool {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	s := n.sensor(m.Gateway, m.NodeID, m.ChildSensorID)
+	return s != nil && s.Ignored
+}
+
+// sensor returns the given sensor of the node on the gateway, or on
+// whichever gateway if empty, or nil if unknown. n.mux must be held.
+func (n *Network) sensor(gateway string, node, sensor uint8) *Sensor {
+	nd, err := n.node(gateway, node)
+	if err != nil {
+		return nil
+	}
+	return nd.Sensors[strconv.Itoa(int(sensor))]
+}
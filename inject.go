@@ -0,0 +1,112 @@
+// This file contains injection of synthetic test messages.
+package mysensors
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var injectedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mysensors_synthetic_messages_total",
+	Help: "Synthetic test messages injected",
+}, []string{"gateway"})
+
+func init() {
+	mustRegister(injectedCount)
+}
+
+// Inject passes the set message m to the network as if received from the
+// gateway, flagged as Synthetic, so it reaches the metrics, alerts and
+// history. It is for testing dashboards and alerts end-to-end. It isn't
+// gateway traffic, so isn't passed to subscribers or handled by the Handler.
+// It fails at once if the Handler is not running.
+func (h *Handler) Inject(m *Message) error {
+	if m.Type != MsgSet {
+		return fmt.Errorf("can't inject %s messages, only set", m.Type)
+	}
+	select {
+	case <-h.started:
+	default:
+		return errors.New("handler is not running")
+	}
+	m.Gateway = h.Gateway
+	m.Synthetic = true
+	logf(modHandler, LevelInfo, "Injecting synthetic message: %s", m)
+	select {
+	case h.c <- m:
+		injectedCount.WithLabelValues(h.Gateway).Inc()
+		return nil
+	case <-h.done:
+		return errors.New("handler stopped")
+	case <-time.After(5 * time.Second):
+		return errors.New("timed out, handler is busy")
+	}
+}
+
+// injected exports the value of a synthetic message. It isn't recorded as
+// received: nodes aren't created, seen or woken, and IDs aren't allocated.
+// A node or sensor not yet known gets a stand-in, not added to the network.
+// n.mux must be held.
+func (n *Network) injected(m *Message) error {
+	if m.Type != MsgSet {
+		return fmt.Errorf("can't inject %s messages, only set", m.Type)
+	}
+	nd, ok := n.Nodes[nodeKey(m.Gateway, m.NodeID)]
+	if !ok {
+		nd = NewNode(n)
+		nd.ID = m.NodeID
+		nd.Gateway = m.Gateway
+	}
+	s, ok := nd.Sensors[strconv.Itoa(int(m.ChildSensorID))]
+	if !ok {
+		s = NewSensor(nd)
+		s.ID = m.ChildSensorID
+	}
+	s.injectValue(m)
+	return nil
+}
+
+// injectValue exports an injected value on series labelled synthetic="true",
+// and raises its alerts and records it in the history flagged as synthetic.
+// The sensor's values, counters and watermarks are left as received, so the
+// injected value neither replaces the real reading nor is exported later as
+// one.
+func (s *Sensor) injectValue(m *Message) {
+	t := m.SubType.(SubTypeSetReq)
+	v := s.newVar(t)
+	v.SubType = t
+	if err := v.Set(string(m.Payload)); err != nil {
+		logf(modNetwork, LevelWarn, "Invalid synthetic %s value %q: %v", t, m.Payload, err)
+		return
+	}
+	v.Updated = time.Now()
+	s.synthetic = true
+	defer func() { s.synthetic = false }()
+	if t == V_TRIPPED {
+		s.raiseAlert(s.Vars[t.String()], v, true)
+	}
+	if s.Ignored {
+		return
+	}
+	if v.Type == varFloat {
+		s.track(s.node.network.gauges.SetUnit(t, s.metricUnit(t), s.labels(), s.converted(t, v.FloatVal))...)
+		s.recordHistory(t, v.FloatVal, true)
+	}
+	s.exportValue(v)
+	s.exportBinary(v)
+}
+
+// ParseSubType returns the message type and sub type with the given name,
+// eg V_TEMP.
+func ParseSubType(name string) (MsgType, SubType, error) {
+	for _, t := range []MsgType{MsgSet, MsgInternal, MsgPresentation} {
+		if st, err := parseSubType(t, name); err == nil {
+			return t, st, nil
+		}
+	}
+	return 0, nil, errors.New("unknown sub type " + name)
+}
@@ -0,0 +1,56 @@
+package mysensors
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInjectValue(t *testing.T) {
+	r := prometheus.NewRegistry()
+	n := NewNetwork(WithRegisterer(r))
+	for _, m := range []*Message{
+		{NodeID: 5, ChildSensorID: 1, Type: MsgSet, SubType: V_TEMP, Payload: []byte("21.5")},
+		{NodeID: 5, ChildSensorID: 1, Type: MsgSet, SubType: V_TEMP, Payload: []byte("99"), Synthetic: true},
+	} {
+		n.HandleMessage(m, nil)
+	}
+	// The injected value is a separate series, leaving the real one.
+	want := `
+# HELP temperature MYSENSORS V_TEMP
+# TYPE temperature gauge
+temperature{gateway="",location="",name="",node="5",sensor="1",sketch="",synthetic="",type=""} 21.5
+temperature{gateway="",location="",name="",node="5",sensor="1",sketch="",synthetic="true",type=""} 99
+`
+	if err := testutil.GatherAndCompare(r, strings.NewReader(want), "temperature"); err != nil {
+		t.Error(err)
+	}
+	if v := n.Nodes[nodeKey("", 5)].Sensors["1"].Vars[V_TEMP.String()].FloatVal; v != 21.5 {
+		t.Errorf("V_TEMP = %g after injection, want 21.5", v)
+	}
+}
+
+func TestInjectNotRunning(t *testing.T) {
+	h := NewHandler(nil, nil, nil)
+	if err := h.Inject(&Message{NodeID: 5, ChildSensorID: 1, Type: MsgSet, SubType: V_TEMP}); err == nil {
+		t.Error("Inject into a handler not started succeeded")
+	}
+}
+
+func TestInjectUnknownNode(t *testing.T) {
+	r := prometheus.NewRegistry()
+	n := NewNetwork(WithRegisterer(r))
+	n.HandleMessage(&Message{NodeID: 7, ChildSensorID: 1, Type: MsgSet, SubType: V_TEMP, Payload: []byte("99"), Synthetic: true}, nil)
+	// The injected value is exported, but the node isn't created or seen.
+	if len(n.Nodes) != 0 {
+		t.Errorf("injection created nodes %v", n.Nodes)
+	}
+	if c, err := testutil.GatherAndCount(r, "temperature"); err != nil || c != 1 {
+		t.Errorf("%d temperature series (%v), want 1", c, err)
+	}
+	if c, err := testutil.GatherAndCount(r, lastSeenMetric); err != nil || c != 0 {
+		t.Errorf("%d last seen series (%v), want 0", c, err)
+	}
+}
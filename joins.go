@@ -0,0 +1,103 @@
+// This file contains the watchdog of node ID assignments.
+package mysensors
+
+import (
+	"flag"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var presentationTimeout = flag.Duration("presentation_timeout", time.Minute, "Time for a node to present after being assigned an ID before the assignment is failed")
+
+// maxFailedJoins is the number of failed assignments kept.
+const maxFailedJoins = 50
+
+var (
+	idAssignmentCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_id_assignments_total",
+		Help: "Node IDs assigned, by result: presented or timeout",
+	}, []string{"result"})
+	pendingIDGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mysensors_pending_id_assignments",
+		Help: "Node IDs assigned that the node has not yet presented with",
+	})
+)
+
+func init() {
+	mustRegister(idAssignmentCount, pendingIDGauge)
+}
+
+// FailedJoin is an ID assignment the node did not present with in time.
+type FailedJoin struct {
+	Node     uint8
+	Gateway  string `json:",omitempty"`
+	Assigned time.Time
+	Expired  time.Time
+}
+
+// Joins are the ID assignments awaiting presentation and those that failed.
+type Joins struct {
+	// Pending are the times of the assignments by node, keyed as in Nodes.
+	Pending map[string]time.Time
+	Failed  []FailedJoin
+}
+
+// assign records an ID assignment on the gateway, failing it if the node
+// does not present within --presentation_timeout. Called with the mux held.
+func (n *Network) assign(gateway string, id uint8) {
+	if n.pendingIDs == nil {
+		n.pendingIDs = make(map[string]time.Time)
+	}
+	assigned := time.Now()
+	n.pendingIDs[nodeKey(gateway, id)] = assigned
+	pendingIDGauge.Set(float64(len(n.pendingIDs)))
+	time.AfterFunc(*presentationTimeout, func() { n.joinTimeout(gateway, id, assigned) })
+}
+
+// joined clears a pending assignment once the node presents. Called with the
+// mux held.
+func (n *Network) joined(m *Message) {
+	if m.Type != MsgPresentation {
+		return
+	}
+	if _, ok := n.pendingIDs[nodeKey(m.Gateway, m.NodeID)]; !ok {
+		return
+	}
+	delete(n.pendingIDs, nodeKey(m.Gateway, m.NodeID))
+	pendingIDGauge.Set(float64(len(n.pendingIDs)))
+	idAssignmentCount.WithLabelValues("presented").Inc()
+	logf(modNetwork, LevelInfo, "Node %d presented after ID assignment.", m.NodeID)
+}
+
+// joinTimeout fails the assignment of id, freeing it, if the node has not
+// presented since.
+func (n *Network) joinTimeout(gateway string, id uint8, assigned time.Time) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if t, ok := n.pendingIDs[nodeKey(gateway, id)]; !ok || !t.Equal(assigned) {
+		return
+	}
+	delete(n.pendingIDs, nodeKey(gateway, id))
+	n.ids.release(gateway, id)
+	pendingIDGauge.Set(float64(len(n.pendingIDs)))
+	idAssignmentCount.WithLabelValues("timeout").Inc()
+	n.failedJoins = append(n.failedJoins, FailedJoin{Node: id, Gateway: gateway, Assigned: assigned, Expired: time.Now()})
+	if len(n.failedJoins) > maxFailedJoins {
+		n.failedJoins = n.failedJoins[len(n.failedJoins)-maxFailedJoins:]
+	}
+	logf(modNetwork, LevelWarn, "Node assigned ID %d did not present within %v, freeing the ID.", id, *presentationTimeout)
+}
+
+// Joins returns the pending and failed ID assignments.
+func (n *Network) Joins() Joins {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	j := Joins{Pending: map[string]time.Time{}, Failed: append([]FailedJoin{}, n.failedJoins...)}
+	for key, t := range n.pendingIDs {
+		j.Pending[key] = t
+	}
+	sort.Slice(j.Failed, func(a, b int) bool { return j.Failed[a].Expired.After(j.Failed[b].Expired) })
+	return j
+}
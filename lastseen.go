@@ -0,0 +1,53 @@
+// This file contains the time nodes and sensors were last heard from.
+package mysensors
+
+import (
+	"strconv"
+	"time"
+)
+
+const lastSeenMetric = "mysensors_last_seen_timestamp_seconds"
+
+func init() {
+	fixedGauges[lastSeenMetric] = fixedVec{
+		help:   "Unix time of the last message from the sensor, or the node itself as sensor 255",
+		labels: []string{"node", "sensor", "location", "gateway", "name"},
+	}
+}
+
+// seen records that a message was received from the node, and the sensor
+// unless nil. n.mux must be held.
+func (nd *Node) seen(s *Sensor, t time.Time) {
+	nd.LastSeen = t
+	if nd.expired {
+		nd.expired = false
+		nd.reexport()
+	}
+	nd.exportLastSeen()
+	if s != nil {
+		s.LastSeen = t
+		s.exportLastSeen()
+	}
+}
+
+// exportLastSeen exports when the node was last heard from, if known.
+func (nd *Node) exportLastSeen() {
+	if nd.LastSeen.IsZero() {
+		return
+	}
+	nd.gauge(lastSeenMetric).WithLabelValues(nd.lastSeenLabels()...).Set(float64(nd.LastSeen.Unix()))
+}
+
+// lastSeenLabels are the labels of the node's last seen series.
+func (nd *Node) lastSeenLabels() []string {
+	return []string{strconv.Itoa(int(nd.ID)), strconv.Itoa(NoChild), nd.Location, nd.Gateway, nd.Name}
+}
+
+// exportLastSeen exports when the sensor was last heard from, if known.
+func (s *Sensor) exportLastSeen() {
+	if s.LastSeen.IsZero() || s.Ignored {
+		return
+	}
+	labels := []string{strconv.Itoa(int(s.node.ID)), strconv.Itoa(int(s.ID)), s.node.Location, s.node.Gateway, s.name()}
+	s.export(lastSeenMetric, labels, float64(s.LastSeen.Unix()))
+}
@@ -0,0 +1,71 @@
+// This file contains the latency of nodes answering requests and acks.
+package mysensors
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var latencyHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "mysensors_response_latency_seconds",
+	Help:    "Time from writing a REQ or a message with ack set to the gateway until the node's answer or echo is received",
+	Buckets: prometheus.ExponentialBuckets(0.01, 2, 10),
+}, []string{"node", "gateway", "kind"})
+
+func init() {
+	mustRegister(latencyHistogram)
+}
+
+// reqKey identifies a REQ and the SET answering it.
+func reqKey(m *Message) string {
+	return fmt.Sprintf("%d;%d;%d", m.NodeID, m.ChildSensorID, m.SubType.Value())
+}
+
+// observeLatency records the time since sent for the answer of kind ack or
+// req of a node on the gateway.
+func observeLatency(gateway string, node uint8, kind string, sent time.Time) {
+	latencyHistogram.WithLabelValues(strconv.Itoa(int(node)), gateway, kind).Observe(time.Since(sent).Seconds())
+}
+
+// trackReq records that the REQ m was sent. The first transmission of
+// repeated REQs counts.
+func (h *Handler) trackReq(m *Message) {
+	h.ackMux.Lock()
+	defer h.ackMux.Unlock()
+	if h.reqs == nil {
+		h.reqs = make(map[string]time.Time)
+	}
+	k := reqKey(m)
+	if _, ok := h.reqs[k]; !ok {
+		h.reqs[k] = time.Now()
+	}
+}
+
+// answerReq records the latency of the REQ answered by the received SET m,
+// if any.
+func (h *Handler) answerReq(m *Message) {
+	if m.Type != MsgSet {
+		return
+	}
+	h.ackMux.Lock()
+	defer h.ackMux.Unlock()
+	k := reqKey(m)
+	if sent, ok := h.reqs[k]; ok {
+		delete(h.reqs, k)
+		observeLatency(h.Gateway, m.NodeID, "req", sent)
+	}
+}
+
+// expireReqs forgets REQs unanswered for as long as echoes are awaited, so
+// late answers, eg from sleeping nodes, are not counted. h.ackMux must be
+// held.
+func (h *Handler) expireReqs(now time.Time) {
+	for k, sent := range h.reqs {
+		if now.Sub(sent) > time.Duration(*ackRetries+1)**ackTimeout {
+			delete(h.reqs, k)
+		}
+	}
+}
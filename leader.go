@@ -0,0 +1,93 @@
+// This file contains leader election between instances sharing a gateway.
+package mysensors
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var leaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "mysensors_leader",
+	Help: "Whether this instance is the leader, and writes to the gateways",
+})
+
+func init() {
+	mustRegister(leaderGauge)
+}
+
+// Elector decides whether this instance is the leader, when several
+// instances share a gateway. Only the leader writes to the gateway, while
+// all instances read from it and export metrics.
+type Elector interface {
+	Leader() bool
+}
+
+// FileLockElector elects the instance holding an exclusive lock on a file,
+// eg on storage shared between the instances. The lock is released when the
+// leader exits.
+type FileLockElector struct {
+	// Path is the lock file, created if it does not exist.
+	Path string
+	// Interval is the time between attempts to take the lock.
+	Interval time.Duration
+
+	mux    sync.Mutex
+	leader bool
+}
+
+// Leader returns whether this instance holds the lock.
+func (e *FileLockElector) Leader() bool {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.leader
+}
+
+// Run tries to take the lock every Interval until it does, then holds it
+// until ctx is done.
+func (e *FileLockElector) Run(ctx context.Context) error {
+	f, err := os.OpenFile(e.Path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	leaderGauge.Set(0)
+	logf(modHandler, LevelInfo, "Waiting for leader lock %s.", e.Path)
+	t := time.NewTicker(e.Interval)
+	defer t.Stop()
+	for {
+		if err := tryLock(f); err == nil {
+			break
+		} else if err != errLocked {
+			return err
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	// Record the leader for humans.
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	e.setLeader(true)
+	logf(modHandler, LevelInfo, "Took leader lock %s, writing to gateways.", e.Path)
+	<-ctx.Done()
+	e.setLeader(false)
+	return nil
+}
+
+func (e *FileLockElector) setLeader(leader bool) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.leader = leader
+	if leader {
+		leaderGauge.Set(1)
+	} else {
+		leaderGauge.Set(0)
+	}
+}
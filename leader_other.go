@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+// This file contains file locking for other systems.
+package mysensors
+
+import (
+	"errors"
+	"os"
+)
+
+// errLocked is returned by tryLock if another process holds the lock.
+var errLocked = errors.New("file is locked")
+
+// tryLock is not supported on this platform.
+func tryLock(f *os.File) error {
+	return errors.New("leader lock files are not supported on this platform")
+}
@@ -0,0 +1,23 @@
+//go:build linux || darwin
+// +build linux darwin
+
+// This file contains file locking for unix systems.
+package mysensors
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// errLocked is returned by tryLock if another process holds the lock.
+var errLocked = errors.New("file is locked")
+
+// tryLock takes an exclusive lock on f without blocking.
+func tryLock(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLocked
+	}
+	return err
+}
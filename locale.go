@@ -0,0 +1,71 @@
+// This file contains locale-aware rendering for status output.
+package mysensors
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+)
+
+var (
+	displayLocale   = flag.String("locale", "en", "Locale for numbers in status output, eg en, de_DE")
+	displayTempUnit = flag.String("display_temp_unit", "C", "Temperature unit in status output, C or F")
+)
+
+// commaLocales are languages using a decimal comma.
+var commaLocales = map[string]bool{
+	"bg": true, "cs": true, "da": true, "de": true, "el": true, "es": true,
+	"fi": true, "fr": true, "hr": true, "hu": true, "id": true, "it": true,
+	"lt": true, "lv": true, "nb": true, "nl": true, "pl": true, "pt": true,
+	"ro": true, "ru": true, "sk": true, "sl": true, "sr": true, "sv": true,
+	"tr": true, "uk": true,
+}
+
+// displayUnits are the units shown for variables in status output.
+var displayUnits = map[SubTypeSetReq]string{
+	V_HUM:         "%",
+	V_PERCENTAGE:  "%",
+	V_LIGHT_LEVEL: "%",
+	V_PRESSURE:    "hPa",
+	V_VOLTAGE:     "V",
+	V_CURRENT:     "A",
+	V_WATT:        "W",
+	V_KWH:         "kWh",
+	V_LEVEL:       "lx",
+	V_IMPEDANCE:   "Ω",
+	V_WEIGHT:      "kg",
+	V_RAIN:        "mm",
+	V_RAINRATE:    "mm/h",
+	V_FLOW:        "m",
+}
+
+// formatNumber formats f for the configured locale.
+func formatNumber(f float64) string {
+	s := strconv.FormatFloat(f, 'f', 2, 64)
+	lang := strings.ToLower(strings.SplitN(strings.SplitN(*displayLocale, "_", 2)[0], "-", 2)[0])
+	if commaLocales[lang] {
+		s = strings.Replace(s, ".", ",", 1)
+	}
+	return s
+}
+
+// display returns the value of the sensor's variable formatted for status
+// output, in the configured locale and units. Temperatures are converted from
+// the unit the sensor reports in, see reportedTempUnit. Stored and exported
+// values are not affected.
+func (s *Sensor) display(v *Var) string {
+	if v.Type != varFloat {
+		return v.Value()
+	}
+	if v.SubType == V_TEMP {
+		to := "C"
+		if strings.EqualFold(*displayTempUnit, "F") {
+			to = "F"
+		}
+		return formatNumber(convertTemp(v.FloatVal, s.reportedTempUnit(), to)) + "°" + to
+	}
+	if v.Unit != "" {
+		return formatNumber(v.FloatVal) + v.Unit
+	}
+	return formatNumber(v.FloatVal) + displayUnits[v.SubType]
+}
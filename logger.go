@@ -0,0 +1,153 @@
+// This file contains leveled, per-module logging.
+package mysensors
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var logLevel = flag.String("log_level", "debug", "Log verbosity (error, warn, info or debug), optionally with per-module levels, eg info,handler=debug")
+
+// Level is a log verbosity level.
+type Level int
+
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+)
+
+var levelNames = [...]string{
+	"error",
+	"warn",
+	"info",
+	"debug",
+}
+
+func (l Level) String() string { return levelNames[l] }
+
+// ParseLevel parses a level name.
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Log modules.
+const (
+	modHandler   = "handler"
+	modNetwork   = "network"
+	modMQTT      = "mqtt"
+	modTransport = "transport"
+)
+
+// LogFunc receives a library log message, eg to write structured logs.
+type LogFunc func(module string, level Level, msg string)
+
+var (
+	logMux  sync.Mutex
+	logHook LogFunc
+)
+
+// SetLogFunc sends library log messages enabled by the log level to f
+// instead of the standard logger, or back to it if f is nil.
+func SetLogFunc(f LogFunc) {
+	logMux.Lock()
+	defer logMux.Unlock()
+	logHook = f
+}
+
+// output writes a log message to the hook or standard logger.
+func output(module string, level Level, msg string) {
+	logMux.Lock()
+	f := logHook
+	logMux.Unlock()
+	if f != nil {
+		f(module, level, strings.TrimRight(msg, "\n"))
+		return
+	}
+	log.Print(msg)
+}
+
+var (
+	levelsOnce   sync.Once
+	levelsMux    sync.Mutex
+	defaultLevel = LevelDebug
+	moduleLevels = map[string]Level{}
+)
+
+// SetLogLevel sets the log verbosity from a spec of a default level and
+// optional per-module levels, eg "info" or "info,handler=debug,mqtt=warn".
+func SetLogLevel(spec string) error {
+	levelsOnce.Do(func() {})
+	return applyLogLevel(spec)
+}
+
+func applyLogLevel(spec string) error {
+	def := LevelDebug
+	mods := map[string]Level{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		l, err := ParseLevel(kv[len(kv)-1])
+		if err != nil {
+			return err
+		}
+		if len(kv) == 1 {
+			def = l
+		} else {
+			mods[kv[0]] = l
+		}
+	}
+	levelsMux.Lock()
+	defer levelsMux.Unlock()
+	defaultLevel, moduleLevels = def, mods
+	return nil
+}
+
+// LogLevel returns the current log verbosity spec.
+func LogLevel() string {
+	loadLogLevel()
+	levelsMux.Lock()
+	defer levelsMux.Unlock()
+	parts := []string{defaultLevel.String()}
+	for m, l := range moduleLevels {
+		parts = append(parts, m+"="+l.String())
+	}
+	sort.Strings(parts[1:])
+	return strings.Join(parts, ",")
+}
+
+// loadLogLevel applies --log_level on first use, after flags are parsed.
+func loadLogLevel() {
+	levelsOnce.Do(func() {
+		if err := applyLogLevel(*logLevel); err != nil {
+			output(modNetwork, LevelError, fmt.Sprintf("Invalid --log_level: %v", err))
+		}
+	})
+}
+
+// logf logs for module if level is enabled.
+func logf(module string, level Level, format string, v ...interface{}) {
+	loadLogLevel()
+	levelsMux.Lock()
+	l, ok := moduleLevels[module]
+	if !ok {
+		l = defaultLevel
+	}
+	levelsMux.Unlock()
+	if level <= l {
+		output(module, level, fmt.Sprintf(format, v...))
+	}
+}
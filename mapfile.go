@@ -0,0 +1,261 @@
+// This file contains the mapping file, overriding how variables are
+// exported.
+package mysensors
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// MappingRule sets how a variable is exported, for all sensors or those of
+// a node or single sensor. Rules override GaugeMap and the metric profile.
+type MappingRule struct {
+	// Var is the variable, eg V_TEMP.
+	Var string
+	// Node and Sensor, if set, limit the rule to a node or sensor.
+	Node   *uint8 `json:",omitempty"`
+	Sensor *uint8 `json:",omitempty"`
+	// Metric is the metric name.
+	Metric string
+	// Type is gauge, the default, or counter.
+	Type string `json:",omitempty"`
+	// Parser is number, the default, or binary for on/off payloads.
+	Parser string `json:",omitempty"`
+	// Scale multiplies the values, if not 0.
+	Scale float64 `json:",omitempty"`
+
+	subType SubTypeSetReq
+}
+
+// LoadMappingFile reads mapping rules from a JSON list, or a YAML list of
+// the lower case fields if the file is named .yaml or .yml.
+func LoadMappingFile(path string) ([]MappingRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []MappingRule
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		items, err := parseYAMLList(data)
+		if err != nil {
+			return nil, err
+		}
+		for i, item := range items {
+			r, err := yamlMappingRule(item)
+			if err != nil {
+				return nil, fmt.Errorf("%s: rule %d: %v", path, i+1, err)
+			}
+			rules = append(rules, r)
+		}
+	default:
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	for i := range rules {
+		if err := rules[i].parse(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %v", path, i+1, err)
+		}
+	}
+	return rules, nil
+}
+
+// yamlMappingRule converts a YAML mapping, with lower case keys, to a rule.
+func yamlMappingRule(item map[string]string) (MappingRule, error) {
+	r := MappingRule{}
+	for k, v := range item {
+		var err error
+		switch k {
+		case "var":
+			r.Var = v
+		case "node", "sensor":
+			var id uint8
+			if id, err = parseUint8(v); err == nil {
+				if k == "node" {
+					r.Node = &id
+				} else {
+					r.Sensor = &id
+				}
+			}
+		case "metric":
+			r.Metric = v
+		case "type":
+			r.Type = v
+		case "parser":
+			r.Parser = v
+		case "scale":
+			r.Scale, err = strconv.ParseFloat(v, 64)
+		default:
+			err = fmt.Errorf("unknown key %q", k)
+		}
+		if err != nil {
+			return r, fmt.Errorf("%s: %v", k, err)
+		}
+	}
+	return r, nil
+}
+
+// parse validates the rule.
+func (r *MappingRule) parse() error {
+	st, err := parseSubType(MsgSet, r.Var)
+	if err != nil {
+		return err
+	}
+	r.subType = st.(SubTypeSetReq)
+	if !metricNameRE.MatchString(r.Metric) {
+		return fmt.Errorf("invalid metric name %q for %s", r.Metric, r.Var)
+	}
+	if r.Sensor != nil && r.Node == nil {
+		return fmt.Errorf("sensor %d without a node", *r.Sensor)
+	}
+	switch r.Type {
+	case "", "gauge", "counter":
+	default:
+		return fmt.Errorf("invalid type %q, want gauge or counter", r.Type)
+	}
+	switch r.Parser {
+	case "", "number", "binary":
+	default:
+		return fmt.Errorf("invalid parser %q, want number or binary", r.Parser)
+	}
+	return nil
+}
+
+// matches returns how specifically the rule matches the variable of the
+// sensor: 3 for the sensor, 2 for its node, 1 for all sensors, or 0 if not.
+func (r *MappingRule) matches(node, sensor uint8, t SubTypeSetReq) int {
+	switch {
+	case r.subType != t:
+		return 0
+	case r.Node == nil:
+		return 1
+	case *r.Node != node:
+		return 0
+	case r.Sensor == nil:
+		return 2
+	case *r.Sensor != sensor:
+		return 0
+	}
+	return 3
+}
+
+// value returns the value of the variable per the rule, or false if it
+// does not parse.
+func (r *MappingRule) value(v *Var) (float64, bool) {
+	f, ok := v.FloatVal, v.Type == varFloat
+	switch {
+	case r.Parser == "binary":
+		f, ok = parseBinary(v.Value())
+	case !ok:
+		var err error
+		f, err = strconv.ParseFloat(strings.TrimSpace(v.Value()), 64)
+		ok = err == nil
+	}
+	if r.Scale != 0 {
+		f *= r.Scale
+	}
+	return f, ok
+}
+
+// rule returns the most specific rule for the variable of the sensor, or
+// nil if none.
+func (g *Gauges) rule(node, sensor uint8, t SubTypeSetReq) *MappingRule {
+	var best *MappingRule
+	score := 0
+	for i := range g.rules {
+		if m := g.rules[i].matches(node, sensor, t); m > score {
+			best, score = &g.rules[i], m
+		}
+	}
+	return best
+}
+
+// SetMappingRules replaces the mapping rules, eg from LoadMappingFile. The
+// sensors' metrics are exported again per the new rules.
+func (n *Network) SetMappingRules(rules []MappingRule) error {
+	for i := range rules {
+		if err := rules[i].parse(); err != nil {
+			return fmt.Errorf("rule %d: %v", i+1, err)
+		}
+	}
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	for _, nd := range n.Nodes {
+		for _, s := range nd.Sensors {
+			s.unexportAll()
+		}
+	}
+	// Metrics of the old rules are recreated as needed.
+	for _, name := range n.gauges.metrics.gaugeNames() {
+		n.deleteMetric(name)
+	}
+	n.gauges.Gauge = nil
+	n.gauges.rules = rules
+	for _, nd := range n.Nodes {
+		for _, s := range nd.Sensors {
+			for _, v := range s.Vars {
+				if s.numberRule(v.SubType) && v.Type == varString {
+					// Values of newly mapped variables are now numbers.
+					v.Type = varFloat
+					v.Set(v.StringVal)
+				}
+			}
+			s.reexport()
+		}
+	}
+	logf(modNetwork, LevelInfo, "Applied %d mapping rules.", len(rules))
+	return nil
+}
+
+// rule returns the mapping rule for the sensor's variable, or nil if none.
+func (s *Sensor) rule(t SubTypeSetReq) *MappingRule {
+	return s.node.network.gauges.rule(s.node.ID, s.ID, t)
+}
+
+// numberRule returns whether the sensor's variable has a mapping rule with
+// numeric values.
+func (s *Sensor) numberRule(t SubTypeSetReq) bool {
+	r := s.rule(t)
+	return r != nil && r.Parser != "binary"
+}
+
+// exportMapped exports the variable per its mapping rule, and returns
+// whether it has one.
+func (s *Sensor) exportMapped(v *Var) bool {
+	r := s.rule(v.SubType)
+	if r == nil {
+		return false
+	}
+	f, ok := r.value(v)
+	if !ok {
+		return true
+	}
+	g := s.node.network.gauges
+	help := fmt.Sprintf("MYSENSORS %s", v.SubType)
+	if r.Type == "counter" {
+		// Counted with the totals of CounterMap, see count.
+		return true
+	}
+	if *scrapeTimeMetrics {
+		// The value is collected from the Var at scrape time.
+		g.receiveTimeSeconds.WithLabelValues(s.labels()...).SetToCurrentTime()
+		s.track(Series{Metric: receiveTimeMetric, Labels: s.labels()})
+		return true
+	}
+	ga := s.node.network.vec(r.Metric)
+	if ga == nil {
+		if ga = g.newGauge(r.Metric, help); ga == nil {
+			return true
+		}
+	}
+	values := g.profile.values(v.SubType, s.labels())
+	ga.WithLabelValues(values...).Set(f)
+	g.receiveTimeSeconds.WithLabelValues(s.labels()...).SetToCurrentTime()
+	s.track(Series{Metric: r.Metric, Labels: values}, Series{Metric: receiveTimeMetric, Labels: s.labels()})
+	return true
+}
@@ -0,0 +1,137 @@
+// This file contains runtime configuration of the metric mappings.
+package mysensors
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// Mappings maps variable names, eg V_TEMP, to metric names, as GaugeMap and
+// CounterMap do.
+type Mappings struct {
+	Gauges   map[string]string
+	Counters map[string]string
+}
+
+// Mappings returns the current metric mappings.
+func (n *Network) Mappings() Mappings {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	m := Mappings{Gauges: map[string]string{}, Counters: map[string]string{}}
+	for t, name := range GaugeMap {
+		m.Gauges[t.String()] = name
+	}
+	for t, name := range CounterMap {
+		m.Counters[t.String()] = name
+	}
+	return m
+}
+
+// SetMappings replaces the metric mappings. Metrics of removed or renamed
+// mappings are deleted, and new metrics are created as values are received.
+// The mappings are saved with the network.
+func (n *Network) SetMappings(m Mappings) error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if err := n.applyMappings(m); err != nil {
+		return err
+	}
+	n.CustomMappings = &m
+	n.changed()
+	return nil
+}
+
+// applyMappings validates and applies m. n.mux must be held.
+func (n *Network) applyMappings(m Mappings) error {
+	gauges, err := parseMappings(m.Gauges)
+	if err != nil {
+		return err
+	}
+	counters, err := parseMappings(m.Counters)
+	if err != nil {
+		return err
+	}
+	kept := map[string]bool{}
+	for t := range n.gauges.Gauge {
+		if name, ok := gauges[t]; ok && name == GaugeMap[t] {
+			kept[name] = true
+			continue
+		}
+		delete(n.gauges.Gauge, t)
+	}
+	// Metrics named with units, and the remapped ones, are recreated as
+	// values are received.
+	for _, name := range n.gauges.metrics.gaugeNames() {
+		if !kept[name] {
+			n.deleteMetric(name)
+		}
+	}
+	for t := range GaugeMap {
+		delete(GaugeMap, t)
+	}
+	for t, name := range gauges {
+		GaugeMap[t] = name
+	}
+	for t := range CounterMap {
+		delete(CounterMap, t)
+	}
+	for t, name := range counters {
+		CounterMap[t] = name
+	}
+	// Values of newly mapped variables are now numbers.
+	for _, nd := range n.Nodes {
+		for _, s := range nd.Sensors {
+			for _, v := range s.Vars {
+				if _, ok := gauges[v.SubType]; ok && v.Type == varString {
+					v.Type = varFloat
+					v.Set(v.StringVal)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// deleteMetric unregisters a sensor metric, and removes its series from
+// the sensors' index.
+func (n *Network) deleteMetric(name string) {
+	logf(modNetwork, LevelInfo, "Deleting metric %s.", name)
+	n.gauges.metrics.unregister(name)
+	for _, nd := range n.Nodes {
+		for _, s := range nd.Sensors {
+			for k, se := range s.Series {
+				if se.Metric == name {
+					delete(s.Series, k)
+				}
+			}
+		}
+	}
+}
+
+// customGauge returns whether variable t was mapped with SetMappings.
+// n.mux must be held.
+func (n *Network) customGauge(t SubTypeSetReq) bool {
+	if n.CustomMappings == nil {
+		return false
+	}
+	_, ok := n.CustomMappings.Gauges[t.String()]
+	return ok
+}
+
+// parseMappings validates and parses mappings by variable name.
+func parseMappings(names map[string]string) (map[SubTypeSetReq]string, error) {
+	m := map[SubTypeSetReq]string{}
+	for v, name := range names {
+		t, err := parseSubType(MsgSet, v)
+		if err != nil {
+			return nil, err
+		}
+		if !metricNameRE.MatchString(name) {
+			return nil, fmt.Errorf("invalid metric name %q for %s", name, v)
+		}
+		m[t.(SubTypeSetReq)] = name
+	}
+	return m, nil
+}
@@ -4,11 +4,26 @@
 package mysensors
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 )
 
+var (
+	// ErrBadFormat is returned for malformed messages.
+	ErrBadFormat = errors.New("bad message format")
+	// ErrUnknownType is returned for messages of unknown type or sub type.
+	// The message is still parsed, with an UnknownSubType if needed, so it
+	// can be passed on unchanged.
+	ErrUnknownType = errors.New("unknown message type")
+)
+
+// unknownName names values missing from a type's name table.
+func unknownName(v uint8) string { return fmt.Sprintf("UNKNOWN(%d)", v) }
+
 type AckType uint8
 
 const (
@@ -21,7 +36,12 @@ var ackType = [...]string{
 	"ack",
 }
 
-func (t AckType) String() string { return ackType[t] }
+func (t AckType) String() string {
+	if int(t) < len(ackType) {
+		return ackType[t]
+	}
+	return unknownName(uint8(t))
+}
 
 // MsgType is a MySensors message type.
 type MsgType uint8
@@ -42,7 +62,12 @@ var msgType = [...]string{
 	"stream",
 }
 
-func (t MsgType) String() string { return msgType[t] }
+func (t MsgType) String() string {
+	if int(t) < len(msgType) {
+		return msgType[t]
+	}
+	return unknownName(uint8(t))
+}
 
 // SubType is an interface for message SubTypes.
 type SubType interface {
@@ -92,6 +117,10 @@ const (
 	S_SOUND
 	S_VIBRATION
 	S_MOISTURE
+	S_INFO
+	S_GAS
+	S_GPS
+	S_WATER_QUALITY
 	S_BINARY SubTypePresentation = 3
 )
 
@@ -132,11 +161,18 @@ var subTypePresentation = [...]string{
 	"S_SOUND",
 	"S_VIBRATION",
 	"S_MOISTURE",
+	"S_INFO",
+	"S_GAS",
+	"S_GPS",
+	"S_WATER_QUALITY",
 }
 
 // String formats an optionally-present SubTypePresentation for status messages.
 func (t SubTypePresentation) String() string {
-	return subTypePresentation[t]
+	if int(t) < len(subTypePresentation) {
+		return subTypePresentation[t]
+	}
+	return unknownName(uint8(t))
 }
 
 func (t SubTypePresentation) Value() uint8 { return uint8(t) }
@@ -201,6 +237,17 @@ const (
 	V_HVAC_SETPOINT_COOL
 	V_HVAC_SETPOINT_HEAT
 	V_HVAC_FLOW_MODE
+	// MySensors 2.x.
+	V_TEXT
+	V_CUSTOM
+	V_POSITION
+	V_IR_RECORD
+	V_PH
+	V_ORP
+	V_EC
+	V_VAR
+	V_VA
+	V_POWER_FACTOR
 )
 
 var subTypeSetReq = [...]string{
@@ -253,9 +300,27 @@ var subTypeSetReq = [...]string{
 	"V_HVAC_SETPOINT_COOL",
 	"V_HVAC_SETPOINT_HEAT",
 	"V_HVAC_FLOW_MODE",
+	"V_TEXT",
+	"V_CUSTOM",
+	"V_POSITION",
+	"V_IR_RECORD",
+	"V_PH",
+	"V_ORP",
+	"V_EC",
+	"V_VAR",
+	"V_VA",
+	"V_POWER_FACTOR",
 }
 
-func (t SubTypeSetReq) String() string { return subTypeSetReq[t] }
+func (t SubTypeSetReq) String() string {
+	if c, ok := t.custom(); ok {
+		return c.Name
+	}
+	if int(t) < len(subTypeSetReq) {
+		return subTypeSetReq[t]
+	}
+	return unknownName(uint8(t))
+}
 
 func (t SubTypeSetReq) Value() uint8 { return uint8(t) }
 
@@ -282,6 +347,23 @@ const (
 	I_REQUEST_SIGNING
 	I_GET_NONCE
 	I_GET_NONCE_RESPONSE
+	// MySensors 2.x.
+	I_HEARTBEAT_REQUEST
+	I_PRESENTATION
+	I_DISCOVER_REQUEST
+	I_DISCOVER_RESPONSE
+	I_HEARTBEAT_RESPONSE
+	I_LOCKED
+	I_PING
+	I_PONG
+	I_REGISTRATION_REQUEST
+	I_REGISTRATION_RESPONSE
+	I_DEBUG
+	I_SIGNAL_REPORT_REQUEST
+	I_SIGNAL_REPORT_REVERSE
+	I_SIGNAL_REPORT_RESPONSE
+	I_PRE_SLEEP_NOTIFICATION
+	I_POST_SLEEP_NOTIFICATION
 )
 
 var subTypeInternal = [...]string{
@@ -303,12 +385,73 @@ var subTypeInternal = [...]string{
 	"I_REQUEST_SIGNING",
 	"I_GET_NONCE",
 	"I_GET_NONCE_RESPONSE",
+	"I_HEARTBEAT_REQUEST",
+	"I_PRESENTATION",
+	"I_DISCOVER_REQUEST",
+	"I_DISCOVER_RESPONSE",
+	"I_HEARTBEAT_RESPONSE",
+	"I_LOCKED",
+	"I_PING",
+	"I_PONG",
+	"I_REGISTRATION_REQUEST",
+	"I_REGISTRATION_RESPONSE",
+	"I_DEBUG",
+	"I_SIGNAL_REPORT_REQUEST",
+	"I_SIGNAL_REPORT_REVERSE",
+	"I_SIGNAL_REPORT_RESPONSE",
+	"I_PRE_SLEEP_NOTIFICATION",
+	"I_POST_SLEEP_NOTIFICATION",
 }
 
-func (t SubTypeInternal) String() string { return subTypeInternal[t] }
+func (t SubTypeInternal) String() string {
+	if int(t) < len(subTypeInternal) {
+		return subTypeInternal[t]
+	}
+	return unknownName(uint8(t))
+}
 
 func (t SubTypeInternal) Value() uint8 { return uint8(t) }
 
+// SubTypeStream are SubTypes for stream messages, eg firmware updates.
+
+type SubTypeStream uint8
+
+const (
+	ST_FIRMWARE_CONFIG_REQUEST SubTypeStream = iota
+	ST_FIRMWARE_CONFIG_RESPONSE
+	ST_FIRMWARE_REQUEST
+	ST_FIRMWARE_RESPONSE
+	ST_SOUND
+	ST_IMAGE
+)
+
+var subTypeStream = [...]string{
+	"ST_FIRMWARE_CONFIG_REQUEST",
+	"ST_FIRMWARE_CONFIG_RESPONSE",
+	"ST_FIRMWARE_REQUEST",
+	"ST_FIRMWARE_RESPONSE",
+	"ST_SOUND",
+	"ST_IMAGE",
+}
+
+func (t SubTypeStream) String() string {
+	if int(t) < len(subTypeStream) {
+		return subTypeStream[t]
+	}
+	return unknownName(uint8(t))
+}
+
+func (t SubTypeStream) Value() uint8 { return uint8(t) }
+
+// UnknownSubType is a sub type of an unknown message type, or missing from
+// the known sub types. It keeps the numeric value, so the message can be
+// marshalled again unchanged.
+type UnknownSubType uint8
+
+func (t UnknownSubType) String() string { return unknownName(uint8(t)) }
+
+func (t UnknownSubType) Value() uint8 { return uint8(t) }
+
 // Message is a complete MySensors message.
 
 type Message struct {
@@ -324,6 +467,12 @@ type Message struct {
 	SubType SubType
 	// Payload it the payload of the message.
 	Payload []byte
+	// Gateway is the name of the gateway the message was received from.
+	// It is not part of the wire format.
+	Gateway string
+	// Synthetic marks test messages injected with Handler.Inject. It is not
+	// part of the wire format.
+	Synthetic bool
 }
 
 // String returns a string representation of the message.
@@ -332,65 +481,233 @@ func (m *Message) String() string {
 		m.NodeID, m.ChildSensorID, m.Type, m.Ack, m.SubType, string(m.Payload))
 }
 
+// Topic returns the MQTT topic for the message under the given prefix.
+func (m *Message) Topic(prefix string) string {
+	return fmt.Sprintf("%s/%d/%d/%d/%d/%d", prefix, m.NodeID, m.ChildSensorID, m.Type, m.Ack, m.SubType)
+}
+
 // Copy returns a copy of the message.
 func (m *Message) Copy() *Message {
-	b := m.Marshal()
-	n := &Message{}
-	if err := n.Unmarshal(b); err != nil {
-		panic(err)
-	}
-	return n
+	n := *m
+	n.Payload = append([]byte{}, m.Payload...)
+	return &n
 }
 
-// Marshal marshals the message into a byte slice.
+// Marshal marshals the message into a byte slice. It runs for every message
+// sent, so appends to a single allocation rather than formatting.
 func (m *Message) Marshal() []byte {
-	return []byte(fmt.Sprintf("%d;%d;%d;%d;%d;%s\n", m.NodeID, m.ChildSensorID, m.Type, m.Ack, m.SubType, m.Payload))
+	b := make([]byte, 0, len("255;255;255;1;255;\n")+len(m.Payload))
+	for _, v := range [...]uint8{m.NodeID, m.ChildSensorID, uint8(m.Type), uint8(m.Ack)} {
+		b = strconv.AppendUint(b, uint64(v), 10)
+		b = append(b, ';')
+	}
+	if m.SubType != nil {
+		b = strconv.AppendUint(b, uint64(m.SubType.Value()), 10)
+	}
+	b = append(b, ';')
+	b = append(b, m.Payload...)
+	return append(b, '\n')
 }
 
-// Unmarshal reads the given wire bytes into the Message.
-func (m *Message) Unmarshal(b []byte) error {
-	s := strings.TrimSuffix(string(b), "\x0a")
-	parts := strings.SplitN(s, ";", 6)
-	if len(parts) != 6 {
-		return fmt.Errorf("invalid format, only %d parts", len(parts))
+// MaxPayload is the largest payload in bytes a node can receive. Gateways
+// silently truncate longer payloads. Stream payloads are hex, so twice as
+// long on the wire.
+const MaxPayload = 25
+
+// CheckPayload returns an error wrapping ErrBadFormat if the payload can't be
+// sent intact. There is no escaping in the serial format: semicolons are
+// allowed, as the payload is the last field, but line breaks end the message.
+func (m *Message) CheckPayload() error {
+	if bytes.ContainsAny(m.Payload, "\r\n") {
+		return fmt.Errorf("%w: line break in payload", ErrBadFormat)
 	}
-	if nodeID, err := strconv.Atoi(parts[0]); err != nil {
-		return err
-	} else {
-		m.NodeID = uint8(nodeID)
+	max := MaxPayload
+	if m.Type == MsgStream {
+		max *= 2
+	}
+	if len(m.Payload) > max {
+		return fmt.Errorf("%w: payload of %d bytes, the maximum is %d", ErrBadFormat, len(m.Payload), max)
 	}
+	return nil
+}
 
-	if childSensorID, err := strconv.Atoi(parts[1]); err != nil {
-		return err
-	} else {
-		m.ChildSensorID = uint8(childSensorID)
+// wireFields names the numeric fields of the serial format, for errors.
+var wireFields = [...]string{"node id", "child sensor id", "type", "ack", "sub type"}
+
+// Unmarshal reads the given wire bytes into the Message. It returns an
+// error wrapping ErrBadFormat for malformed messages, or ErrUnknownType for
+// well formed messages of unknown type or sub type. The payload is the rest
+// of the line, so may contain semicolons. It runs for every message
+// received, so only allocates for the payload, and errors.
+func (m *Message) Unmarshal(b []byte) error {
+	for len(b) > 0 && (b[len(b)-1] == '\n' || b[len(b)-1] == '\r') {
+		b = b[:len(b)-1]
+	}
+	var fields [len(wireFields)]uint8
+	for i := range fields {
+		end := bytes.IndexByte(b, ';')
+		if end < 0 {
+			return fmt.Errorf("%w: only %d parts", ErrBadFormat, i+1)
+		}
+		v, ok := atou8(b[:end])
+		if !ok {
+			return fmt.Errorf("%w: invalid %s %q", ErrBadFormat, wireFields[i], b[:end])
+		}
+		fields[i] = v
+		b = b[end+1:]
+	}
+	if fields[3] > uint8(Ack) {
+		return fmt.Errorf("%w: invalid ack %d", ErrBadFormat, fields[3])
 	}
+	if bytes.ContainsAny(b, "\r\n") {
+		// A message is a line, so this would be sent as two.
+		return fmt.Errorf("%w: line break in payload", ErrBadFormat)
+	}
+	m.NodeID = fields[0]
+	m.ChildSensorID = fields[1]
+	m.Type = MsgType(fields[2])
+	m.Ack = AckType(fields[3])
+	m.Payload = make([]byte, len(b))
+	copy(m.Payload, b)
+
+	subType, known := fields[4], 0
+	switch m.Type {
+	case MsgPresentation:
+		m.SubType, known = SubTypePresentation(subType), len(subTypePresentation)
+	case MsgSet, MsgReq:
+		m.SubType, known = SubTypeSetReq(subType), len(subTypeSetReq)
+	case MsgInternal:
+		m.SubType, known = SubTypeInternal(subType), len(subTypeInternal)
+	case MsgStream:
+		m.SubType, known = SubTypeStream(subType), len(subTypeStream)
+	default:
+		m.SubType = UnknownSubType(subType)
+		return fmt.Errorf("%w %d", ErrUnknownType, m.Type)
+	}
+	if st, ok := m.SubType.(SubTypeSetReq); ok && st.known() {
+		return nil
+	}
+	if int(subType) >= known {
+		m.SubType = UnknownSubType(subType)
+		return fmt.Errorf("%w: %s sub type %d", ErrUnknownType, m.Type, subType)
+	}
+	return nil
+}
 
-	if mType, err := strconv.Atoi(parts[2]); err != nil {
-		return err
-	} else {
-		m.Type = MsgType(mType)
+// atou8 parses a decimal uint8, as strconv.ParseUint without converting b to
+// a string.
+func atou8(b []byte) (uint8, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	v := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		if v = v*10 + int(c-'0'); v > 255 {
+			return 0, false
+		}
 	}
+	return uint8(v), true
+}
 
-	if ack, err := strconv.Atoi(parts[3]); err != nil {
-		return err
-	} else {
-		m.Ack = AckType(ack)
+// messageJSON is the JSON form of a Message, with the type and sub type by
+// name, eg "set" and "V_TEMP".
+type messageJSON struct {
+	NodeID        uint8
+	ChildSensorID uint8
+	Type          string
+	Ack           bool `json:",omitempty"`
+	SubType       string
+	Payload       string
+	Gateway       string `json:",omitempty"`
+	Synthetic     bool   `json:",omitempty"`
+}
+
+// MarshalJSON encodes the message with its type and sub type by name.
+func (m *Message) MarshalJSON() ([]byte, error) {
+	j := messageJSON{
+		NodeID:        m.NodeID,
+		ChildSensorID: m.ChildSensorID,
+		Type:          m.Type.String(),
+		Ack:           m.Ack == Ack,
+		Payload:       string(m.Payload),
+		Gateway:       m.Gateway,
+		Synthetic:     m.Synthetic,
 	}
+	if m.SubType != nil {
+		j.SubType = m.SubType.String()
+	}
+	return json.Marshal(j)
+}
 
-	if subType, err := strconv.Atoi(parts[4]); err != nil {
+// UnmarshalJSON decodes a message encoded by MarshalJSON. The type and sub
+// type can also be given as numbers. Errors are as for Unmarshal.
+func (m *Message) UnmarshalJSON(b []byte) error {
+	var j messageJSON
+	if err := json.Unmarshal(b, &j); err != nil {
 		return err
-	} else {
-		switch m.Type {
-		case MsgPresentation:
-			m.SubType = SubTypePresentation(subType)
-		case MsgSet, MsgReq:
-			m.SubType = SubTypeSetReq(subType)
-		case MsgInternal:
-			m.SubType = SubTypeInternal(subType)
+	}
+	t, ok := parseNumber(j.Type)
+	for i, name := range msgType {
+		if name == j.Type {
+			t, ok = uint8(i), true
 		}
 	}
+	if !ok {
+		return fmt.Errorf("%w: message type %q", ErrUnknownType, j.Type)
+	}
+	st, ok := parseNumber(j.SubType)
+	if s, err := parseSubType(MsgType(t), j.SubType); err == nil {
+		st, ok = s.Value(), true
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s sub type %q", ErrUnknownType, MsgType(t), j.SubType)
+	}
+	if strings.ContainsAny(j.Payload, "\r\n") {
+		return fmt.Errorf("%w: line break in payload", ErrBadFormat)
+	}
+	ack := NoAck
+	if j.Ack {
+		ack = Ack
+	}
+	line := fmt.Sprintf("%d;%d;%d;%d;%d;%s", j.NodeID, j.ChildSensorID, t, ack, st, j.Payload)
+	err := m.Unmarshal([]byte(line))
+	m.Gateway, m.Synthetic = j.Gateway, j.Synthetic
+	return err
+}
 
-	m.Payload = []byte(parts[5])
-	return nil
+// parseNumber parses a number, or the name of an unknown value given by
+// unknownName.
+func parseNumber(s string) (uint8, bool) {
+	if strings.HasPrefix(s, "UNKNOWN(") && strings.HasSuffix(s, ")") {
+		s = s[len("UNKNOWN(") : len(s)-1]
+	}
+	v, err := strconv.ParseUint(s, 10, 8)
+	return uint8(v), err == nil
+}
+
+// MarshalText encodes the message in the serial format, without the
+// trailing newline.
+func (m *Message) MarshalText() ([]byte, error) {
+	return bytes.TrimSuffix(m.Marshal(), []byte("\n")), nil
+}
+
+// UnmarshalText decodes a message in the serial format, as Unmarshal.
+func (m *Message) UnmarshalText(b []byte) error {
+	return m.Unmarshal(b)
+}
+
+// UnmarshalTopic reads the given MQTT topic and payload into the Message.
+func (m *Message) UnmarshalTopic(topic string, payload []byte) error {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 6 {
+		return fmt.Errorf("%w: topic has only %d parts", ErrBadFormat, len(parts))
+	}
+	if bytes.ContainsAny(payload, "\r\n") {
+		return fmt.Errorf("%w: line break in payload", ErrBadFormat)
+	}
+	line := strings.Join(parts[len(parts)-5:], ";") + ";" + string(payload)
+	return m.Unmarshal([]byte(line))
 }
@@ -0,0 +1,66 @@
+package mysensors
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUnmarshal(t *testing.T) {
+	m := &Message{}
+	if err := m.Unmarshal([]byte("5;1;1;0;0;21.5;x\r\n")); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if m.NodeID != 5 || m.ChildSensorID != 1 || m.Type != MsgSet || m.Ack != NoAck || m.SubType != V_TEMP || string(m.Payload) != "21.5;x" {
+		t.Errorf("Unmarshal = %s", m)
+	}
+}
+
+func TestUnmarshalBounds(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		err  error
+	}{
+		{"", ErrBadFormat},
+		{"5;1;1;0", ErrBadFormat},
+		{"5;1;1;0;0", ErrBadFormat},
+		{"256;1;1;0;0;1", ErrBadFormat},
+		{"5;1000;1;0;0;1", ErrBadFormat},
+		{"-1;1;1;0;0;1", ErrBadFormat},
+		{";1;1;0;0;1", ErrBadFormat},
+		{"5;1;1;2;0;1", ErrBadFormat},
+		{"5;1;1;0;0;1\r2", ErrBadFormat},
+		{"5;1;9;0;0;1", ErrUnknownType},
+		{"5;1;3;0;255;1", ErrUnknownType},
+		{"255;255;1;1;0;", nil},
+	} {
+		m := &Message{}
+		if err := m.Unmarshal([]byte(tc.line)); !errors.Is(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("Unmarshal(%q) = %v, want %v", tc.line, err, tc.err)
+		}
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	for _, line := range []string{"0;255;3;0;14;Gateway startup complete.", "5;1;1;1;2;1", "12;0;0;0;6;"} {
+		m := &Message{}
+		if err := m.Unmarshal([]byte(line)); err != nil {
+			t.Fatalf("Unmarshal(%q): %v", line, err)
+		}
+		if got := string(m.Marshal()); got != line+"\n" {
+			t.Errorf("Marshal(Unmarshal(%q)) = %q", line, got)
+		}
+	}
+}
+
+// BenchmarkUnmarshal reports one allocation per message, the copy of the
+// payload, as callers may reuse the line buffer.
+func BenchmarkUnmarshal(b *testing.B) {
+	line := []byte("5;1;1;0;0;21.5\n")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m := Message{}
+		if err := m.Unmarshal(line); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// This file contains the lazily created sensor metric vectors.
+package mysensors
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricSet holds the sensor metric vectors of a network by name, creating
+// and registering each once. Getting a vector is idempotent, so any number of
+// variables, mappings and code paths can share a metric, and vectors can be
+// unregistered when the mappings change. It has its own lock, as vectors are
+// created while exporting, and scraped concurrently.
+type metricSet struct {
+	registry prometheus.Registerer
+
+	mux      sync.Mutex
+	gauges   map[string]*prometheus.GaugeVec
+	counters map[string]*prometheus.CounterVec
+	// fixed are the vectors of fixedGauges created.
+	fixed map[string]*prometheus.GaugeVec
+	// fixedCounts are the vectors of fixedCounters created.
+	fixedCounts map[string]*prometheus.CounterVec
+}
+
+// fixedVec describes a gauge vector of fixedGauges.
+type fixedVec struct {
+	help   string
+	labels []string
+}
+
+// fixedGauges are the per-sensor and per-node gauges with fixed names, by
+// name, eg mysensors_tripped. Each network creates its own in its metricSet,
+// so networks with their own registries don't share series. They are not
+// mapped, so are kept when the mappings change.
+var fixedGauges = map[string]fixedVec{}
+
+// fixedCounters are the per-sensor and per-node counters with fixed names,
+// created per network like fixedGauges.
+var fixedCounters = map[string]fixedVec{}
+
+// newMetricSet returns a metricSet registering its vectors with r.
+func newMetricSet(r prometheus.Registerer) *metricSet {
+	return &metricSet{
+		registry: r,
+		gauges:   map[string]*prometheus.GaugeVec{},
+		counters: map[string]*prometheus.CounterVec{},
+		fixed:    map[string]*prometheus.GaugeVec{},
+
+		fixedCounts: map[string]*prometheus.CounterVec{},
+	}
+}
+
+// fixedGauge returns the named gauge vector of fixedGauges, creating and
+// registering it if needed.
+func (m *metricSet) fixedGauge(name string) *prometheus.GaugeVec {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if vec, ok := m.fixed[name]; ok {
+		return vec
+	}
+	spec, ok := fixedGauges[name]
+	if !ok {
+		panic("unknown fixed gauge " + name)
+	}
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: spec.help}, spec.labels)
+	if existing, ok := register(m.registry, vec).(*prometheus.GaugeVec); ok {
+		// Networks sharing a registry share the vector.
+		vec = existing
+	}
+	m.fixed[name] = vec
+	return vec
+}
+
+// fixedCounter returns the named counter vector of fixedCounters, creating
+// and registering it if needed.
+func (m *metricSet) fixedCounter(name string) *prometheus.CounterVec {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if vec, ok := m.fixedCounts[name]; ok {
+		return vec
+	}
+	spec, ok := fixedCounters[name]
+	if !ok {
+		panic("unknown fixed counter " + name)
+	}
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: spec.help}, spec.labels)
+	if existing, ok := register(m.registry, vec).(*prometheus.CounterVec); ok {
+		// Networks sharing a registry share the vector.
+		vec = existing
+	}
+	m.fixedCounts[name] = vec
+	return vec
+}
+
+// gauge returns the node network's gauge vector of fixedGauges.
+func (nd *Node) gauge(name string) *prometheus.GaugeVec {
+	return nd.network.gauges.metrics.fixedGauge(name)
+}
+
+// counter returns the node network's counter vector of fixedCounters.
+func (nd *Node) counter(name string) *prometheus.CounterVec {
+	return nd.network.gauges.metrics.fixedCounter(name)
+}
+
+// gauge returns the named gauge vector, creating and registering it if
+// needed, or nil if the name is taken by another kind of metric.
+func (m *metricSet) gauge(name, help string, labels []string, constLabels prometheus.Labels) *prometheus.GaugeVec {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if vec, ok := m.gauges[name]; ok {
+		return vec
+	}
+	if _, ok := m.counters[name]; ok {
+		logf(modNetwork, LevelError, "Error registering gauge %s: already a counter", name)
+		return nil
+	}
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help, ConstLabels: constLabels}, labels)
+	if err := m.registry.Register(vec); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if vec, ok = are.ExistingCollector.(*prometheus.GaugeVec); !ok {
+			logf(modNetwork, LevelError, "Error registering metric %s: %v", name, err)
+			return nil
+		}
+	}
+	m.gauges[name] = vec
+	return vec
+}
+
+// counter returns the named counter vector, creating and registering it if
+// needed, or nil if the name is taken by another kind of metric.
+func (m *metricSet) counter(name, help string, labels []string, constLabels prometheus.Labels) *prometheus.CounterVec {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if vec, ok := m.counters[name]; ok {
+		return vec
+	}
+	if _, ok := m.gauges[name]; ok {
+		logf(modNetwork, LevelError, "Error registering counter %s: already a gauge", name)
+		return nil
+	}
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help, ConstLabels: constLabels}, labels)
+	if err := m.registry.Register(vec); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if vec, ok = are.ExistingCollector.(*prometheus.CounterVec); !ok {
+			logf(modNetwork, LevelError, "Error registering metric %s: %v", name, err)
+			return nil
+		}
+	}
+	m.counters[name] = vec
+	return vec
+}
+
+// lookupGauge returns the named gauge vector, or nil if not created.
+func (m *metricSet) lookupGauge(name string) *prometheus.GaugeVec {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if vec, ok := m.fixed[name]; ok {
+		return vec
+	}
+	return m.gauges[name]
+}
+
+// lookupCounter returns the named counter vector, or nil if not created.
+func (m *metricSet) lookupCounter(name string) *prometheus.CounterVec {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.counters[name]
+}
+
+// gaugeNames returns the names of the gauge vectors, other than
+// fixedGauges, sorted.
+func (m *metricSet) gaugeNames() []string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	names := make([]string, 0, len(m.gauges))
+	for name := range m.gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unregister unregisters and forgets the named vector, so it is created
+// anew, eg with a new help, when next needed.
+func (m *metricSet) unregister(name string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if vec, ok := m.gauges[name]; ok {
+		m.registry.Unregister(vec)
+		delete(m.gauges, name)
+	}
+	if vec, ok := m.counters[name]; ok {
+		m.registry.Unregister(vec)
+		delete(m.counters, name)
+	}
+}
+
+// unregisterAll unregisters and forgets all vectors, including fixedGauges
+// and fixedCounters.
+func (m *metricSet) unregisterAll() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for name, vec := range m.fixed {
+		m.registry.Unregister(vec)
+		delete(m.fixed, name)
+	}
+	for name, vec := range m.fixedCounts {
+		m.registry.Unregister(vec)
+		delete(m.fixedCounts, name)
+	}
+	for name, vec := range m.gauges {
+		m.registry.Unregister(vec)
+		delete(m.gauges, name)
+	}
+	for name, vec := range m.counters {
+		m.registry.Unregister(vec)
+		delete(m.counters, name)
+	}
+}
@@ -0,0 +1,45 @@
+// This file contains message middleware.
+package mysensors
+
+// Middleware inspects or rewrites a message, for filtering, rewriting
+// payloads or custom logging. It returns the message to pass on, nil to drop
+// it, or an error to drop and log it.
+type Middleware func(*Message) (*Message, error)
+
+// UseInbound appends middleware run in order on every message received from
+// the gateway, before it is handled.
+func (h *Handler) UseInbound(mw ...Middleware) {
+	h.mwMux.Lock()
+	defer h.mwMux.Unlock()
+	h.inbound = append(h.inbound, mw...)
+}
+
+// UseOutbound appends middleware run in order on every message before it is
+// written to the gateway.
+func (h *Handler) UseOutbound(mw ...Middleware) {
+	h.mwMux.Lock()
+	defer h.mwMux.Unlock()
+	h.outbound = append(h.outbound, mw...)
+}
+
+// middleware runs the inbound or outbound middleware on m, returning nil if
+// the message was dropped.
+func (h *Handler) middleware(outbound bool, m *Message) *Message {
+	h.mwMux.Lock()
+	chain := h.inbound
+	if outbound {
+		chain = h.outbound
+	}
+	h.mwMux.Unlock()
+	for _, mw := range chain {
+		var err error
+		if m, err = mw(m); err != nil {
+			logf(modHandler, LevelWarn, "Middleware dropped message: %v\n", err)
+			return nil
+		}
+		if m == nil {
+			return nil
+		}
+	}
+	return m
+}
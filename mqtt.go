@@ -1,29 +1,62 @@
 package mysensors
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"sync"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
 	broker       = flag.String("broker", "", "MQTT broker address, eg tcp://192.168.0.1:1883")
 	topicPrefix  = flag.String("topic_prefix", "mysensors", "Prefix for MQTT topic")
 	clientPrefix = flag.String("client_prefix", "mysensors-", "Prefix for MQTT client name")
+	mqttJSON     = flag.Bool("mqtt_json", false, "Publish whole messages as JSON, with type names, instead of the bare payload")
 )
 
+var mqttPublishErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "mysensors_mqtt_publish_errors_total",
+	Help: "Messages that failed to publish to the MQTT broker",
+})
+
+func init() {
+	mustRegister(mqttPublishErrors)
+}
+
 var clientID = 0
 
 type MQTTClient struct {
 	client  mqtt.Client
 	options *mqtt.ClientOptions
 	msgChan chan *Message
+
+	subMux sync.Mutex
+	subs   map[string]func(payload []byte)
 }
 
+// Start publishes the messages received on ch, forever.
 func (m *MQTTClient) Start(ch chan *Message) error {
+	return m.StartContext(context.Background(), ch)
+}
+
+// StartContext publishes the messages received on ch until ctx is done,
+// then disconnects from the broker.
+func (m *MQTTClient) StartContext(ctx context.Context, ch chan *Message) error {
 	if *broker == "" {
+		// Discard messages so senders don't block.
+		go func() {
+			for {
+				select {
+				case <-ch:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
 		return nil
 	}
 	m.options = mqtt.NewClientOptions().AddBroker(*broker)
@@ -34,7 +67,7 @@ func (m *MQTTClient) Start(ch chan *Message) error {
 	m.msgChan = ch
 
 	err := m.startClient()
-	go m.messageListener()
+	go m.messageListener(ctx)
 	return err
 }
 
@@ -43,20 +76,79 @@ func (m *MQTTClient) startClient() error {
 	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
+	m.subMux.Lock()
+	defer m.subMux.Unlock()
+	for topic, f := range m.subs {
+		if err := m.subscribe(topic, f); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (m *MQTTClient) messageListener() {
-	for msg := range m.msgChan {
-		topic := fmt.Sprintf("%s/%d/%d/%d/%d/%d", *topicPrefix, msg.NodeID, msg.ChildSensorID, msg.Type, msg.Ack, msg.SubType)
-		if token := m.client.Publish(topic, 0, true, msg.Payload); token.Wait() && token.Error() != nil {
-			log.Printf("MQTT publish error: %v\n", token.Error())
+// Subscribe calls f with the payload of each message on the topic under
+// --topic_prefix, resubscribing after reconnects. It does nothing without a
+// broker.
+func (m *MQTTClient) Subscribe(topic string, f func(payload []byte)) error {
+	m.subMux.Lock()
+	defer m.subMux.Unlock()
+	if m.subs == nil {
+		m.subs = make(map[string]func([]byte))
+	}
+	m.subs[topic] = f
+	if m.client == nil {
+		return nil
+	}
+	return m.subscribe(topic, f)
+}
+
+func (m *MQTTClient) subscribe(topic string, f func([]byte)) error {
+	token := m.client.Subscribe(*topicPrefix+"/"+topic, 0, func(_ mqtt.Client, msg mqtt.Message) {
+		f(msg.Payload())
+	})
+	token.Wait()
+	return token.Error()
+}
+
+func (m *MQTTClient) messageListener(ctx context.Context) {
+	for {
+		var msg *Message
+		select {
+		case msg = <-m.msgChan:
+		case <-ctx.Done():
+			m.client.Disconnect(250)
+			return
+		}
+		payload := msg.Payload
+		if *mqttJSON {
+			var err error
+			if payload, err = json.Marshal(msg); err != nil {
+				logf(modMQTT, LevelError, "Error encoding %s: %v\n", msg, err)
+				continue
+			}
+		}
+		if token := m.client.Publish(msg.Topic(*topicPrefix), 0, true, payload); token.Wait() && token.Error() != nil {
+			mqttPublishErrors.Inc()
+			logf(modMQTT, LevelError, "MQTT publish error: %v\n", token.Error())
 		}
 	}
 }
 
+// Publish publishes a retained payload to the topic under --topic_prefix.
+// It does nothing without a broker.
+func (m *MQTTClient) Publish(topic string, payload []byte) error {
+	if m.client == nil {
+		return nil
+	}
+	token := m.client.Publish(*topicPrefix+"/"+topic, 0, true, payload)
+	if token.Wait() && token.Error() != nil {
+		mqttPublishErrors.Inc()
+	}
+	return token.Error()
+}
+
 func (m *MQTTClient) connLostHandler(client mqtt.Client, reason error) {
-	log.Printf("MQTT connection lost: %v", reason)
+	logf(modMQTT, LevelError, "MQTT connection lost: %v", reason)
 	clientID++
 	m.options.SetClientID(fmt.Sprintf("%s%d", *clientPrefix, clientID))
 	// TODO: Handle persistent failure.
@@ -0,0 +1,99 @@
+// This file contains an input source for MySensors MQTT gateways.
+package mysensors
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	gatewayBroker   = flag.String("gateway_broker", "", "MQTT broker of a MySensors MQTT gateway to read from instead of the serial port, eg tcp://192.168.0.1:1883")
+	gatewayTopicOut = flag.String("gateway_topic_out", "mygateway1-out", "Topic prefix the MQTT gateway publishes to")
+	gatewayTopicIn  = flag.String("gateway_topic_in", "mygateway1-in", "Topic prefix the MQTT gateway subscribes to")
+)
+
+// MQTTGateway is a GatewayTransport for a MySensors MQTT gateway. It presents
+// the gateway traffic as serial protocol lines.
+type MQTTGateway struct {
+	mux    sync.Mutex
+	client mqtt.Client
+	pr     *io.PipeReader
+	pw     *io.PipeWriter
+}
+
+// Enabled returns whether an MQTT gateway broker is configured.
+func (g *MQTTGateway) Enabled() bool {
+	return *gatewayBroker != ""
+}
+
+// Open connects to the broker and subscribes to the gateway's topics.
+func (g *MQTTGateway) Open() error {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.pr, g.pw = io.Pipe()
+	options := mqtt.NewClientOptions().AddBroker(*gatewayBroker)
+	options.SetClientID(*clientPrefix + "gateway")
+	options.SetAutoReconnect(true)
+	// Subscribe on every connect so subscriptions survive reconnects.
+	options.SetOnConnectHandler(func(c mqtt.Client) {
+		if token := c.Subscribe(*gatewayTopicOut+"/#", 0, g.messageHandler); token.Wait() && token.Error() != nil {
+			logf(modTransport, LevelError, "MQTT gateway subscribe error: %v\n", token.Error())
+		}
+	})
+	options.SetConnectionLostHandler(func(c mqtt.Client, reason error) {
+		logf(modTransport, LevelError, "MQTT gateway connection lost: %v", reason)
+	})
+	g.client = mqtt.NewClient(options)
+	if token := g.client.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+// Close disconnects from the broker.
+func (g *MQTTGateway) Close() error {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.client.Disconnect(250)
+	return g.pw.Close()
+}
+
+func (g *MQTTGateway) current() (mqtt.Client, *io.PipeReader, *io.PipeWriter) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return g.client, g.pr, g.pw
+}
+
+func (g *MQTTGateway) messageHandler(c mqtt.Client, msg mqtt.Message) {
+	m := &Message{}
+	if err := m.UnmarshalTopic(msg.Topic(), msg.Payload()); err != nil && !errors.Is(err, ErrUnknownType) {
+		logf(modTransport, LevelWarn, "Error parsing MQTT gateway message [%s]: %v\n", msg.Topic(), err)
+		return
+	}
+	_, _, pw := g.current()
+	pw.Write(m.Marshal())
+}
+
+// Read reads serial protocol lines received from the gateway.
+func (g *MQTTGateway) Read(b []byte) (int, error) {
+	_, pr, _ := g.current()
+	return pr.Read(b)
+}
+
+// Write publishes a serial protocol line to the gateway.
+func (g *MQTTGateway) Write(b []byte) (int, error) {
+	m := &Message{}
+	// Messages of unknown types are passed on unchanged.
+	if err := m.Unmarshal(b); err != nil && !errors.Is(err, ErrUnknownType) {
+		return 0, err
+	}
+	client, _, _ := g.current()
+	if token := client.Publish(m.Topic(*gatewayTopicIn), 0, false, m.Payload); token.Wait() && token.Error() != nil {
+		return 0, token.Error()
+	}
+	return len(b), nil
+}
@@ -0,0 +1,50 @@
+// This file contains the human names of nodes and sensors.
+package mysensors
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// name returns the name label value of the sensor: its own name, else its
+// node's.
+func (s *Sensor) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.node.Name
+}
+
+// SetName names a node on the gateway, which may be empty if the ID is only
+// on one, or one of its sensors unless sensor is NoChild, eg kitchen_fridge,
+// or removes the name if empty. The metrics move to the new name label,
+// except counters and signal reports, whose series of the old name remain
+// until restarted.
+func (n *Network) SetName(gateway string, node, sensor uint8, name string) error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	nd, err := n.node(gateway, node)
+	if err != nil {
+		return err
+	}
+	if sensor != NoChild {
+		s, ok := nd.Sensors[strconv.Itoa(int(sensor))]
+		if !ok {
+			return fmt.Errorf("unknown sensor %d/%d", node, sensor)
+		}
+		s.Name = name
+		s.relabel()
+		n.changed()
+		return nil
+	}
+	nd.unexport()
+	nd.Name = name
+	nd.exportInfo()
+	nd.exportBattery()
+	nd.exportLastSeen()
+	for _, s := range nd.Sensors {
+		s.reexport()
+	}
+	n.changed()
+	return nil
+}
@@ -0,0 +1,114 @@
+// This file contains the network transport, for ethernet gateways.
+package mysensors
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// NetTransport is a GatewayTransport for a gateway reached over the network,
+// eg a MySensors ethernet gateway optionally over TLS, or a serial gateway
+// bridged to a unix socket by socat or ser2net.
+type NetTransport struct {
+	// Network is the network to dial, eg "tcp" or "unix".
+	Network string
+	// Address is the gateway address, eg 192.168.0.2:5003 or a socket path.
+	Address string
+	// TLSConfig enables TLS if not nil.
+	TLSConfig *tls.Config
+
+	mux  sync.Mutex
+	conn net.Conn
+}
+
+// NewNetTransport returns a transport for the gateway at address on network.
+// The connection uses TLS if config is not nil.
+func NewNetTransport(network, address string, config *tls.Config) *NetTransport {
+	return &NetTransport{Network: network, Address: address, TLSConfig: config}
+}
+
+// LoadTLSConfig returns a TLS client configuration. ca is a PEM file of CAs
+// to verify the gateway against (the system roots if empty), cert and key
+// are an optional PEM client certificate, and serverName overrides the name
+// verified in the gateway's certificate.
+func LoadTLSConfig(ca, cert, key, serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", ca)
+		}
+	}
+	if cert != "" || key != "" {
+		c, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{c}
+	}
+	return config, nil
+}
+
+func (t *NetTransport) Open() error {
+	d := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if t.TLSConfig != nil {
+		conn, err = tls.DialWithDialer(d, t.Network, t.Address, t.TLSConfig)
+	} else {
+		conn, err = d.Dial(t.Network, t.Address)
+	}
+	if err != nil {
+		return err
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.conn = conn
+	return nil
+}
+
+func (t *NetTransport) current() (net.Conn, error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.conn == nil {
+		return nil, errors.New("connection not open")
+	}
+	return t.conn, nil
+}
+
+func (t *NetTransport) Read(b []byte) (int, error) {
+	c, err := t.current()
+	if err != nil {
+		return 0, err
+	}
+	return c.Read(b)
+}
+
+func (t *NetTransport) Write(b []byte) (int, error) {
+	c, err := t.current()
+	if err != nil {
+		return 0, err
+	}
+	return c.Write(b)
+}
+
+func (t *NetTransport) Close() error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
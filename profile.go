@@ -0,0 +1,77 @@
+// This file contains metric naming profiles, for compatibility with other
+// exporters.
+package mysensors
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+var namingProfile = flag.String("naming_profile", "default", "Metric naming profile: default, or homeassistant to match the names and labels of Home Assistant's Prometheus integration")
+
+// metricProfile names sensor metrics and their labels.
+type metricProfile struct {
+	// names overrides the GaugeMap metric names.
+	names map[SubTypeSetReq]string
+	// labels are the label names, or nil for the default labels.
+	labels []string
+	// values returns the label values given the default label values
+	// (location, node, sensor, gateway, type, sketch, name, synthetic).
+	values func(t SubTypeSetReq, l []string) []string
+}
+
+var profiles = map[string]*metricProfile{
+	"default": {
+		values: func(t SubTypeSetReq, l []string) []string { return l },
+	},
+	// homeassistant matches the Home Assistant Prometheus integration, for
+	// the entities generated by HomeAssistantYAML.
+	"homeassistant": {
+		names: map[SubTypeSetReq]string{
+			V_TEMP:        "homeassistant_sensor_temperature_celsius",
+			V_HUM:         "homeassistant_sensor_humidity_percent",
+			V_PRESSURE:    "homeassistant_sensor_pressure_hpa",
+			V_LEVEL:       "homeassistant_sensor_illuminance_lx",
+			V_LIGHT_LEVEL: "homeassistant_sensor_unit_percent",
+			V_PERCENTAGE:  "homeassistant_sensor_unit_percent",
+			V_VOLTAGE:     "homeassistant_sensor_voltage_v",
+			V_DISTANCE:    "homeassistant_sensor_distance_m",
+			V_VOLUME:      "homeassistant_sensor_unit_l",
+		},
+		labels: []string{"domain", "entity", "friendly_name", "synthetic"},
+		values: func(t SubTypeSetReq, l []string) []string {
+			name := fmt.Sprintf("Node %s Sensor %s %s", l[1], l[2], t)
+			if l[0] != "" {
+				name = l[0] + " " + name
+			}
+			return []string{"sensor", "sensor." + slugify(name), name, l[7]}
+		},
+	},
+}
+
+// currentProfile returns the configured naming profile.
+func currentProfile() *metricProfile {
+	if p, ok := profiles[*namingProfile]; ok {
+		return p
+	}
+	logf(modNetwork, LevelWarn, "Unknown --naming_profile %q, using default", *namingProfile)
+	return profiles["default"]
+}
+
+// slugify converts a name to a Home Assistant style entity ID.
+func slugify(s string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			underscore = false
+		} else if !underscore && b.Len() > 0 {
+			b.WriteByte('_')
+			underscore = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "_")
+}
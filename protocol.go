@@ -0,0 +1,93 @@
+// This file contains per-node library version handling.
+package mysensors
+
+import (
+	"strconv"
+	"strings"
+)
+
+const nodeInfoMetric = "mysensors_node_info"
+
+func init() {
+	fixedGauges[nodeInfoMetric] = fixedVec{
+		help:   "Sketch and library version reported by the node, and the units it is configured to report in",
+		labels: []string{"node", "location", "gateway", "sketch_name", "sketch_version", "version", "units", "name"},
+	}
+	fixedGauges["mysensors_dust_level"] = fixedVec{
+		help:   "V_DUST_LEVEL from 1.4 nodes",
+		labels: sensorLabels,
+	}
+}
+
+// legacyNames are the 1.4 names of variables renumbered or renamed in 1.5.
+var legacyNames = map[SubTypeSetReq]string{
+	V_STATUS:          "V_LIGHT",
+	V_PERCENTAGE:      "V_DIMMER",
+	V_HVAC_FLOW_STATE: "V_HEATER",
+	V_HVAC_SPEED:      "V_HEATER_SW",
+	V_LEVEL:           "V_DUST_LEVEL",
+}
+
+// setVersion records the library version reported by the node, either by
+// I_VERSION or in its S_ARDUINO_NODE presentation.
+func (n *Node) setVersion(version string) {
+	n.Version = version
+	n.exportInfo()
+}
+
+// exportInfo exports mysensors_node_info, replacing the previous series.
+func (n *Node) exportInfo() {
+	if n.info != nil {
+		n.gauge(nodeInfoMetric).DeleteLabelValues(n.info...)
+	}
+	n.info = []string{strconv.Itoa(int(n.ID)), n.Location, n.Gateway, n.SketchName, n.SketchVersion, n.Version, unitSystems[n.config()], n.Name}
+	n.gauge(nodeInfoMetric).WithLabelValues(n.info...).Set(1)
+}
+
+// protocol returns the major and minor library version of the node, or
+// false if unknown.
+func (n *Node) protocol() (major, minor int, ok bool) {
+	parts := strings.SplitN(n.Version, ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	minor, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
+
+// legacy returns whether the node runs a 1.4 or older library, which names
+// some variables differently.
+func (n *Node) legacy() bool {
+	major, minor, ok := n.protocol()
+	return ok && (major < 1 || major == 1 && minor < 5)
+}
+
+// SubTypeName returns the name of the variable in the node's library
+// version, eg V_DIMMER rather than V_PERCENTAGE for 1.4 nodes.
+func (n *Node) SubTypeName(t SubTypeSetReq) string {
+	if name, ok := legacyNames[t]; ok && n.legacy() {
+		return name
+	}
+	return t.String()
+}
+
+// legacyValue exports a value from a 1.4 node whose variable changed meaning
+// in 1.5, returning whether it did.
+func (s *Sensor) legacyValue(t SubTypeSetReq, v float64) bool {
+	if !s.node.legacy() {
+		return false
+	}
+	if t != V_LEVEL {
+		return false
+	}
+	// V_LEVEL was V_DUST_LEVEL, not a light level.
+	s.export("mysensors_dust_level", s.labels(), v)
+	return true
+}
@@ -0,0 +1,158 @@
+// This file contains message queue buffering and overflow policies.
+package mysensors
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	queuePolicy = flag.String("queue_policy", "block", "What to do when a message queue is full: block, drop_newest or drop_oldest")
+	txQueueSize = flag.Int("tx_queue_size", 16, "Buffer size of each gateway's transmit queue, within which internal replies are sent first")
+)
+
+var queueDroppedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mysensors_queue_dropped_messages_total",
+	Help: "Messages dropped because a queue was full, per --queue_policy",
+}, []string{"queue"})
+
+// queueDepths collects the number of messages waiting in the queues passed to
+// Enqueue, summed over the queues of the same name, eg of each gateway.
+var queueDepths = &queueCollector{
+	desc:   prometheus.NewDesc("mysensors_queue_depth", "Messages waiting in a queue", []string{"queue"}, nil),
+	queues: map[string][]chan *Message{},
+	held:   map[chan *Message]int{},
+}
+
+func init() {
+	mustRegister(queueDroppedCount, queueDepths)
+}
+
+// queueCollector is a prometheus.Collector of queue depths.
+type queueCollector struct {
+	desc   *prometheus.Desc
+	mux    sync.Mutex
+	queues map[string][]chan *Message
+	// held are the messages taken off each queue but still waiting, eg in
+	// the tx queue.
+	held map[chan *Message]int
+}
+
+// watch adds c to the named queues, if new.
+func (q *queueCollector) watch(queue string, c chan *Message) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.add(queue, c)
+}
+
+// hold records that n messages taken off c, of the named queue, are still
+// waiting.
+func (q *queueCollector) hold(queue string, c chan *Message, n int) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.add(queue, c)
+	q.held[c] = n
+}
+
+// add adds c to the named queues, if new. q.mux must be held.
+func (q *queueCollector) add(queue string, c chan *Message) {
+	for _, qc := range q.queues[queue] {
+		if qc == c {
+			return
+		}
+	}
+	q.queues[queue] = append(q.queues[queue], c)
+}
+
+func (q *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- q.desc
+}
+
+func (q *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for queue, cs := range q.queues {
+		depth := 0
+		for _, c := range cs {
+			depth += len(c) + q.held[c]
+		}
+		ch <- prometheus.MustNewConstMetric(q.desc, prometheus.GaugeValue, float64(depth), queue)
+	}
+}
+
+// CheckQueuePolicy returns an error if --queue_policy is invalid, or drops
+// messages but one of the queues, given by name with their buffer sizes, or
+// the tx queue, is unbuffered, so would drop any message not received at
+// once.
+func CheckQueuePolicy(sizes map[string]int) error {
+	switch *queuePolicy {
+	case "block":
+		return nil
+	case "drop_newest", "drop_oldest":
+	default:
+		return fmt.Errorf("invalid --queue_policy %q, want block, drop_newest or drop_oldest", *queuePolicy)
+	}
+	if *txQueueSize <= 0 {
+		return fmt.Errorf("--queue_policy=%s needs --tx_queue_size > 0", *queuePolicy)
+	}
+	for queue, size := range sizes {
+		if size <= 0 {
+			return fmt.Errorf("--queue_policy=%s needs --%s_queue_size > 0", *queuePolicy, queue)
+		}
+	}
+	return nil
+}
+
+// Enqueue sends m on c, the named queue. If c is full, m or the oldest
+// queued message is dropped per --queue_policy, or it blocks until there is
+// room. Unbuffered queues always block. It returns false if done is closed
+// first.
+func Enqueue(queue string, c chan *Message, m *Message, done <-chan struct{}) bool {
+	queueDepths.watch(queue, c)
+	if cap(c) == 0 {
+		select {
+		case c <- m:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	select {
+	case c <- m:
+		return true
+	case <-done:
+		return false
+	default:
+	}
+	switch *queuePolicy {
+	case "drop_newest":
+		queueDroppedCount.WithLabelValues(queue).Inc()
+		logf(modHandler, LevelWarn, "Queue %s full, dropping: %s\n", queue, m)
+		return true
+	case "drop_oldest":
+		for {
+			select {
+			case c <- m:
+				return true
+			case <-done:
+				return false
+			default:
+			}
+			select {
+			case old := <-c:
+				queueDroppedCount.WithLabelValues(queue).Inc()
+				logf(modHandler, LevelWarn, "Queue %s full, dropping: %s\n", queue, old)
+			default:
+			}
+		}
+	}
+	select {
+	case c <- m:
+		return true
+	case <-done:
+		return false
+	}
+}
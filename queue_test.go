@@ -0,0 +1,49 @@
+package mysensors
+
+import "testing"
+
+func TestCheckQueuePolicy(t *testing.T) {
+	policy, size := *queuePolicy, *txQueueSize
+	defer func() { *queuePolicy, *txQueueSize = policy, size }()
+	for _, tc := range []struct {
+		policy string
+		tx, rx int
+		ok     bool
+	}{
+		{"block", 0, 0, true},
+		{"drop_oldest", 10, 10, true},
+		{"drop_newest", 10, 10, true},
+		{"drop_oldest", 10, 0, false},
+		{"drop_newest", 0, 10, false},
+		{"drop_all", 10, 10, false},
+	} {
+		*queuePolicy, *txQueueSize = tc.policy, tc.tx
+		if err := CheckQueuePolicy(map[string]int{"rx": tc.rx}); (err == nil) != tc.ok {
+			t.Errorf("CheckQueuePolicy(%s, tx %d, rx %d) = %v", tc.policy, tc.tx, tc.rx, err)
+		}
+	}
+}
+
+func TestEnqueueUnbuffered(t *testing.T) {
+	policy := *queuePolicy
+	defer func() { *queuePolicy = policy }()
+	for _, p := range []string{"drop_oldest", "drop_newest"} {
+		*queuePolicy = p
+		c := make(chan *Message)
+		got := make(chan *Message)
+		go func() { got <- <-c }()
+		// Blocks until the receiver is ready, rather than dropping or
+		// spinning.
+		if !Enqueue("test", c, &Message{NodeID: 1}, nil) {
+			t.Errorf("%s: Enqueue = false", p)
+		}
+		if m := <-got; m.NodeID != 1 {
+			t.Errorf("%s: received node %d", p, m.NodeID)
+		}
+		done := make(chan struct{})
+		close(done)
+		if Enqueue("test", c, &Message{NodeID: 2}, done) {
+			t.Errorf("%s: Enqueue with done closed = true", p)
+		}
+	}
+}
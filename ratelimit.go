@@ -0,0 +1,63 @@
+// This file contains rate limiting of messages sent to the gateway.
+package mysensors
+
+import (
+	"flag"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	txRate  = flag.Float64("tx_rate", 0, "Maximum messages per second sent to each gateway, 0 for no limit. Use --tx_queue_size to queue bursts")
+	txBurst = flag.Int("tx_burst", 1, "Messages which may be sent at once, above --tx_rate, after the gateway was idle")
+)
+
+var (
+	txDelayedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_tx_delayed_messages_total",
+		Help: "Messages delayed by --tx_rate",
+	}, []string{"gateway"})
+	txDelaySeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysensors_tx_delay_seconds_total",
+		Help: "Time messages were delayed by --tx_rate",
+	}, []string{"gateway"})
+)
+
+func init() {
+	mustRegister(txDelayedCount, txDelaySeconds)
+}
+
+// throttle waits for a token of the --tx_rate and --tx_burst token bucket.
+// It returns false if the Handler is stopped first. Only the writer calls
+// it.
+func (h *Handler) throttle() bool {
+	if *txRate <= 0 {
+		return true
+	}
+	burst := float64(*txBurst)
+	if burst < 1 {
+		burst = 1
+	}
+	now := time.Now()
+	if h.txLast.IsZero() {
+		h.txTokens = burst
+	} else if h.txTokens += now.Sub(h.txLast).Seconds() * *txRate; h.txTokens > burst {
+		h.txTokens = burst
+	}
+	h.txLast = now
+	if h.txTokens < 1 {
+		wait := time.Duration((1 - h.txTokens) / *txRate * float64(time.Second))
+		txDelayedCount.WithLabelValues(h.Gateway).Inc()
+		txDelaySeconds.WithLabelValues(h.Gateway).Add(wait.Seconds())
+		select {
+		case <-time.After(wait):
+		case <-h.done:
+			return false
+		}
+		h.txTokens = 1
+		h.txLast = now.Add(wait)
+	}
+	h.txTokens--
+	return true
+}
@@ -0,0 +1,62 @@
+package mysensors
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	rate, burst := *txRate, *txBurst
+	defer func() { *txRate, *txBurst = rate, burst }()
+	*txRate, *txBurst = 20, 3
+	h := NewHandler(nil, nil, nil)
+	done := make(chan struct{})
+	h.done = done
+
+	// The burst is sent at once.
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if !h.throttle() {
+			t.Fatal("throttle stopped")
+		}
+	}
+	if d := time.Since(start); d > 40*time.Millisecond {
+		t.Errorf("burst took %v", d)
+	}
+	// Then one message per 1/--tx_rate.
+	start = time.Now()
+	for i := 0; i < 2; i++ {
+		if !h.throttle() {
+			t.Fatal("throttle stopped")
+		}
+	}
+	if d := time.Since(start); d < 80*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("2 messages at 20/s took %v, want 100ms", d)
+	}
+	// Tokens are refilled while idle, up to the burst.
+	time.Sleep(300 * time.Millisecond)
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		h.throttle()
+	}
+	if d := time.Since(start); d > 40*time.Millisecond {
+		t.Errorf("burst after idling took %v", d)
+	}
+	// A waiting writer is released when the Handler stops.
+	close(done)
+	if h.throttle() {
+		t.Error("throttle did not stop")
+	}
+}
+
+func TestThrottleUnlimited(t *testing.T) {
+	rate := *txRate
+	defer func() { *txRate = rate }()
+	*txRate = 0
+	h := NewHandler(nil, nil, nil)
+	for i := 0; i < 1000; i++ {
+		if !h.throttle() {
+			t.Fatal("throttle stopped")
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// This file contains gateway reconnection routines.
+package mysensors
+
+import (
+	"flag"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	reconnectMinBackoff = flag.Duration("reconnect_min_backoff", time.Second, "Initial delay between gateway reconnect attempts")
+	reconnectMaxBackoff = flag.Duration("reconnect_max_backoff", time.Minute, "Maximum delay between gateway reconnect attempts")
+)
+
+var reconnectCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mysensors_gateway_reconnects_total",
+	Help: "Reconnections to the gateway after I/O errors",
+}, []string{"gateway"})
+
+func init() {
+	mustRegister(reconnectCount)
+}
+
+// conn returns the gateway transport and its connection generation.
+func (h *Handler) conn() (GatewayTransport, int) {
+	h.connMux.Lock()
+	defer h.connMux.Unlock()
+	return h.t, h.gen
+}
+
+// nextGen starts a new connection generation. h.connMux must be held.
+func (h *Handler) nextGen() {
+	h.gen++
+	if h.regen != nil {
+		close(h.regen)
+	}
+	h.regen = make(chan struct{})
+}
+
+// reconnect reopens the gateway after an I/O error on connection generation
+// gen. It returns false if the Handler cannot reconnect, or is stopped. The
+// transport is reopened without h.connMux held, and reconnecting stops if
+// SetTransport replaces it.
+func (h *Handler) reconnect(gen int) bool {
+	h.reconnectMux.Lock()
+	defer h.reconnectMux.Unlock()
+	h.connMux.Lock()
+	if gen != h.gen {
+		// Already reconnected by the reader or writer, or replaced.
+		h.connMux.Unlock()
+		return true
+	}
+	if h.regen == nil {
+		h.regen = make(chan struct{})
+	}
+	t, regen := h.t, h.regen
+	h.connMux.Unlock()
+	t.Close()
+	backoff := *reconnectMinBackoff
+	for {
+		err := t.Open()
+		if err == nil || err == ErrNoReopen {
+			h.connMux.Lock()
+			replaced := gen != h.gen
+			if err == nil && !replaced {
+				h.nextGen()
+			}
+			h.connMux.Unlock()
+			switch {
+			case replaced:
+				// SetTransport replaced the transport while it was
+				// reopened, so it is not used.
+				if err == nil {
+					t.Close()
+				}
+				return true
+			case err != nil:
+				return false
+			}
+			reconnectCount.WithLabelValues(h.Gateway).Inc()
+			logf(modHandler, LevelInfo, "Reconnected to gateway.")
+			return true
+		}
+		logf(modHandler, LevelError, "Error reopening gateway, retrying in %v: %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-regen:
+			logf(modHandler, LevelInfo, "Gateway transport replaced, stopped reconnecting.")
+			return true
+		case <-h.done:
+			return false
+		}
+		if backoff *= 2; backoff > *reconnectMaxBackoff {
+			backoff = *reconnectMaxBackoff
+		}
+	}
+}
+
+// SetTransport opens t and replaces the gateway transport with it, eg to
+// move a gateway from serial to TCP. The Network state and metrics are kept.
+func (h *Handler) SetTransport(t GatewayTransport) error {
+	if err := t.Open(); err != nil {
+		return err
+	}
+	h.connMux.Lock()
+	defer h.connMux.Unlock()
+	old := h.t
+	h.t = t
+	// The reader and writer see the old transport fail, and pick up the
+	// new one as already reconnected. A pending reconnect of the old one
+	// is cancelled.
+	h.nextGen()
+	old.Close()
+	logf(modHandler, LevelInfo, "Gateway %s switched transport.", h.Gateway)
+	return nil
+}
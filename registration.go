@@ -0,0 +1,110 @@
+// This file contains the registration of 2.x nodes.
+package mysensors
+
+import (
+	"flag"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var registrationPolicy = flag.String("registration_policy", "auto", "How node registration requests are answered: auto (accept all), known (accept nodes in the inventory or previously accepted) or manual (approve via the API)")
+
+// Node registration states.
+const (
+	RegistrationPending  = "pending"
+	RegistrationAccepted = "accepted"
+	RegistrationDenied   = "denied"
+)
+
+var registrationCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mysensors_registration_requests_total",
+	Help: "I_REGISTRATION_REQUEST messages received, by state answered",
+}, []string{"state"})
+
+func init() {
+	mustRegister(registrationCount)
+}
+
+// Registration is the registration state of a node.
+type Registration struct {
+	Node     uint8
+	Location string `json:",omitempty"`
+	Gateway  string `json:",omitempty"`
+	State    string
+}
+
+// register decides the registration of the requesting node per
+// --registration_policy, and reports whether to accept it. Decisions are
+// kept, so later requests are answered the same until changed via Register.
+func (n *Network) register(m *Message) bool {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	nd := n.received(m)
+	if nd.Registration != RegistrationAccepted && nd.Registration != RegistrationDenied {
+		state := RegistrationPending
+		switch *registrationPolicy {
+		case "auto":
+			state = RegistrationAccepted
+		case "known":
+			state = RegistrationDenied
+			if n.inventory != nil && n.inventory.accepts(m.Gateway, m.NodeID, NoChild) {
+				state = RegistrationAccepted
+			}
+		case "manual":
+		default:
+			logf(modNetwork, LevelError, "Unknown --registration_policy %q, holding node %d for approval.", *registrationPolicy, m.NodeID)
+		}
+		if state != nd.Registration {
+			logf(modNetwork, LevelInfo, "Node %d registration %s.", m.NodeID, state)
+			nd.Registration = state
+			n.changed()
+		}
+	}
+	registrationCount.WithLabelValues(nd.Registration).Inc()
+	return nd.Registration == RegistrationAccepted
+}
+
+// Register accepts or denies the registration of a node on the gateway, which
+// may be empty if the ID is only on one. The node is answered straight away,
+// so it need not request registration again.
+func (n *Network) Register(gateway string, node uint8, accept bool) error {
+	n.mux.Lock()
+	nd, err := n.node(gateway, node)
+	if err != nil {
+		n.mux.Unlock()
+		return err
+	}
+	state, payload := RegistrationDenied, "0"
+	if accept {
+		state, payload = RegistrationAccepted, "1"
+	}
+	nd.Registration = state
+	n.changed()
+	n.mux.Unlock()
+	logf(modNetwork, LevelInfo, "Node %d registration %s via API.", node, state)
+	return n.Send(&Message{
+		NodeID:        node,
+		ChildSensorID: NoChild,
+		Type:          MsgInternal,
+		SubType:       I_REGISTRATION_RESPONSE,
+		Payload:       []byte(payload),
+		Gateway:       nd.Gateway,
+	})
+}
+
+// Registrations returns the registration state of nodes that have requested
+// registration, by node ID.
+func (n *Network) Registrations() []Registration {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	regs := []Registration{}
+	for _, nd := range n.Nodes {
+		if nd.Registration == "" {
+			continue
+		}
+		regs = append(regs, Registration{Node: nd.ID, Location: nd.Location, Gateway: nd.Gateway, State: nd.Registration})
+	}
+	sort.Slice(regs, func(i, j int) bool { return regs[i].Node < regs[j].Node })
+	return regs
+}
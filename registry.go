@@ -0,0 +1,189 @@
+// This file contains the Prometheus registry the metrics are registered
+// with, which can be swapped at runtime.
+package mysensors
+
+import (
+	"flag"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	constLabels = flag.String("const_labels", "", "Comma separated name=value labels added to the sensor value metrics, eg site=home. Prometheus adds the instance label itself")
+	sketchLabel = flag.Bool("sketch_label", false, "Label the per-sensor metrics with the sketch name of their node")
+)
+
+var (
+	// regMux protects registry and collectors.
+	regMux   sync.Mutex
+	registry prometheus.Registerer = prometheus.DefaultRegisterer
+	// collectors are the package level metrics, moved on SetRegistry.
+	collectors []prometheus.Collector
+)
+
+// mustRegister registers package level metrics with the current registry.
+func mustRegister(cs ...prometheus.Collector) {
+	regMux.Lock()
+	defer regMux.Unlock()
+	collectors = append(collectors, cs...)
+	registry.MustRegister(cs...)
+}
+
+// flagConstLabels parses --const_labels, ignoring malformed entries.
+func flagConstLabels() prometheus.Labels {
+	return parseLabelsFlag("const_labels", *constLabels)
+}
+
+// parseLabelsFlag parses the comma separated name=value labels of the named
+// flag, ignoring malformed entries.
+func parseLabelsFlag(name, value string) prometheus.Labels {
+	if value == "" {
+		return nil
+	}
+	l := prometheus.Labels{}
+	for _, kv := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			logf(modNetwork, LevelError, "Ignoring malformed --%s entry %q, want name=value", name, kv)
+			continue
+		}
+		l[parts[0]] = parts[1]
+	}
+	return l
+}
+
+// currentRegistry returns the registry metrics are registered with.
+func currentRegistry() prometheus.Registerer {
+	regMux.Lock()
+	defer regMux.Unlock()
+	return registry
+}
+
+// SetRegistry moves the package level metrics to r, eg a fresh registry in
+// tests or when embedding. Call Network.Reregister to move each network's
+// sensor metrics too.
+func SetRegistry(r prometheus.Registerer) error {
+	regMux.Lock()
+	defer regMux.Unlock()
+	for _, c := range collectors {
+		registry.Unregister(c)
+	}
+	registry = r
+	for _, c := range collectors {
+		if err := registerOrReuse(r, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerOrReuse registers c with r, allowing it to be registered already.
+func registerOrReuse(r prometheus.Registerer, c prometheus.Collector) error {
+	if err := r.Register(c); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// register registers a network metric with r, returning the metric already
+// registered under the same name if any, so networks can be created more
+// than once.
+func register(r prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	if err := r.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		logf(modNetwork, LevelError, "Error registering metric: %v", err)
+	}
+	return c
+}
+
+// metricsRegistry returns the registry for the network's metrics: the one
+// given by WithRegisterer, or the current one.
+func (n *Network) metricsRegistry() prometheus.Registerer {
+	if n.registerer != nil {
+		return n.registerer
+	}
+	return currentRegistry()
+}
+
+// Reregister moves the network's metrics to the current registry, after
+// SetRegistry, unless the network has its own. The metric vectors are
+// rebuilt from the network state, so the new registry holds exactly the
+// current node and sensor values. Uptime and signal reports aren't kept in
+// the state, and return with the nodes' next reports; heartbeat and counter
+// reset counts start again from 0.
+func (n *Network) Reregister() {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	old := n.registry
+	old.Unregister(n.rxNodePacketCount)
+	old.Unregister(n.gauges.receiveTimeSeconds)
+	for _, nd := range n.Nodes {
+		for _, s := range nd.Sensors {
+			s.unexportAll()
+		}
+	}
+	n.gauges.metrics.unregisterAll()
+	n.gauges.Gauge = nil
+	n.registerMetrics()
+	for _, nd := range n.Nodes {
+		nd.reexport()
+		for _, s := range nd.Sensors {
+			s.reexport()
+		}
+	}
+	logf(modNetwork, LevelInfo, "Moved metrics to a new registry.")
+}
+
+// reexport exports the node's current values again.
+func (nd *Node) reexport() {
+	nd.exportLastSeen()
+	nd.exportBattery()
+	if nd.Version != "" || nd.SketchName != "" {
+		nd.exportInfo()
+	}
+	if len(nd.Queued) > 0 {
+		nd.gauge(sleepQueueMetric).WithLabelValues(nd.sleepQueueLabels()...).Set(float64(len(nd.Queued)))
+	}
+}
+
+// reexport exports the sensor's current values again.
+func (s *Sensor) reexport() {
+	if s.Ignored {
+		return
+	}
+	s.exportLastSeen()
+	for _, v := range s.Vars {
+		r := s.rule(v.SubType)
+		if r == nil {
+			s.exportValue(v)
+			s.exportBinary(v)
+		} else if r.Type != "counter" {
+			// Counters are exported from their totals, below.
+			s.exportMapped(v)
+		}
+		s.exportCounter(v)
+		if v.Type != varFloat {
+			continue
+		}
+		switch {
+		case r != nil:
+			// Exported per its mapping rule.
+		case s.legacyValue(v.SubType, v.FloatVal):
+			// Exported under its 1.4 meaning.
+		case s.airQuality(v.SubType):
+			s.updateAirQuality(v.FloatVal)
+		default:
+			s.track(s.node.network.gauges.SetUnit(v.SubType, s.metricUnit(v.SubType), s.labels(), s.converted(v.SubType, v.FloatVal))...)
+		}
+		s.exportWatermarks(v)
+	}
+	if avg, ok := s.windAverage(); ok {
+		s.export("mysensors_wind_direction_average_degrees", s.labels(), avg)
+	}
+}
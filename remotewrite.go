@@ -0,0 +1,258 @@
+// This file contains the Prometheus remote_write client, pushing the metrics
+// where they cannot be scraped.
+package mysensors
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	remoteWriteURL      = flag.String("remote_write_url", "", "Prometheus remote_write endpoint to push the metrics to, eg http://mimir:9009/api/v1/push, empty to disable. Credentials are taken from REMOTE_WRITE_USERNAME and REMOTE_WRITE_PASSWORD, or REMOTE_WRITE_BEARER_TOKEN")
+	remoteWriteInterval = flag.Duration("remote_write_interval", 30*time.Second, "Interval between pushes to --remote_write_url")
+	remoteWriteTimeout  = flag.Duration("remote_write_timeout", 10*time.Second, "Timeout of each push to --remote_write_url")
+	remoteWriteRetries  = flag.Int("remote_write_retries", 3, "Retries of failed pushes, until the next interval")
+	remoteWriteBackoff  = flag.Duration("remote_write_retry_interval", time.Second, "Initial delay between push retries, doubled on each retry")
+	remoteWriteLabels   = flag.String("remote_write_labels", "job=mysensors", "Comma separated name=value labels added to the pushed series, in place of those added when scraping")
+	remoteWriteTenant   = flag.String("remote_write_tenant", "", "Tenant to push as, sent as the X-Scope-OrgID header of Mimir, Cortex and Loki")
+)
+
+var (
+	remoteWriteSamples = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mysensors_remote_write_samples_total",
+		Help: "Samples pushed to --remote_write_url",
+	})
+	remoteWriteFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mysensors_remote_write_failures_total",
+		Help: "Pushes to --remote_write_url given up on after all retries",
+	})
+)
+
+func init() {
+	mustRegister(remoteWriteSamples, remoteWriteFailures)
+}
+
+// CheckRemoteWrite returns an error if --remote_write_interval is not
+// positive while pushing to --remote_write_url.
+func CheckRemoteWrite() error {
+	if *remoteWriteURL != "" && *remoteWriteInterval <= 0 {
+		return fmt.Errorf("invalid --remote_write_interval %v, want > 0", *remoteWriteInterval)
+	}
+	return nil
+}
+
+// errPermanent marks push errors not worth retrying.
+type errPermanent struct{ error }
+
+// RemoteWrite pushes the metrics of the current registry to
+// --remote_write_url every --remote_write_interval, until ctx is done.
+func RemoteWrite(ctx context.Context) {
+	if *remoteWriteURL == "" {
+		return
+	}
+	extra := parseLabelsFlag("remote_write_labels", *remoteWriteLabels)
+	client := &http.Client{Timeout: *remoteWriteTimeout}
+	t := time.NewTicker(*remoteWriteInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		g, ok := currentRegistry().(prometheus.Gatherer)
+		if !ok {
+			g = prometheus.DefaultGatherer
+		}
+		mfs, err := g.Gather()
+		if err != nil {
+			// Gather returns what it could, eg without a failed collector.
+			logf(modNetwork, LevelWarn, "Error gathering metrics to push: %v", err)
+		}
+		req, samples := writeRequest(mfs, extra, time.Now())
+		body := snappy.Encode(nil, req)
+		backoff := *remoteWriteBackoff
+		for try := 0; ; try++ {
+			err := pushRemoteWrite(ctx, client, body)
+			if err == nil {
+				remoteWriteSamples.Add(float64(samples))
+				break
+			}
+			if _, permanent := err.(errPermanent); permanent || try >= *remoteWriteRetries {
+				remoteWriteFailures.Inc()
+				logf(modNetwork, LevelError, "Giving up on pushing %d samples after %d tries: %v", samples, try+1, err)
+				break
+			}
+			logf(modNetwork, LevelWarn, "Error pushing metrics, retrying in %v: %v", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff *= 2
+		}
+	}
+}
+
+// pushRemoteWrite posts the snappy compressed write request body. Client
+// errors, other than 429 Too Many Requests, are permanent.
+func pushRemoteWrite(ctx context.Context, client *http.Client, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, *remoteWriteURL, bytes.NewReader(body))
+	if err != nil {
+		return errPermanent{err}
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "mysensors-prom")
+	if *remoteWriteTenant != "" {
+		req.Header.Set("X-Scope-OrgID", *remoteWriteTenant)
+	}
+	if token := os.Getenv("REMOTE_WRITE_BEARER_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if user := os.Getenv("REMOTE_WRITE_USERNAME"); user != "" {
+		req.SetBasicAuth(user, os.Getenv("REMOTE_WRITE_PASSWORD"))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return errPermanent{err}
+	}
+	return err
+}
+
+// writeRequest encodes the metric families as a remote_write WriteRequest
+// protobuf, with the extra labels, and returns it and its number of samples.
+// All samples are timestamped now, ignoring any --metric_timestamps receive
+// time: the receiver rejects samples older than the series' last, which a
+// silent sensor's would be on every push after the first.
+func writeRequest(mfs []*dto.MetricFamily, extra prometheus.Labels, now time.Time) ([]byte, int) {
+	var b []byte
+	samples := 0
+	ts := now.UnixNano() / int64(time.Millisecond)
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for k, v := range extra {
+				labels[k] = v
+			}
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			add := func(suffix string, v float64, extraName, extraValue string) {
+				b = appendProtoBytes(b, 1, timeSeries(name+suffix, labels, extraName, extraValue, v, ts))
+				samples++
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue(), "", "")
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue(), "", "")
+			case dto.MetricType_UNTYPED:
+				add("", m.GetUntyped().GetValue(), "", "")
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add("", q.GetValue(), "quantile", strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64))
+				}
+				add("_sum", s.GetSampleSum(), "", "")
+				add("_count", float64(s.GetSampleCount()), "", "")
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, bu := range h.GetBucket() {
+					add("_bucket", float64(bu.GetCumulativeCount()), "le", strconv.FormatFloat(bu.GetUpperBound(), 'g', -1, 64))
+				}
+				add("_bucket", float64(h.GetSampleCount()), "le", "+Inf")
+				add("_sum", h.GetSampleSum(), "", "")
+				add("_count", float64(h.GetSampleCount()), "", "")
+			}
+		}
+	}
+	return b, samples
+}
+
+// timeSeries encodes a TimeSeries protobuf of one sample, with the labels
+// sorted by name as remote_write requires. Empty labels are left out, as
+// when scraped.
+func timeSeries(name string, labels map[string]string, extraName, extraValue string, v float64, ts int64) []byte {
+	names := []string{"__name__"}
+	for k, value := range labels {
+		if k != extraName && value != "" {
+			names = append(names, k)
+		}
+	}
+	if extraName != "" {
+		names = append(names, extraName)
+	}
+	sort.Strings(names)
+	var b []byte
+	for _, k := range names {
+		value := labels[k]
+		switch k {
+		case "__name__":
+			value = name
+		case extraName:
+			value = extraValue
+		}
+		var l []byte
+		l = appendProtoBytes(l, 1, []byte(k))
+		l = appendProtoBytes(l, 2, []byte(value))
+		b = appendProtoBytes(b, 1, l)
+	}
+	var s []byte
+	s = appendProtoTag(s, 1, 1)
+	bits := math.Float64bits(v)
+	for i := 0; i < 8; i++ {
+		s = append(s, byte(bits>>(8*i)))
+	}
+	s = appendProtoTag(s, 2, 0)
+	s = appendVarint(s, uint64(ts))
+	return appendProtoBytes(b, 2, s)
+}
+
+// appendVarint appends v in protobuf varint encoding.
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// appendProtoTag appends the key of a protobuf field.
+func appendProtoTag(b []byte, field, wireType int) []byte {
+	return appendVarint(b, uint64(field<<3|wireType))
+}
+
+// appendProtoBytes appends a length delimited protobuf field: a string, or
+// an embedded message.
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendProtoTag(b, field, 2)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
@@ -0,0 +1,125 @@
+package mysensors
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeWriteRequest decodes a remote_write WriteRequest into one line per
+// sample, of its labels in order, value and timestamp.
+func decodeWriteRequest(t *testing.T, b []byte) []string {
+	var samples []string
+	fields(t, b, func(num protowire.Number, ts []byte) {
+		if num != 1 {
+			t.Fatalf("WriteRequest field %d", num)
+		}
+		var labels []string
+		var sample string
+		fields(t, ts, func(num protowire.Number, v []byte) {
+			switch num {
+			case 1:
+				var name, value string
+				fields(t, v, func(num protowire.Number, s []byte) {
+					if num == 1 {
+						name = string(s)
+					} else {
+						value = string(s)
+					}
+				})
+				labels = append(labels, name+"="+value)
+			case 2:
+				var value float64
+				var ts int64
+				for len(v) > 0 {
+					num, typ, n := protowire.ConsumeTag(v)
+					if n < 0 {
+						t.Fatalf("Sample: %v", protowire.ParseError(n))
+					}
+					v = v[n:]
+					switch {
+					case num == 1 && typ == protowire.Fixed64Type:
+						var bits uint64
+						bits, n = protowire.ConsumeFixed64(v)
+						value = math.Float64frombits(bits)
+					case num == 2 && typ == protowire.VarintType:
+						var u uint64
+						u, n = protowire.ConsumeVarint(v)
+						ts = int64(u)
+					default:
+						t.Fatalf("Sample field %d of type %d", num, typ)
+					}
+					if n < 0 {
+						t.Fatalf("Sample: %v", protowire.ParseError(n))
+					}
+					v = v[n:]
+				}
+				sample = fmt.Sprintf("%g@%d", value, ts)
+			}
+		})
+		samples = append(samples, strings.Join(labels, ",")+" "+sample)
+	})
+	return samples
+}
+
+// fields calls f with each length delimited field of the protobuf message b.
+func fields(t *testing.T, b []byte, f func(protowire.Number, []byte)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("tag: %v", protowire.ParseError(n))
+		}
+		if typ != protowire.BytesType {
+			t.Fatalf("field %d of type %d", num, typ)
+		}
+		b = b[n:]
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			t.Fatalf("field %d: %v", num, protowire.ParseError(n))
+		}
+		f(num, v)
+		b = b[n:]
+	}
+}
+
+func TestWriteRequest(t *testing.T) {
+	r := prometheus.NewRegistry()
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "temperature", Help: "h"}, []string{"node", "location"})
+	// A long label value, so that lengths take several varint bytes.
+	g.WithLabelValues("5", strings.Repeat("x", 300)).Set(21.5)
+	g.WithLabelValues("6", "").Set(-1)
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency_seconds", Help: "h", Buckets: []float64{0.5}})
+	h.Observe(0.25)
+	r.MustRegister(g, h)
+	mfs, err := r.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	req, n := writeRequest(mfs, prometheus.Labels{"job": "mysensors"}, now)
+	body, err := snappy.Decode(nil, snappy.Encode(nil, req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := decodeWriteRequest(t, body)
+	want := []string{
+		"__name__=latency_seconds_bucket,job=mysensors,le=0.5 1@1600000000000",
+		"__name__=latency_seconds_bucket,job=mysensors,le=+Inf 1@1600000000000",
+		"__name__=latency_seconds_sum,job=mysensors 0.25@1600000000000",
+		"__name__=latency_seconds_count,job=mysensors 1@1600000000000",
+		"__name__=temperature,job=mysensors,node=6 -1@1600000000000",
+		"__name__=temperature,job=mysensors,location=" + strings.Repeat("x", 300) + ",node=5 21.5@1600000000000",
+	}
+	if n != len(want) {
+		t.Errorf("writeRequest counted %d samples, want %d", n, len(want))
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("decoded samples:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
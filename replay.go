@@ -0,0 +1,111 @@
+// This file contains a transport replaying captured gateway traffic.
+package mysensors
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplayTransport is a GatewayTransport that replays a file of captured
+// gateway lines, eg to reproduce parsing bugs or demo dashboards without
+// hardware. Lines are either raw serial protocol lines, or frames as output
+// by /api/tail ("<time> <gateway> <dir> <line>") of which only received
+// frames are replayed. Written messages are discarded.
+type ReplayTransport struct {
+	// Path is the capture file.
+	Path string
+	// Timing replays frames with their original spacing, where timestamped.
+	Timing bool
+	// Loop restarts the replay at the end of the file.
+	Loop bool
+
+	mux sync.Mutex
+	pr  *io.PipeReader
+	pw  *io.PipeWriter
+}
+
+func (t *ReplayTransport) Open() error {
+	f, err := os.Open(t.Path)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.pr, t.pw = io.Pipe()
+	go t.replay(t.pw)
+	return nil
+}
+
+func (t *ReplayTransport) replay(pw *io.PipeWriter) {
+	for {
+		f, err := os.Open(t.Path)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		var last time.Time
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			ts, line, ok := parseCapture(s.Text())
+			if !ok {
+				continue
+			}
+			if t.Timing && !ts.IsZero() {
+				if !last.IsZero() && ts.After(last) {
+					time.Sleep(ts.Sub(last))
+				}
+				last = ts
+			}
+			if _, err := pw.Write([]byte(line + "\n")); err != nil {
+				f.Close()
+				return
+			}
+		}
+		f.Close()
+		if !t.Loop {
+			// Leave the pipe open so the Handler idles rather than reconnects.
+			return
+		}
+	}
+}
+
+// parseCapture parses a captured line, returning its timestamp (zero if not
+// known) and the raw serial protocol line.
+func parseCapture(l string) (time.Time, string, bool) {
+	l = strings.TrimSpace(strings.TrimPrefix(l, "data: "))
+	if l == "" || strings.HasPrefix(l, "#") {
+		return time.Time{}, "", false
+	}
+	parts := strings.SplitN(l, " ", 4)
+	if len(parts) == 4 {
+		if ts, err := time.Parse(time.RFC3339Nano, parts[0]); err == nil {
+			return ts, parts[3], parts[2] == "rx"
+		}
+	}
+	return time.Time{}, l, true
+}
+
+func (t *ReplayTransport) Read(b []byte) (int, error) {
+	t.mux.Lock()
+	pr := t.pr
+	t.mux.Unlock()
+	return pr.Read(b)
+}
+
+func (t *ReplayTransport) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (t *ReplayTransport) Close() error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.pw.Close()
+}
+
+// unpingable disables the gateway watchdog, as there is no gateway to ping.
+func (t *ReplayTransport) unpingable() {}
@@ -0,0 +1,42 @@
+// This file contains presentation requests to nodes sending values for
+// sensors that have not presented.
+package mysensors
+
+import (
+	"flag"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var representInterval = flag.Duration("represent_interval", 10*time.Minute, "Minimum time between I_PRESENTATION requests to a node sending values for unpresented sensors, 0 to disable")
+
+var representCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mysensors_presentation_requests_total",
+	Help: "I_PRESENTATION requests sent to nodes with unpresented sensors",
+}, []string{"gateway"})
+
+func init() {
+	mustRegister(representCount)
+}
+
+// represent asks the node to present its sensors again, as it sent a value
+// for sensor s which has not presented, for example after the state was
+// lost. Requests are limited to one per --represent_interval per node.
+// n.mux must be held.
+func (nd *Node) represent(s *Sensor, tx chan *Message) {
+	if *representInterval <= 0 || tx == nil || s.Presentation != nil {
+		return
+	}
+	if major, _, ok := nd.protocol(); ok && major < 2 {
+		// I_PRESENTATION is new in 2.0.
+		return
+	}
+	if time.Since(nd.represented) < *representInterval {
+		return
+	}
+	nd.represented = time.Now()
+	logf(modNetwork, LevelInfo, "Node %d sent a value for unpresented sensor %d, requesting presentation.", nd.ID, s.ID)
+	representCount.WithLabelValues(nd.Gateway).Inc()
+	Enqueue("tx", tx, &Message{NodeID: nd.ID, ChildSensorID: NoChild, Type: MsgInternal, SubType: I_PRESENTATION}, nil)
+}
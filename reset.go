@@ -0,0 +1,158 @@
+// This file contains the node factory-reset workflow.
+package mysensors
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// ResetNode factory-resets a node from the controller side. The node's state
+// and metrics are forgotten, its ID is released, the node is rebooted with
+// I_REBOOT, and ResetNode waits (until ctx is done) for it to present itself
+// again, rebuilding its sensors. If the node cleared its EEPROM and requests
+// an ID, it is reassigned its old one. gateway is the node's gateway, or
+// empty for the one it is on. progress is called as each step starts,
+// without n.mux held.
+func (n *Network) ResetNode(ctx context.Context, gateway string, id uint8, progress func(step string)) error {
+	progress(fmt.Sprintf("forgetting state of node %d", id))
+	n.mux.Lock()
+	gw, err := n.nodeGateway(gateway, id)
+	if err != nil {
+		n.mux.Unlock()
+		return err
+	}
+	tx := n.gateways[gw]
+	if nd, ok := n.Nodes[nodeKey(gw, id)]; ok {
+		nd.unexport()
+		delete(n.Nodes, nodeKey(gw, id))
+	}
+	n.ids.release(gw, id)
+	if n.reassignIDs == nil {
+		n.reassignIDs = make(map[string]bool)
+	}
+	n.reassignIDs[nodeKey(gw, id)] = true
+	n.changed()
+	n.mux.Unlock()
+	defer n.endReassign(gw, id)
+
+	ch, stop := n.watch(gw, id)
+	defer stop()
+
+	progress(fmt.Sprintf("rebooting node %d", id))
+	select {
+	case tx <- &Message{NodeID: id, ChildSensorID: NoChild, Type: MsgInternal, SubType: I_REBOOT}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	progress(fmt.Sprintf("waiting for node %d to present or request an ID", id))
+	for {
+		select {
+		case m := <-ch:
+			if m.Type == MsgInternal && m.SubType == I_ID_RESPONSE {
+				progress(fmt.Sprintf("node requested an ID, reassigned %d", id))
+			}
+			if m.Type == MsgPresentation {
+				progress(fmt.Sprintf("node %d presented: %s", id, m))
+				return nil
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("node %d did not present: %v", id, ctx.Err())
+		}
+	}
+}
+
+// nodeMetrics are the gauges labelled with the node's labels.
+var nodeMetrics = []string{batteryRatioMetric, batteryVoltsMetric, uptimeMetric, "mysensors_rssi_dbm", "mysensors_snr", "mysensors_tx_power_dbm"}
+
+// unexport deletes the node's series and those of its sensors. n.mux must be
+// held.
+func (nd *Node) unexport() {
+	for _, s := range nd.Sensors {
+		s.unexportAll()
+		s.unexportResets()
+	}
+	nd.unexportSeries()
+}
+
+// unexportResets deletes the sensor's counter resets series. n.mux must be
+// held.
+func (s *Sensor) unexportResets() {
+	s.node.counter(counterResetsMetric).DeleteLabelValues(s.resetLabels()...)
+}
+
+// unexportSeries deletes the node's own series. n.mux must be held.
+func (nd *Node) unexportSeries() {
+	for _, metric := range nodeMetrics {
+		nd.gauge(metric).DeleteLabelValues(nd.labels()...)
+	}
+	nd.counter(heartbeatMetric).DeleteLabelValues(nd.labels()...)
+	nd.gauge(sleepQueueMetric).DeleteLabelValues(nd.sleepQueueLabels()...)
+	nd.gauge(lastSeenMetric).DeleteLabelValues(nd.lastSeenLabels()...)
+	if nd.info != nil {
+		nd.gauge(nodeInfoMetric).DeleteLabelValues(nd.info...)
+		nd.info = nil
+	}
+}
+
+// reassignID assigns an ID of the gateway released by ResetNode to a node
+// requesting one, if any is not in use. n.mux must be held.
+func (n *Network) reassignID(gateway string, inUse func(uint8) bool) (uint8, bool) {
+	for i := FirstNodeID; i < BroadcastID; i++ {
+		id := uint8(i)
+		if !n.reassignIDs[nodeKey(gateway, id)] || inUse(id) {
+			continue
+		}
+		if err := n.ids.claim(gateway, id); err != nil {
+			logf(modNetwork, LevelError, "Can't reassign node ID %d: %v", id, err)
+			continue
+		}
+		delete(n.reassignIDs, nodeKey(gateway, id))
+		n.assign(gateway, id)
+		n.notifyWatchers(&Message{NodeID: id, ChildSensorID: NoChild, Type: MsgInternal, SubType: I_ID_RESPONSE, Payload: []byte(strconv.Itoa(int(id))), Gateway: gateway})
+		logf(modNetwork, LevelInfo, "Reassigned ID %d to a reset node.", id)
+		return id, true
+	}
+	return 0, false
+}
+
+// endReassign stops reserving id for its reset node. The ID stays allocated
+// in case the node uses it again, as IDs are never reissued.
+func (n *Network) endReassign(gateway string, id uint8) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	delete(n.reassignIDs, nodeKey(gateway, id))
+	n.ids.seen(gateway, id)
+}
+
+// watch returns a channel receiving messages handled for node id on the
+// gateway, and a function to stop watching. Messages are dropped if the
+// receiver is slow.
+func (n *Network) watch(gateway string, id uint8) (chan *Message, func()) {
+	ch := make(chan *Message, 10)
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.watchers == nil {
+		n.watchers = make(map[chan *Message]string)
+	}
+	n.watchers[ch] = nodeKey(gateway, id)
+	return ch, func() {
+		n.mux.Lock()
+		defer n.mux.Unlock()
+		delete(n.watchers, ch)
+	}
+}
+
+// notifyWatchers passes m to watchers of its node. n.mux must be held.
+func (n *Network) notifyWatchers(m *Message) {
+	for ch, key := range n.watchers {
+		if key != nodeKey(m.Gateway, m.NodeID) {
+			continue
+		}
+		select {
+		case ch <- m:
+		default:
+		}
+	}
+}
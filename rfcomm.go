@@ -0,0 +1,99 @@
+// This file contains a transport for gateways on Bluetooth serial adapters.
+package mysensors
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RFCOMMTransport is a GatewayTransport for a gateway connected through a
+// Bluetooth serial (RFCOMM) adapter, eg an HC-05. The adapter must already
+// be paired. If the link drops, eg the pairing is lost, reads fail and the
+// Handler reconnects.
+type RFCOMMTransport struct {
+	// Address is the adapter's Bluetooth address, eg 00:11:22:33:44:55.
+	Address string
+	// Channel is the RFCOMM channel, usually 1.
+	Channel uint8
+
+	mux  sync.Mutex
+	conn io.ReadWriteCloser
+}
+
+// NewRFCOMMTransport returns a transport for the adapter at the given address.
+func NewRFCOMMTransport(address string, channel uint8) *RFCOMMTransport {
+	return &RFCOMMTransport{Address: address, Channel: channel}
+}
+
+// parseBDAddr parses a Bluetooth address, returning it in the little endian
+// byte order of the kernel.
+func parseBDAddr(s string) ([6]uint8, error) {
+	var addr [6]uint8
+	parts := strings.Split(s, ":")
+	if len(parts) != 6 {
+		return addr, fmt.Errorf("invalid Bluetooth address %q", s)
+	}
+	for i, p := range parts {
+		b, err := strconv.ParseUint(p, 16, 8)
+		if err != nil {
+			return addr, fmt.Errorf("invalid Bluetooth address %q", s)
+		}
+		addr[5-i] = uint8(b)
+	}
+	return addr, nil
+}
+
+func (t *RFCOMMTransport) Open() error {
+	addr, err := parseBDAddr(t.Address)
+	if err != nil {
+		return err
+	}
+	conn, err := dialRFCOMM(addr, t.Channel)
+	if err != nil {
+		return fmt.Errorf("connecting to %s: %v", t.Address, err)
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.conn = conn
+	logf(modTransport, LevelInfo, "Connected to Bluetooth gateway %s.", t.Address)
+	return nil
+}
+
+func (t *RFCOMMTransport) current() (io.ReadWriteCloser, error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.conn == nil {
+		return nil, fmt.Errorf("Bluetooth gateway %s is not connected", t.Address)
+	}
+	return t.conn, nil
+}
+
+func (t *RFCOMMTransport) Read(b []byte) (int, error) {
+	c, err := t.current()
+	if err != nil {
+		return 0, err
+	}
+	return c.Read(b)
+}
+
+func (t *RFCOMMTransport) Write(b []byte) (int, error) {
+	c, err := t.current()
+	if err != nil {
+		return 0, err
+	}
+	return c.Write(b)
+}
+
+func (t *RFCOMMTransport) Close() error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
@@ -0,0 +1,34 @@
+// This file contains RFCOMM sockets for linux.
+package mysensors
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dialRFCOMM connects an RFCOMM socket to the given address and channel.
+func dialRFCOMM(addr [6]uint8, channel uint8) (io.ReadWriteCloser, error) {
+	fd, err := unix.Socket(unix.AF_BLUETOOTH, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.BTPROTO_RFCOMM)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Connect(fd, &unix.SockaddrRFCOMM{Addr: addr, Channel: channel}); err != nil {
+		unix.Close(fd)
+		switch err {
+		case unix.EACCES, unix.EPERM:
+			return nil, fmt.Errorf("%v: the pairing was lost or rejected, re-pair the adapter", err)
+		case unix.EHOSTDOWN, unix.EHOSTUNREACH, unix.ETIMEDOUT:
+			return nil, fmt.Errorf("%v: the adapter is out of range or powered off", err)
+		}
+		return nil, err
+	}
+	// Non-blocking, so Close interrupts a blocked Read.
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "rfcomm"), nil
+}
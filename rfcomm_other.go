@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+// This file contains RFCOMM sockets for other systems.
+package mysensors
+
+import (
+	"errors"
+	"io"
+)
+
+// dialRFCOMM is not supported on this platform.
+func dialRFCOMM(addr [6]uint8, channel uint8) (io.ReadWriteCloser, error) {
+	return nil, errors.New("Bluetooth RFCOMM gateways are only supported on linux")
+}
@@ -0,0 +1,255 @@
+// This file contains scripted scenarios for the simulated gateway.
+package mysensors
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScenarioStep is a message the simulated gateway sends at a given time
+// into a scenario. Exactly one of Present, Set, Internal, Raw or Silent is
+// set.
+type ScenarioStep struct {
+	// At is the time since the start of the scenario.
+	At time.Duration
+	// Node and Child address the message. Child defaults to 255, the node
+	// itself.
+	Node  uint8
+	Child uint8
+	// Present presents the child, eg S_TEMP.
+	Present string
+	// Set sends a value, eg V_TEMP.
+	Set string
+	// Internal sends an internal message, eg I_BATTERY_LEVEL.
+	Internal string
+	// Value is the payload.
+	Value string
+	// Raw is a raw serial protocol line to send.
+	Raw string
+	// Silent ends the scenario, leaving the gateway connected but silent.
+	Silent bool
+}
+
+// message returns the message the step sends.
+func (st *ScenarioStep) message() (*Message, error) {
+	if st.Raw != "" {
+		m := &Message{}
+		return m, m.Unmarshal([]byte(st.Raw + "\n"))
+	}
+	m := &Message{NodeID: st.Node, ChildSensorID: st.Child, Payload: []byte(st.Value)}
+	var err error
+	switch {
+	case st.Present != "":
+		m.Type = MsgPresentation
+		m.SubType, err = parseSubType(m.Type, st.Present)
+	case st.Set != "":
+		m.Type = MsgSet
+		m.SubType, err = parseSubType(m.Type, st.Set)
+	case st.Internal != "":
+		m.Type = MsgInternal
+		m.SubType, err = parseSubType(m.Type, st.Internal)
+	default:
+		err = fmt.Errorf("step at %v sends nothing", st.At)
+	}
+	return m, err
+}
+
+// parseSubType returns the sub type of message type t with the given name.
+func parseSubType(t MsgType, name string) (SubType, error) {
+	switch t {
+	case MsgPresentation:
+		for i, n := range subTypePresentation {
+			if n == name {
+				return SubTypePresentation(i), nil
+			}
+		}
+	case MsgSet, MsgReq:
+		if st, ok := customSubType(name); ok {
+			return st, nil
+		}
+		for i, n := range subTypeSetReq {
+			if n == name {
+				return SubTypeSetReq(i), nil
+			}
+		}
+	case MsgInternal:
+		for i, n := range subTypeInternal {
+			if n == name {
+				return SubTypeInternal(i), nil
+			}
+		}
+	case MsgStream:
+		for i, n := range subTypeStream {
+			if n == name {
+				return SubTypeStream(i), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unknown %s sub type %q", t, name)
+}
+
+// LoadScenario reads a scenario from a file. It is a YAML list of steps,
+// with the ScenarioStep fields in lower case, eg:
+//
+//   - at: 0s
+//     node: 5
+//     present: S_TEMP
+//     child: 0
+//   - at: 10s
+//     node: 5
+//     child: 0
+//     set: V_TEMP
+//     value: 21.5
+//   - at: 30s
+//     silent: true
+//
+// Only this simple form of YAML is supported, or the equivalent JSON.
+func LoadScenario(path string) ([]ScenarioStep, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var items []map[string]string
+	if t := bytes.TrimSpace(data); len(t) > 0 && t[0] == '[' {
+		var raw []map[string]interface{}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+		for _, r := range raw {
+			item := map[string]string{}
+			for k, v := range r {
+				item[k] = fmt.Sprint(v)
+			}
+			items = append(items, item)
+		}
+	} else if items, err = parseYAMLList(data); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	steps := []ScenarioStep{}
+	for i, item := range items {
+		st, err := scenarioStep(item)
+		if err != nil {
+			return nil, fmt.Errorf("%s: step %d: %v", path, i+1, err)
+		}
+		steps = append(steps, st)
+	}
+	return steps, nil
+}
+
+// scenarioStep converts a parsed step.
+func scenarioStep(item map[string]string) (ScenarioStep, error) {
+	st := ScenarioStep{Child: NoChild}
+	for k, v := range item {
+		var err error
+		switch strings.ToLower(k) {
+		case "at":
+			if st.At, err = time.ParseDuration(v); err != nil {
+				// Plain numbers are seconds.
+				var secs float64
+				if secs, err = strconv.ParseFloat(v, 64); err == nil {
+					st.At = time.Duration(secs * float64(time.Second))
+				}
+			}
+		case "node":
+			st.Node, err = parseUint8(v)
+		case "child":
+			st.Child, err = parseUint8(v)
+		case "present":
+			st.Present = v
+		case "set":
+			st.Set = v
+		case "internal":
+			st.Internal = v
+		case "value":
+			st.Value = v
+		case "raw":
+			st.Raw = v
+		case "silent":
+			st.Silent, err = strconv.ParseBool(v)
+		default:
+			err = fmt.Errorf("unknown key %q", k)
+		}
+		if err != nil {
+			return st, fmt.Errorf("%s: %v", k, err)
+		}
+	}
+	if !st.Silent {
+		if _, err := st.message(); err != nil {
+			return st, err
+		}
+	}
+	return st, nil
+}
+
+func parseUint8(s string) (uint8, error) {
+	v, err := strconv.ParseUint(s, 10, 8)
+	return uint8(v), err
+}
+
+// parseYAMLList parses a YAML list of mappings of scalars.
+func parseYAMLList(data []byte) ([]map[string]string, error) {
+	var items []map[string]string
+	var item map[string]string
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; s.Scan(); line++ {
+		l := s.Text()
+		if i := strings.Index(l, " #"); i >= 0 {
+			l = l[:i]
+		}
+		t := strings.TrimSpace(l)
+		if t == "" || strings.HasPrefix(t, "#") {
+			continue
+		}
+		if strings.HasPrefix(t, "-") {
+			item = map[string]string{}
+			items = append(items, item)
+			if t = strings.TrimSpace(t[1:]); t == "" {
+				continue
+			}
+		} else if item == nil || l[0] != ' ' && l[0] != '\t' {
+			return nil, fmt.Errorf("line %d: expected a list item", line)
+		}
+		kv := strings.SplitN(t, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("line %d: expected key: value", line)
+		}
+		v := strings.TrimSpace(kv[1])
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		item[strings.TrimSpace(kv[0])] = v
+	}
+	return items, s.Err()
+}
+
+// playScenario sends the scenario steps at their times, until a silent step
+// or stop.
+func (s *Simulator) playScenario(send func(*Message) bool, stop chan bool) {
+	start := time.Now()
+	for _, st := range s.Scenario {
+		select {
+		case <-time.After(time.Until(start.Add(st.At))):
+		case <-stop:
+			return
+		}
+		if st.Silent {
+			logf(modTransport, LevelInfo, "Simulator: scenario going silent.")
+			return
+		}
+		m, err := st.message()
+		if err != nil {
+			logf(modTransport, LevelError, "Simulator: %v", err)
+			continue
+		}
+		if !send(m) {
+			return
+		}
+	}
+	logf(modTransport, LevelInfo, "Simulator: scenario finished.")
+}
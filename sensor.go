@@ -6,11 +6,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"math"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -22,125 +24,310 @@ const (
 	GatewayID = 0
 	// NoChild is the placeholder used for non-sensor node messages.
 	NoChild = 255
+	// BroadcastID addresses all nodes.
+	BroadcastID = 255
 )
 
 // GaugeMap maps MySensor variables to prometheus variable names.
 var GaugeMap = map[SubTypeSetReq]string{
-	V_DISTANCE:    "distance",
-	V_TEMP:        "temperature",
-	V_HUM:         "humidity",
-	V_PRESSURE:    "pressure",
-	V_LEVEL:       "light_level",
-	V_LIGHT_LEVEL: "light_percent",
-	V_VOLUME:      "volume",
-	V_PERCENTAGE:  "battery_level",
-	V_VOLTAGE:     "battery_voltage",
-}
-
-// CounterMap maps MySensor variables to prometheus variable names.
+	V_DISTANCE:     "distance_meters",
+	V_TEMP:         "temperature",
+	V_HUM:          "humidity",
+	V_PRESSURE:     "pressure",
+	V_LEVEL:        "light_level",
+	V_LIGHT_LEVEL:  "light_percent",
+	V_VOLUME:       "volume",
+	V_PERCENTAGE:   "percentage",
+	V_VOLTAGE:      "voltage_volts",
+	V_WIND:         "wind_speed_meters_per_second",
+	V_GUST:         "wind_gust_meters_per_second",
+	V_DIRECTION:    "wind_direction_degrees",
+	V_PH:           "ph",
+	V_ORP:          "orp_millivolts",
+	V_EC:           "conductivity_microsiemens_per_cm",
+	V_VAR:          "reactive_power_var",
+	V_VA:           "apparent_power_volt_amperes",
+	V_POWER_FACTOR: "power_factor",
+	V_WATT:         "power_watts",
+	V_KWH:          "energy_kilowatt_hours",
+	V_CURRENT:      "current_amperes",
+	V_IMPEDANCE:    "impedance_ohms",
+	V_UV:           "uv_index",
+	V_WEIGHT:       "weight_kilograms",
+	V_RAIN:         "rain_millimeters",
+	V_RAINRATE:     "rain_rate_millimeters_per_hour",
+	V_FLOW:         "water_flow_meters",
+}
+
+// CounterMap maps MySensor variables nodes report cumulative totals of to
+// prometheus counter names. The counters accumulate the increases of the
+// totals, so survive node and exporter restarts, see Var.Total.
 var CounterMap = map[SubTypeSetReq]string{
-	V_VOLUME: "volume",
+	V_VOLUME: "volume_total",
+	V_KWH:    "energy_kilowatt_hours_total",
 }
 
 // Gauges contains a mapping from MySensor variables to prometheus gauge objects.
 type Gauges struct {
+	// Gauge are the gauges of variables by the names they are mapped to.
+	// Those named with a unit with --unit_metric_names, and those of
+	// mapping rules, are only in metrics.
 	Gauge              map[SubTypeSetReq]*prometheus.GaugeVec
 	receiveTimeSeconds *prometheus.GaugeVec
 	Labels             []string
+	profile            *metricProfile
+	// constLabels are added to every sensor gauge, per --const_labels or
+	// WithConstLabels.
+	constLabels prometheus.Labels
+	// metrics are the network's sensor metric vectors, by name.
+	metrics *metricSet
+	// rules are the mapping rules, see SetMappingRules.
+	rules []MappingRule
 }
 
-// Set sets the corresponding gauge to the given value.
-func (g *Gauges) Set(t SubTypeSetReq, l []string, v float64) {
-	gs, ok := GaugeMap[t]
-	if !ok {
-		return
+// receiveTimeMetric is the name of Gauges.receiveTimeSeconds.
+const receiveTimeMetric = "mysensors_receive_time_seconds"
+
+// name returns the metric name for the variable, or "" if not exported.
+func (g *Gauges) name(t SubTypeSetReq) string {
+	for _, r := range g.rules {
+		if r.Node == nil && r.subType == t && r.Type != "counter" {
+			return r.Metric
+		}
 	}
-	ga, ok := g.Gauge[t]
-	if !ok {
-		ga = prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name:        gs,
-				Help:        fmt.Sprintf("MYSENSORS %s", t),
-				ConstLabels: prometheus.Labels{"instance": "192.168.0.10:9001"},
-			},
-			g.Labels,
-		)
-		prometheus.MustRegister(ga)
+	if name, ok := g.profile.names[t]; ok {
+		return name
+	}
+	if name, ok := GaugeMap[t]; ok {
+		return name
+	}
+	c, _ := t.custom()
+	return c.Metric
+}
+
+// Set sets the corresponding gauge to the given value, returning the series
+// set.
+func (g *Gauges) Set(t SubTypeSetReq, l []string, v float64) []Series {
+	return g.SetUnit(t, "", l, v)
+}
+
+// metric returns the metric name and help for the variable in the given
+// unit, and whether the name includes the unit, or "" if not exported.
+func (g *Gauges) metric(t SubTypeSetReq, unit string) (name, help string, named bool) {
+	if name = g.name(t); name == "" {
+		return "", "", false
+	}
+	help = fmt.Sprintf("MYSENSORS %s", t)
+	if unit != "" {
+		help += " (" + unit + ")"
+	}
+	if slug := unitSlug(unit); *unitMetricNames && slug != "" && !strings.HasSuffix(name, "_"+slug) {
+		return name + "_" + slug, help, true
+	}
+	return name, help, false
+}
+
+// SetUnit sets the corresponding gauge to the given value in the given unit,
+// if known, returning the series set. The unit is added to the help of new
+// metrics, and with --unit_metric_names to their name.
+func (g *Gauges) SetUnit(t SubTypeSetReq, unit string, l []string, v float64) []Series {
+	gs, help, named := g.metric(t, unit)
+	if gs == "" {
+		return nil
+	}
+	if *scrapeTimeMetrics {
+		// The value is collected from the Var at scrape time.
+		g.receiveTimeSeconds.WithLabelValues(l...).SetToCurrentTime()
+		return []Series{{Metric: receiveTimeMetric, Labels: l}}
+	}
+	ga := g.newGauge(gs, help)
+	if ga == nil {
+		return nil
+	}
+	if !named {
 		if len(g.Gauge) == 0 {
 			g.Gauge = make(map[SubTypeSetReq]*prometheus.GaugeVec)
 		}
 		g.Gauge[t] = ga
 	}
-	ga.WithLabelValues(l...).Set(v)
+	values := g.profile.values(t, l)
+	ga.WithLabelValues(values...).Set(v)
 	g.receiveTimeSeconds.WithLabelValues(l...).SetToCurrentTime()
+	return []Series{{Metric: gs, Labels: values}, {Metric: receiveTimeMetric, Labels: l}}
+}
+
+// newGauge returns the named sensor gauge, creating and registering it if
+// needed, or nil on error.
+func (g *Gauges) newGauge(name, help string) *prometheus.GaugeVec {
+	labels := g.Labels
+	if g.profile.labels != nil {
+		labels = g.profile.labels
+	}
+	return g.metrics.gauge(name, help, labels, g.constLabels)
 }
 
 // Counters contains a mapping from MySensor variables to prometheus counter objects.
 type Counters struct {
 	Counter map[SubTypeSetReq]*prometheus.CounterVec
 	Labels  []string
+	// ConstLabels are added to every counter.
+	ConstLabels prometheus.Labels
+	// Registerer the counters are registered with, or nil for the
+	// package's registry, see SetRegistry.
+	Registerer prometheus.Registerer
+	// metrics are the counters by name, shared with the network's gauges.
+	metrics *metricSet
 }
 
-// Set sets the corresponding counter to the given value.
-func (c *Counters) Set(t SubTypeSetReq, l []string, v float64) {
+// Set sets the corresponding counter to the given total, returning the series
+// set.
+func (c *Counters) Set(t SubTypeSetReq, l []string, v float64) []Series {
 	gs, ok := CounterMap[t]
 	if !ok {
-		return
+		return nil
 	}
-	ga, ok := c.Counter[t]
-	if !ok {
-		ga = prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Name:        gs,
-				Help:        fmt.Sprintf("MYSENSORS %s", t),
-				ConstLabels: prometheus.Labels{"instance": "192.168.0.10:9001"},
-			},
-			c.Labels,
-		)
-		prometheus.MustRegister(ga)
-		if len(c.Counter) == 0 {
-			c.Counter = make(map[SubTypeSetReq]*prometheus.CounterVec)
+	ga := c.set(gs, fmt.Sprintf("MYSENSORS %s", t), l, v)
+	if ga == nil {
+		return nil
+	}
+	if len(c.Counter) == 0 {
+		c.Counter = make(map[SubTypeSetReq]*prometheus.CounterVec)
+	}
+	c.Counter[t] = ga
+	return []Series{{Metric: gs, Labels: l}}
+}
+
+// set sets the named counter to the given total, creating it if needed, and
+// returns it, or nil on error. Totals below 0 are not counted.
+func (c *Counters) set(name, help string, l []string, v float64) *prometheus.CounterVec {
+	// Counters only go up, so the series is recreated with the total.
+	ga := c.vec(name, help)
+	if ga == nil {
+		return nil
+	}
+	ga.DeleteLabelValues(l...)
+	ga.WithLabelValues(l...).Add(math.Max(v, 0))
+	return ga
+}
+
+// vec returns the named counter, creating it if needed, or nil on error.
+func (c *Counters) vec(name, help string) *prometheus.CounterVec {
+	if c.metrics == nil {
+		r := c.Registerer
+		if r == nil {
+			r = currentRegistry()
 		}
-		c.Counter[t] = ga
+		c.metrics = newMetricSet(r)
 	}
-	ga.WithLabelValues(l...).Add(v)
+	return c.metrics.counter(name, help, c.Labels, c.ConstLabels)
 }
 
 // Network is a container for all sensor nodes.
 type Network struct {
 	Nodes             map[string]*Node
 	gauges            *Gauges
+	counters          *Counters
 	rxNodePacketCount *prometheus.CounterVec
 	Tx                chan *Message `json:"-"`
+	gateways          map[string]chan *Message
+	watchers          map[chan *Message]string
+	alerts            chan Alert
+	gatewayVersions   map[string]string
+	inventory         *Inventory
+	quarantine        map[invKey]*Quarantined
+	registry          prometheus.Registerer
+	registerer        prometheus.Registerer
+	collector         *networkCollector
+	violations        map[uint8]map[string]*Violation
+	handlers          []*Handler
+	pendingIDs        map[string]time.Time
+	reassignIDs       map[string]bool
+	failedJoins       []FailedJoin
+	backups           []BackupResult
+	ids               *IDAllocator
 	mux               sync.Mutex
+
+	// dirtySince and lastChange are when the state first and last changed
+	// since it was saved.
+	dirtySince, lastChange time.Time
+	// saveMux protects savedSum and savedPath, the last saved state.
+	saveMux   sync.Mutex
+	savedSum  []byte
+	savedPath string
+
+	// CustomMappings are the metric mappings set with SetMappings, or nil
+	// for the defaults.
+	CustomMappings *Mappings `json:"Mappings,omitempty"`
+	// Groups are the logical devices, by name.
+	Groups map[string]*Group `json:",omitempty"`
+	// History, if set, records the sensor readings.
+	History *History `json:"-"`
+	// OTA, if set, serves firmware updates to nodes.
+	OTA *OTA `json:"-"`
+}
+
+// NetworkOption configures a Network in NewNetwork.
+type NetworkOption func(*Network)
+
+// WithConstLabels sets labels added to the sensor value metrics, overriding
+// --const_labels. Prometheus adds the instance label of the scrape target,
+// so they are rarely needed.
+func WithConstLabels(l prometheus.Labels) NetworkOption {
+	return func(n *Network) { n.gauges.constLabels = l }
+}
+
+// WithRegisterer registers the network's metrics, including its node and
+// sensor gauges, with r instead of the package's registry, so several
+// networks, eg in tests, don't share or collide on metrics. Other package
+// level metrics, eg gateway counters and gauges, stay on the package's
+// registry.
+func WithRegisterer(r prometheus.Registerer) NetworkOption {
+	return func(n *Network) { n.registerer = r }
 }
 
 // NewNetwork initialises a new Network.
-func NewNetwork() *Network {
+func NewNetwork(opts ...NetworkOption) *Network {
 	n := &Network{}
 	n.Nodes = make(map[string]*Node, 0)
-	labels := []string{"location", "node", "sensor"}
+	n.gateways = make(map[string]chan *Message)
+	n.alerts = make(chan Alert, 100)
+	n.ids = NewIDAllocator()
 	n.gauges = &Gauges{
-		Labels: labels,
-		receiveTimeSeconds: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "mysensors_receive_time_seconds",
-				Help: "Unix timestamp of packet received from this sensor",
-			},
-			labels,
-		),
+		Labels:      sensorLabels,
+		profile:     currentProfile(),
+		constLabels: flagConstLabels(),
+	}
+	for _, opt := range opts {
+		opt(n)
 	}
 	n.Tx = make(chan *Message)
-	n.rxNodePacketCount = prometheus.NewCounterVec(
+	n.registerMetrics()
+	return n
+}
+
+// registerMetrics creates and registers the network's fixed metrics.
+func (n *Network) registerMetrics() {
+	n.registry = n.metricsRegistry()
+	n.gauges.metrics = newMetricSet(n.registry)
+	n.counters = &Counters{Labels: n.gauges.Labels, ConstLabels: n.gauges.constLabels, Registerer: n.registry, metrics: n.gauges.metrics}
+	n.rxNodePacketCount = register(n.registry, prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "mysensors_received_packets",
 			Help: "Packets received from sensor nodes",
 		},
-		[]string{"node", "location"},
-	)
-	prometheus.MustRegister(n.rxNodePacketCount)
-	prometheus.MustRegister(n.gauges.receiveTimeSeconds)
-	return n
+		[]string{"node", "location", "gateway", "name"},
+	)).(*prometheus.CounterVec)
+	if *scrapeTimeMetrics {
+		n.collector = &networkCollector{n: n, registry: n.registry}
+		register(n.registry, n.collector)
+	}
+	n.gauges.receiveTimeSeconds = register(n.registry, prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: receiveTimeMetric,
+			Help: "Unix timestamp of packet received from this sensor",
+		},
+		n.gauges.Labels,
+	)).(*prometheus.GaugeVec)
 }
 
 // HandleMessage handles a MySensors message from the gateway.
@@ -148,18 +335,191 @@ func (n *Network) HandleMessage(m *Message, tx chan *Message) error {
 	n.mux.Lock()
 	defer n.mux.Unlock()
 	if m.NodeID == GatewayID {
-		log.Printf("GW MSG: %s\n", m)
+		logf(modNetwork, LevelDebug, "GW MSG: %s\n", m)
 		// Fallthrough: Gateways can expose sensors directly
 	}
-	nID := fmt.Sprintf("%d", m.NodeID)
-	nd, ok := n.Nodes[nID]
-	if !ok {
-		nd = NewNode(n)
-		n.Nodes[nID] = nd
+	if m.NodeID == BroadcastID {
+		// Sent by nodes without an ID yet, or a broadcast seen by the
+		// gateway. Either way it is not a node.
+		logf(modNetwork, LevelDebug, "BROADCAST: %s\n", m)
+		return nil
+	}
+	if m.Synthetic {
+		return n.injected(m)
 	}
+	n.joined(m)
+	observeTime(m)
+	if !n.checkConformance(m) && n.inventory != nil {
+		// Strict mode only accepts conformant traffic.
+		return nil
+	}
+	if n.quarantined(m) {
+		return nil
+	}
+	n.changed()
+	nd := n.received(m)
+	n.notifyWatchers(m)
+	nd.wake(tx)
 	return nd.HandleMessage(m, tx)
 }
 
+// nodeKey returns the key of a node in Nodes. Node IDs are only unique per
+// gateway, so are qualified with the gateway's name.
+func nodeKey(gateway string, id uint8) string {
+	if gateway == "" {
+		return strconv.Itoa(int(id))
+	}
+	return gateway + "/" + strconv.Itoa(int(id))
+}
+
+// received returns the node a message was received from, creating it if
+// needed. A node not yet on a gateway, eg from the state of an older version,
+// is taken to be on the message's. n.mux must be held.
+func (n *Network) received(m *Message) *Node {
+	if nd, ok := n.Nodes[nodeKey(m.Gateway, m.NodeID)]; ok {
+		return nd
+	}
+	nd, ok := n.Nodes[nodeKey("", m.NodeID)]
+	if ok {
+		delete(n.Nodes, nodeKey("", m.NodeID))
+		nd.unexport()
+	} else {
+		nd = NewNode(n)
+		nd.ID = m.NodeID
+	}
+	nd.Gateway = m.Gateway
+	n.Nodes[nodeKey(m.Gateway, m.NodeID)] = nd
+	n.ids.seen(m.Gateway, m.NodeID)
+	if ok {
+		for _, s := range nd.Sensors {
+			s.reexport()
+		}
+	}
+	return nd
+}
+
+// node returns the node with the ID on the gateway, or if gateway is empty,
+// on whichever gateway it is. It is an error if the node is on several
+// gateways. n.mux must be held.
+func (n *Network) node(gateway string, id uint8) (*Node, error) {
+	if nd, ok := n.Nodes[nodeKey(gateway, id)]; ok {
+		return nd, nil
+	}
+	if gateway != "" {
+		return nil, fmt.Errorf("unknown node %d on gateway %s", id, gateway)
+	}
+	var found *Node
+	for _, nd := range n.Nodes {
+		if nd.ID != id {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("node %d is on gateways %s and %s, so the gateway must be given", id, found.Gateway, nd.Gateway)
+		}
+		found = nd
+	}
+	if found == nil {
+		return nil, fmt.Errorf("unknown node %d", id)
+	}
+	return found, nil
+}
+
+// sortByNode sorts messages by gateway and node ID.
+func sortByNode(ms []*Message) {
+	sort.Slice(ms, func(i, j int) bool {
+		if ms[i].Gateway != ms[j].Gateway {
+			return ms[i].Gateway < ms[j].Gateway
+		}
+		return ms[i].NodeID < ms[j].NodeID
+	})
+}
+
+// AddGateway registers the Tx channel of a gateway, for routing messages to
+// the nodes it serves.
+func (n *Network) AddGateway(name string, tx chan *Message) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.gateways[name] = tx
+}
+
+// Send sends a message to a node via its gateway, m.Gateway if set, else the
+// one the node is on.
+// Set and req messages to a sleeping node are held until it wakes. Messages
+// to BroadcastID are sent via every gateway. Payloads which can't be sent
+// intact are refused, see CheckPayload.
+func (n *Network) Send(m *Message) error {
+	if err := m.CheckPayload(); err != nil {
+		return err
+	}
+	if m.NodeID == BroadcastID {
+		n.Broadcast(m)
+		return nil
+	}
+	n.mux.Lock()
+	if n.hold(m) {
+		n.mux.Unlock()
+		return nil
+	}
+	tx, err := n.gatewayTx(m)
+	n.mux.Unlock()
+	if err != nil {
+		return err
+	}
+	Enqueue("tx", tx, m, nil)
+	return nil
+}
+
+// Broadcast sends a copy of the message to all nodes, via every gateway.
+func (n *Network) Broadcast(m *Message) {
+	n.mux.Lock()
+	txs := []chan *Message{}
+	for _, tx := range n.gateways {
+		txs = append(txs, tx)
+	}
+	n.mux.Unlock()
+	for _, tx := range txs {
+		b := m.Copy()
+		b.NodeID = BroadcastID
+		Enqueue("tx", tx, b, nil)
+	}
+}
+
+// gatewayTx returns the Tx channel for the message's node. n.mux must be held.
+func (n *Network) gatewayTx(m *Message) (chan *Message, error) {
+	gw, err := n.nodeGateway(m.Gateway, m.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	return n.gateways[gw], nil
+}
+
+// nodeGateway returns the name of the gateway to reach a node via: the given
+// one if not empty, else the one the node is on, else the only gateway.
+// n.mux must be held.
+func (n *Network) nodeGateway(gateway string, id uint8) (string, error) {
+	if gateway != "" {
+		if _, ok := n.gateways[gateway]; !ok {
+			return "", fmt.Errorf("unknown gateway %s", gateway)
+		}
+		return gateway, nil
+	}
+	nd, err := n.node("", id)
+	if nd != nil {
+		if _, ok := n.gateways[nd.Gateway]; ok {
+			return nd.Gateway, nil
+		}
+	}
+	if len(n.gateways) == 1 {
+		for gw := range n.gateways {
+			return gw, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("no gateway known for node %d", id)
+	}
+	return "", err
+}
+
 // StatusString returns a formatted representation of the network.
 func (n *Network) StatusString() string {
 	n.mux.Lock()
@@ -173,6 +533,9 @@ func (n *Network) StatusString() string {
 	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
 	for _, node := range nodes {
 		fmt.Fprintf(&b, "Node %d [%s %s]", node.ID, node.SketchName, node.SketchVersion)
+		if node.Version != "" {
+			fmt.Fprintf(&b, "    Library: %s", node.Version)
+		}
 		if node.Location != "" {
 			fmt.Fprintf(&b, "    Location: %s", node.Location)
 		}
@@ -193,12 +556,33 @@ func (n *Network) StatusString() string {
 			}
 			sort.Slice(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
 			for _, v := range vars {
-				fmt.Fprintf(&b, " %s: %s   ", v.SubType.String(), v.String())
+				fmt.Fprintf(&b, " %s: %s   ", node.SubTypeName(v.SubType), s.display(v))
 			}
 			fmt.Fprintln(&b)
 		}
 		fmt.Fprintln(&b)
 	}
+	groups := []string{}
+	for name := range n.Groups {
+		groups = append(groups, name)
+	}
+	sort.Strings(groups)
+	for _, name := range groups {
+		fmt.Fprintf(&b, "Group %s:", name)
+		for _, m := range n.groupState(n.Groups[name]).Members {
+			fmt.Fprintf(&b, "  %d/%d", m.Node, m.Sensor)
+			if m.Role != "" {
+				fmt.Fprintf(&b, " (%s)", m.Role)
+			}
+			vals := []string{}
+			for k, v := range m.Values {
+				vals = append(vals, k+": "+v)
+			}
+			sort.Strings(vals)
+			fmt.Fprintf(&b, " %v", vals)
+		}
+		fmt.Fprint(&b, "\n\n")
+	}
 	fmt.Fprintln(&b, "<<< status")
 	return b.String()
 }
@@ -208,7 +592,7 @@ func (n *Network) LoadJson(f string) error {
 	n.mux.Lock()
 	defer n.mux.Unlock()
 	if _, err := os.Stat(f); os.IsNotExist(err) {
-		log.Printf("Warning: State file (%s) does not exist, starting anew", f)
+		logf(modNetwork, LevelWarn, "Warning: State file (%s) does not exist, starting anew", f)
 		return nil
 	}
 	data, err := ioutil.ReadFile(f)
@@ -218,12 +602,35 @@ func (n *Network) LoadJson(f string) error {
 	if err = json.Unmarshal(data, n); err != nil {
 		return err
 	}
+	if n.CustomMappings != nil {
+		if err = n.applyMappings(*n.CustomMappings); err != nil {
+			return err
+		}
+	}
+	// Older versions kept broadcasts as a node.
+	delete(n.Nodes, strconv.Itoa(BroadcastID))
+	// Older versions keyed nodes by ID only.
+	nodes := make(map[string]*Node, len(n.Nodes))
+	for _, node := range n.Nodes {
+		nodes[nodeKey(node.Gateway, node.ID)] = node
+	}
+	n.Nodes = nodes
 	// Re-add parent struct params which arent there after
 	// JSON import.
 	for _, node := range n.Nodes {
 		node.network = n
+		node.reexport()
 		for _, s := range node.Sensors {
 			s.node = node
+			s.rekey()
+			if s.Ignored {
+				continue
+			}
+			s.exportLastSeen()
+			for _, v := range s.Vars {
+				s.exportWatermarks(v)
+				s.exportCounter(v)
+			}
 		}
 	}
 	return nil
@@ -231,31 +638,57 @@ func (n *Network) LoadJson(f string) error {
 
 // SaveJson saves the network to a file in Json format.
 func (n *Network) SaveJson(f string) error {
+	n.mux.Lock()
+	dirtySince := n.dirtySince
+	n.dirtySince = time.Time{}
+	n.mux.Unlock()
+	data, err := n.Json()
+	if err == nil {
+		err = n.writeState(f, data)
+	}
+	if err != nil {
+		n.mux.Lock()
+		if n.dirtySince.IsZero() {
+			n.dirtySince = dirtySince
+		}
+		n.mux.Unlock()
+	}
+	return err
+}
+
+// Json returns the network in indented Json format.
+func (n *Network) Json() ([]byte, error) {
 	n.mux.Lock()
 	defer n.mux.Unlock()
 	data, err := json.Marshal(n)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	var out bytes.Buffer
 	json.Indent(&out, data, "", "  ")
-	if err = ioutil.WriteFile(f, out.Bytes(), os.ModePerm); err != nil {
-		return err
-	}
-	return nil
+	return out.Bytes(), nil
 }
 
-// NextNodeID allocates and returns a node ID.
-func (n *Network) NextNodeID() uint8 {
+// NextNodeID allocates and returns a node ID on the gateway, which is
+// pending until the node presents. It returns ErrNoNodeIDs if all IDs of the
+// gateway are taken.
+func (n *Network) NextNodeID(gateway string) (uint8, error) {
 	n.mux.Lock()
 	defer n.mux.Unlock()
-	nextID := uint8(FirstNodeID)
-	for _, node := range n.Nodes {
-		if node.ID >= nextID {
-			nextID = node.ID + 1
-		}
+	inUse := func(id uint8) bool {
+		_, node := n.Nodes[nodeKey(gateway, id)]
+		_, pending := n.pendingIDs[nodeKey(gateway, id)]
+		return node || pending
 	}
-	return nextID
+	if id, ok := n.reassignID(gateway, inUse); ok {
+		return id, nil
+	}
+	id, err := n.ids.allocate(gateway, inUse)
+	if err != nil {
+		return 0, err
+	}
+	n.assign(gateway, id)
+	return id, nil
 }
 
 // Node is a node that may contain multiple sensors.
@@ -264,18 +697,60 @@ type Node struct {
 	ID uint8
 	// Battery is the battery level percent, or nil if unknown.
 	Battery *int64
+	// BatteryVolts is the last V_VOLTAGE of the node's
+	// --battery_volts_sensor child, or nil if unknown.
+	BatteryVolts *float64 `json:",omitempty"`
 	// Location per the configuration.
 	Location string
+	// Name is a human name per the configuration, eg kitchen_fridge, added
+	// to the node's metrics as the name label.
+	Name string `json:",omitempty"`
 	// Version as reported.
 	Version string
 	// Sketch name.
 	SketchName string
 	// SketchVersion.
 	SketchVersion string
+	// Gateway is the name of the gateway the node was last heard on.
+	Gateway string
+	// Parent is the node's parent in the mesh, or nil if unknown.
+	Parent *uint8 `json:",omitempty"`
+	// Sleeping is whether the node announced it is going to sleep, and has
+	// not been heard from since.
+	Sleeping bool `json:",omitempty"`
+	// Queued are the commands held until the node wakes.
+	Queued []*Message `json:",omitempty"`
+	// SigningRequired is whether the node requires signed messages.
+	SigningRequired bool `json:",omitempty"`
+	// LastSeen is when a message was last received from the node.
+	LastSeen time.Time
+	// Config is the I_CONFIG reply for the node, M for metric or I for
+	// imperial units, or empty for --node_config.
+	Config string `json:",omitempty"`
+	// Registration is the registration state of a 2.x node, or empty if it
+	// has not requested registration.
+	Registration string `json:",omitempty"`
 	// Sensors are all sensors attached to the node.
 	Sensors map[string]*Sensor
 	// network is the parent network.
 	network *Network
+	// info are the label values of the exported mysensors_node_info.
+	info []string
+	// expired is whether the node's series were expired by --value_ttl.
+	expired bool
+	// signalPending are the signal report queries awaiting an answer, by
+	// index in signalQueries.
+	signalPending []int
+	// represented is when the node was last asked to present.
+	represented time.Time
+}
+
+// nodeLabels are the labels of per-node metrics.
+var nodeLabels = []string{"node", "location", "gateway", "name"}
+
+// labels returns the values of nodeLabels for the node.
+func (n *Node) labels() []string {
+	return []string{strconv.Itoa(int(n.ID)), n.Location, n.Gateway, n.Name}
 }
 
 func NewNode(ne *Network) *Node {
@@ -286,38 +761,84 @@ func NewNode(ne *Network) *Node {
 
 func (n *Node) HandleMessage(m *Message, tx chan *Message) error {
 	n.ID = m.NodeID
-	n.network.rxNodePacketCount.WithLabelValues(strconv.Itoa(int(n.ID)), n.Location).Inc()
+	n.network.rxNodePacketCount.WithLabelValues(strconv.Itoa(int(n.ID)), n.Location, n.Gateway, n.Name).Inc()
 	sID := fmt.Sprintf("%d", m.ChildSensorID)
 	if m.ChildSensorID == NoChild {
+		n.seen(nil, time.Now())
 		return n.handleMessage(m, tx)
 	}
 	cs, ok := n.Sensors[sID]
 	if !ok {
 		cs = NewSensor(n)
+		cs.ID = m.ChildSensorID
 		n.Sensors[sID] = cs
 	}
+	n.seen(cs, time.Now())
 	return cs.HandleMessage(m, tx)
 }
 
 func (n *Node) handleMessage(m *Message, tx chan *Message) error {
+	if m.Type == MsgPresentation {
+		switch m.SubType.(SubTypePresentation) {
+		case S_ARDUINO_NODE, S_ARDUINO_REPEATER_NODE:
+			// The payload is the library version.
+			if len(m.Payload) > 0 {
+				n.setVersion(string(m.Payload))
+			}
+			return nil
+		}
+	}
+	if m.Type == MsgSet && m.SubType == V_VOLTAGE && *batteryVoltsSensor == NoChild {
+		// The node reports its battery voltage as itself.
+		if volts, err := strconv.ParseFloat(string(m.Payload), 64); err == nil {
+			n.setBatteryVolts(volts)
+		}
+		return nil
+	}
 	if m.Type != MsgInternal {
 		return fmt.Errorf("Unknown message to child id %d", NoChild)
 	}
 	subType := m.SubType.(SubTypeInternal)
 	switch subType {
 	case I_BATTERY_LEVEL:
-		if battery, err := strconv.ParseInt(string(m.Payload), 10, 32); err != nil {
+		if battery, err := strconv.ParseInt(string(m.Payload), 10, 32); err == nil {
 			n.Battery = &battery
-			n.network.gauges.Set(V_PERCENTAGE, []string{n.Location, strconv.Itoa(int(n.ID)), "0"}, float64(battery)/100.0)
+			n.exportBattery()
 		}
 	case I_VERSION:
-		n.Version = string(m.Payload)
+		n.setVersion(string(m.Payload))
 	case I_SKETCH_NAME:
+		changed := n.SketchName != string(m.Payload)
 		n.SketchName = string(m.Payload)
+		n.exportInfo()
+		if changed && *sketchLabel {
+			for _, s := range n.Sensors {
+				s.relabel()
+			}
+		}
 	case I_SKETCH_VERSION:
 		n.SketchVersion = string(m.Payload)
+		n.exportInfo()
+	case I_DISCOVER_RESPONSE:
+		if parent, err := strconv.ParseUint(string(m.Payload), 10, 8); err == nil {
+			p := uint8(parent)
+			n.Parent = &p
+		}
+	case I_REQUEST_SIGNING:
+		n.SigningRequired = signingRequired(m.Payload)
+	case I_PRE_SLEEP_NOTIFICATION:
+		n.Sleeping = true
+	case I_POST_SLEEP_NOTIFICATION:
+		n.Sleeping = false
+	case I_SIGNAL_REPORT_RESPONSE:
+		n.signalReport(string(m.Payload))
+	case I_HEARTBEAT_RESPONSE:
+		n.heartbeat(string(m.Payload))
+	case I_PRESENTATION, I_DEBUG, I_LOCKED, I_REGISTRATION_REQUEST:
+		// Informational, the node is alive.
+		logf(modNetwork, LevelDebug, "Node %d: %s\n", n.ID, m.String())
 	default:
-		log.Printf("UNKN: %s\n", m.String())
+		logf(modNetwork, LevelDebug, "UNKN: %s\n", m.String())
 	}
 	return nil
 }
@@ -331,8 +852,24 @@ type Sensor struct {
 	Presentation *SubTypePresentation
 	// Vars are the variables presented by this child sensor.
 	Vars map[string]*Var
+	// Ignored sensors are tracked, but their values are neither exported
+	// nor published.
+	Ignored bool `json:",omitempty"`
+	// Name is a human name per the configuration, added to the sensor's
+	// metrics as the name label instead of the node's.
+	Name string `json:",omitempty"`
+	// LastSeen is when a message was last received from the sensor.
+	LastSeen time.Time
+	// Series are the metric series exported for the sensor, by fingerprint,
+	// so they can be deleted exactly.
+	Series map[string]Series `json:",omitempty"`
 	// Node is the parent node.
 	node *Node
+	// wind are the recent wind direction readings.
+	wind []windSample
+	// synthetic is set while exporting an injected value, to label its
+	// series as synthetic.
+	synthetic bool
 }
 
 func NewSensor(n *Node) *Sensor {
@@ -346,27 +883,65 @@ func (s *Sensor) HandleMessage(m *Message, tx chan *Message) error {
 	switch m.Type {
 	case MsgPresentation:
 		p := m.SubType.(SubTypePresentation)
+		changed := s.Presentation == nil || *s.Presentation != p
 		s.Presentation = &p
-		log.Printf("PRES: %s\n", m)
+		if changed && len(s.Series) > 0 {
+			s.relabel()
+		}
+		logf(modNetwork, LevelDebug, "PRES: %s\n", m)
 	case MsgSet:
+		s.node.represent(s, tx)
 		subType := m.SubType.(SubTypeSetReq)
 		if s.Vars == nil {
 			s.Vars = make(map[string]*Var, 0)
 		}
+		var previous *Var
+		if v, ok := s.Vars[subType.String()]; ok {
+			p := *v
+			previous = &p
+		}
 		if _, ok := s.Vars[subType.String()]; !ok {
-			switch subType {
-			case V_DISTANCE, V_TEMP, V_HUM, V_PRESSURE, V_LEVEL, V_VOLUME, V_VOLTAGE, V_LIGHT_LEVEL:
-				s.Vars[subType.String()] = &Var{Type: varFloat}
-			default:
-				s.Vars[subType.String()] = &Var{Type: varString}
-			}
+			s.Vars[subType.String()] = s.newVar(subType)
 		}
 		s.Vars[subType.String()].SubType = subType
 		s.Vars[subType.String()].Set(string(m.Payload))
-		if s.Vars[subType.String()].Type == varFloat {
-			s.node.network.gauges.Set(subType, []string{s.node.Location, strconv.Itoa(int(s.node.ID)), strconv.Itoa(int(s.ID))}, s.Vars[subType.String()].FloatVal)
+		s.Vars[subType.String()].Updated = time.Now()
+		s.setUnit()
+		if subType == V_UNIT_PREFIX && *unitMetricNames && (previous == nil || previous.Value() != s.unit()) {
+			// Move the values to the metrics named with the new unit.
+			s.unexportAll()
+			s.reexport()
 		}
-		log.Printf("SET: %s\n", m)
+		if subType == V_TRIPPED {
+			s.raiseAlert(previous, s.Vars[subType.String()], false)
+		}
+		s.count(previous, s.Vars[subType.String()])
+		if subType == V_VOLTAGE {
+			s.batteryVolts(s.Vars[subType.String()])
+		}
+		mapped := !s.Ignored && s.exportMapped(s.Vars[subType.String()])
+		if s.Vars[subType.String()].Type == varFloat && !s.Ignored {
+			switch {
+			case mapped:
+				// Exported per its mapping rule.
+			case s.legacyValue(subType, s.Vars[subType.String()].FloatVal):
+				// Exported under its 1.4 meaning.
+			case s.airQuality(subType):
+				s.updateAirQuality(s.Vars[subType.String()].FloatVal)
+			default:
+				s.track(s.node.network.gauges.SetUnit(subType, s.metricUnit(subType), s.labels(), s.converted(subType, s.Vars[subType.String()].FloatVal))...)
+			}
+			s.updateWatermarks(s.Vars[subType.String()])
+			s.recordHistory(subType, s.Vars[subType.String()].FloatVal, false)
+			if subType == V_DIRECTION {
+				s.updateWind(s.Vars[subType.String()].FloatVal)
+			}
+		}
+		if !s.Ignored && !mapped {
+			s.exportValue(s.Vars[subType.String()])
+			s.exportBinary(s.Vars[subType.String()])
+		}
+		logf(modNetwork, LevelDebug, "SET: %s\n", m)
 	case MsgReq:
 		subType := m.SubType.(SubTypeSetReq)
 		vr := "0"
@@ -376,12 +951,56 @@ func (s *Sensor) HandleMessage(m *Message, tx chan *Message) error {
 		r := m.Copy()
 		r.SubType = subType
 		r.Payload = []byte(vr)
-		tx <- r
-		log.Printf("REQ: %s\n", m)
+		Enqueue("tx", tx, r, nil)
+		logf(modNetwork, LevelDebug, "REQ: %s\n", m)
 	}
 	return nil
 }
 
+// sensorLabels are the label names of the per-sensor metrics. type is the
+// presented sensor type, sketch the node's sketch name with --sketch_label,
+// and synthetic "true" for injected values. Empty labels are treated by
+// Prometheus as no label.
+var sensorLabels = []string{"location", "node", "sensor", "gateway", "type", "sketch", "name", "synthetic"}
+
+// labels returns the metric label values for the sensor.
+func (s *Sensor) labels() []string {
+	typ, sketch := "", ""
+	if s.Presentation != nil {
+		typ = s.Presentation.String()
+	}
+	if *sketchLabel {
+		sketch = s.node.SketchName
+	}
+	synthetic := ""
+	if s.synthetic {
+		synthetic = "true"
+	}
+	return []string{s.node.Location, strconv.Itoa(int(s.node.ID)), strconv.Itoa(int(s.ID)), s.node.Gateway, typ, sketch, s.name(), synthetic}
+}
+
+// newVar returns a new variable of the given type, float if its values are
+// numbers.
+func (s *Sensor) newVar(t SubTypeSetReq) *Var {
+	switch t {
+	case V_DISTANCE, V_TEMP, V_HUM, V_PRESSURE, V_LEVEL, V_VOLUME, V_VOLTAGE, V_LIGHT_LEVEL, V_WIND, V_GUST, V_DIRECTION,
+		V_PH, V_ORP, V_EC, V_VAR, V_VA, V_POWER_FACTOR, V_WATT, V_KWH, V_CURRENT, V_IMPEDANCE, V_UV, V_WEIGHT,
+		V_RAIN, V_RAINRATE, V_FLOW:
+		return &Var{Type: varFloat}
+	}
+	v := &Var{Type: varString}
+	if c, _ := t.custom(); c.Float || s.node.network.customGauge(t) || s.numberRule(t) {
+		v.Type = varFloat
+	}
+	return v
+}
+
+// relabel moves the sensor's series to its current labels.
+func (s *Sensor) relabel() {
+	s.unexportAll()
+	s.reexport()
+}
+
 const (
 	varString = "string"
 	varFloat  = "float"
@@ -393,6 +1012,18 @@ type Var struct {
 	SubType   SubTypeSetReq
 	FloatVal  float64
 	StringVal string
+	// Unit is the unit the sensor declared with V_UNIT_PREFIX, if any.
+	Unit string `json:",omitempty"`
+	// Updated is when the value was last received.
+	Updated time.Time
+	// Min and Max are the watermarks of float values, or nil if none
+	// were received since WatermarkSince.
+	Min            *float64   `json:",omitempty"`
+	Max            *float64   `json:",omitempty"`
+	WatermarkSince *time.Time `json:",omitempty"`
+	// Total is the counter of variables in CounterMap or mapped to
+	// counters: the sum of the increases of the totals reported.
+	Total float64 `json:",omitempty"`
 }
 
 func (v *Var) Set(val string) error {
@@ -0,0 +1,127 @@
+// This file contains the serial port transport.
+package mysensors
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// SerialTransport is a GatewayTransport for a serial gateway.
+type SerialTransport struct {
+	Config *serial.Config
+	// Glob, if set, is scanned for the port on every open instead of using
+	// Config.Name, eg /dev/serial/by-id/usb-1a86_* so the gateway is found
+	// again when replugged under a new ttyUSB number.
+	Glob string
+	// DTR and RTS, if not nil, set the modem control lines after opening,
+	// eg to hold an Arduino gateway out of reset.
+	DTR, RTS *bool
+	// Settle is the time to wait after opening, for gateways that reboot
+	// when the port is opened.
+	Settle time.Duration
+
+	mux  sync.Mutex
+	port *serial.Port
+}
+
+// NewSerialTransport returns a transport for the serial port name at baud.
+func NewSerialTransport(name string, baud int) *SerialTransport {
+	return &SerialTransport{Config: &serial.Config{Name: name, Baud: baud}}
+}
+
+// NewSerialGlobTransport returns a transport for the first serial port
+// matching glob at baud.
+func NewSerialGlobTransport(glob string, baud int) *SerialTransport {
+	return &SerialTransport{Config: &serial.Config{Baud: baud}, Glob: glob}
+}
+
+func (s *SerialTransport) Open() error {
+	if s.Glob != "" {
+		return s.openGlob()
+	}
+	return s.openPort(s.Config.Name)
+}
+
+// openPort opens the named port and prepares it for use.
+func (s *SerialTransport) openPort(name string) error {
+	c := *s.Config
+	c.Name = name
+	p, err := serial.OpenPort(&c)
+	if err != nil {
+		return err
+	}
+	if s.DTR != nil || s.RTS != nil {
+		if err := setModemLines(name, s.DTR, s.RTS); err != nil {
+			p.Close()
+			return fmt.Errorf("setting DTR/RTS on %s: %v", name, err)
+		}
+	}
+	if s.Settle > 0 {
+		time.Sleep(s.Settle)
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.port = p
+	return nil
+}
+
+func (s *SerialTransport) current() (*serial.Port, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.port == nil {
+		return nil, errors.New("serial port not open")
+	}
+	return s.port, nil
+}
+
+func (s *SerialTransport) Read(b []byte) (int, error) {
+	p, err := s.current()
+	if err != nil {
+		return 0, err
+	}
+	return p.Read(b)
+}
+
+func (s *SerialTransport) Write(b []byte) (int, error) {
+	p, err := s.current()
+	if err != nil {
+		return 0, err
+	}
+	return p.Write(b)
+}
+
+func (s *SerialTransport) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.port == nil {
+		return nil
+	}
+	err := s.port.Close()
+	s.port = nil
+	return err
+}
+
+// openGlob opens the first port matching Glob.
+func (s *SerialTransport) openGlob() error {
+	names, err := filepath.Glob(s.Glob)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no serial port matches %s", s.Glob)
+	}
+	for _, name := range names {
+		if err := s.openPort(name); err != nil {
+			logf(modTransport, LevelWarn, "Error opening serial port %s: %v", name, err)
+			continue
+		}
+		logf(modTransport, LevelInfo, "Opened serial port %s", name)
+		return nil
+	}
+	return fmt.Errorf("no serial port matching %s could be opened", s.Glob)
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+// This file contains serial modem line control for other systems.
+package mysensors
+
+import "errors"
+
+// setModemLines is not supported on this platform.
+func setModemLines(name string, dtr, rts *bool) error {
+	return errors.New("setting DTR/RTS is not supported on this platform")
+}
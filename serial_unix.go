@@ -0,0 +1,38 @@
+//go:build linux || darwin
+// +build linux darwin
+
+// This file contains serial modem line control for unix systems.
+package mysensors
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// setModemLines sets the DTR and RTS lines of the named port, leaving those
+// which are nil unchanged.
+func setModemLines(name string, dtr, rts *bool) error {
+	f, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, l := range []struct {
+		on  *bool
+		bit int
+	}{{dtr, syscall.TIOCM_DTR}, {rts, syscall.TIOCM_RTS}} {
+		if l.on == nil {
+			continue
+		}
+		req := uintptr(syscall.TIOCMBIC)
+		if *l.on {
+			req = syscall.TIOCMBIS
+		}
+		bits := l.bit
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(unsafe.Pointer(&bits))); errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// This file contains the index of metric series exported for each sensor.
+package mysensors
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Series is a metric series exported for a sensor.
+type Series struct {
+	Metric string
+	Labels []string
+}
+
+// key returns the fingerprint of the series. Label values are separated by
+// a byte that can't appear in them, as in collector.go.
+func (s Series) key() string {
+	return s.Metric + "\xff" + strings.Join(s.Labels, "\xff")
+}
+
+// rekey indexes the series again after loading a state file, as JSON
+// replaces the separator byte of the keys, and older files used commas.
+func (s *Sensor) rekey() {
+	series := s.Series
+	s.Series = nil
+	for _, se := range series {
+		s.track(se)
+	}
+}
+
+// vec returns the gauge of the named metric, or nil if unknown.
+func (n *Network) vec(metric string) *prometheus.GaugeVec {
+	if metric == receiveTimeMetric {
+		return n.gauges.receiveTimeSeconds
+	}
+	return n.gauges.metrics.lookupGauge(metric)
+}
+
+// track records that the sensor exported the series.
+func (s *Sensor) track(series ...Series) {
+	if s.Series == nil {
+		s.Series = make(map[string]Series)
+	}
+	for _, se := range series {
+		s.Series[se.key()] = se
+	}
+}
+
+// export sets the named gauge of fixedGauges, and records the series.
+func (s *Sensor) export(metric string, labels []string, v float64) {
+	s.node.network.gauges.metrics.fixedGauge(metric).WithLabelValues(labels...).Set(v)
+	s.track(Series{Metric: metric, Labels: labels})
+}
+
+// unexport deletes a series exported for the sensor.
+func (s *Sensor) unexport(se Series) {
+	if vec := s.node.network.vec(se.Metric); vec != nil {
+		vec.DeleteLabelValues(se.Labels...)
+	} else if vec := s.node.network.gauges.metrics.lookupCounter(se.Metric); vec != nil {
+		vec.DeleteLabelValues(se.Labels...)
+	}
+	delete(s.Series, se.key())
+}
+
+// unexportAll deletes all series exported for the sensor.
+func (s *Sensor) unexportAll() {
+	for _, se := range s.Series {
+		s.unexport(se)
+	}
+}
@@ -0,0 +1,17 @@
+package mysensors
+
+import "testing"
+
+func TestSeriesKey(t *testing.T) {
+	// Label values containing commas don't collide.
+	a := Series{Metric: "temperature", Labels: []string{"kitchen,north", "fridge"}}
+	b := Series{Metric: "temperature", Labels: []string{"kitchen", "north,fridge"}}
+	if a.key() == b.key() {
+		t.Errorf("series %v and %v share key %q", a.Labels, b.Labels, a.key())
+	}
+	s := &Sensor{Series: map[string]Series{"temperature{kitchen,north,fridge}": a}}
+	s.rekey()
+	if _, ok := s.Series[a.key()]; !ok || len(s.Series) != 1 {
+		t.Errorf("rekeyed series %v, want only %q", s.Series, a.key())
+	}
+}
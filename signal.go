@@ -0,0 +1,116 @@
+// This file contains signal quality reports from 2.x nodes.
+package mysensors
+
+import (
+	"context"
+	"flag"
+	"strconv"
+	"time"
+)
+
+var signalInterval = flag.Duration("signal_report_interval", 0, "Interval between requesting signal reports from awake 2.x nodes, 0 to disable")
+
+// invalidSignal is reported for unsupported or unknown signal values.
+const invalidSignal = -256
+
+var signalLabels = nodeLabels
+
+func init() {
+	fixedGauges["mysensors_rssi_dbm"] = fixedVec{
+		help:   "RSSI of the node's uplink, from I_SIGNAL_REPORT_RESPONSE",
+		labels: signalLabels,
+	}
+	fixedGauges["mysensors_snr"] = fixedVec{
+		help:   "SNR of the node's uplink in dB, from I_SIGNAL_REPORT_RESPONSE",
+		labels: signalLabels,
+	}
+	fixedGauges["mysensors_tx_power_dbm"] = fixedVec{
+		help:   "Transmit power of the node, from I_SIGNAL_REPORT_RESPONSE",
+		labels: signalLabels,
+	}
+}
+
+// signalQueries are the I_SIGNAL_REPORT_REQUEST commands sent, and the
+// metrics of their answers. Nodes answer in order, without naming the query.
+var signalQueries = []struct {
+	command string
+	metric  string
+}{
+	{"R!", "mysensors_rssi_dbm"},
+	{"S!", "mysensors_snr"},
+	{"P", "mysensors_tx_power_dbm"},
+}
+
+// SignalReports requests signal reports from all awake 2.x nodes every
+// --signal_report_interval, until ctx is done.
+func (n *Network) SignalReports(ctx context.Context) {
+	if *signalInterval <= 0 {
+		return
+	}
+	t := time.NewTicker(*signalInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		n.mux.Lock()
+		ms := []*Message{}
+		for _, nd := range n.Nodes {
+			if major, _, ok := nd.protocol(); ok && major >= 2 && !nd.Sleeping && nd.ID != GatewayID {
+				ms = append(ms, &Message{NodeID: nd.ID, Gateway: nd.Gateway})
+			}
+		}
+		n.mux.Unlock()
+		sortByNode(ms)
+		for _, m := range ms {
+			if err := n.RequestSignalReport(m.Gateway, m.NodeID); err != nil {
+				logf(modNetwork, LevelWarn, "Error requesting signal report from node %d: %v", m.NodeID, err)
+			}
+		}
+	}
+}
+
+// RequestSignalReport asks a node for its RSSI, SNR and transmit power. The
+// gateway may be empty if the ID is only on one.
+func (n *Network) RequestSignalReport(gateway string, id uint8) error {
+	n.mux.Lock()
+	nd, err := n.node(gateway, id)
+	if err != nil {
+		n.mux.Unlock()
+		return err
+	}
+	// Answers still outstanding from a previous request are lost.
+	nd.signalPending = nd.signalPending[:0]
+	for i := range signalQueries {
+		nd.signalPending = append(nd.signalPending, i)
+	}
+	gateway = nd.Gateway
+	n.mux.Unlock()
+	for _, q := range signalQueries {
+		m := &Message{NodeID: id, ChildSensorID: NoChild, Type: MsgInternal, SubType: I_SIGNAL_REPORT_REQUEST, Payload: []byte(q.command), Gateway: gateway}
+		if err := n.Send(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signalReport exports the answer to the oldest outstanding signal report
+// query. n.mux must be held.
+func (nd *Node) signalReport(payload string) {
+	if len(nd.signalPending) == 0 {
+		logf(modNetwork, LevelDebug, "Node %d sent an unrequested signal report: %s", nd.ID, payload)
+		return
+	}
+	q := signalQueries[nd.signalPending[0]]
+	nd.signalPending = nd.signalPending[1:]
+	v, err := strconv.Atoi(payload)
+	labels := nd.labels()
+	if err != nil || v <= invalidSignal {
+		nd.gauge(q.metric).DeleteLabelValues(labels...)
+		return
+	}
+	nd.gauge(q.metric).WithLabelValues(labels...).Set(float64(v))
+}
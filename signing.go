@@ -0,0 +1,41 @@
+// This file contains the handling of message signing requests. Signing is
+// done by the gateway: the serial protocol carries messages after the
+// gateway verified them, and before it signs them, with no signatures or
+// nonces, so the controller has nothing to sign or verify. HMAC signing and
+// nonce exchange by the controller are therefore not implemented, and won't
+// be.
+package mysensors
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// signingRequired parses an I_REQUEST_SIGNING payload: a boolean in 1.5, or
+// in 2.x a presentation version byte then a flags byte, in hex, with bit 0 of
+// the flags requiring signed messages.
+func signingRequired(payload []byte) bool {
+	s := strings.TrimSpace(string(payload))
+	if len(s) >= 4 {
+		b, err := hex.DecodeString(s)
+		return err == nil && b[1]&1 != 0
+	}
+	v, err := strconv.ParseUint(s, 16, 8)
+	return err == nil && v&1 != 0
+}
+
+// processSigning passes signing requests on to be recorded. They are not
+// answered: the gateway signs and verifies radio messages, and answers for
+// itself, so an answer from the controller could wrongly tell a node the
+// gateway doesn't require signed messages. Nonce exchanges are between the
+// gateway and its nodes, so are only logged if passed on.
+func (h *Handler) processSigning(m *Message) *Message {
+	switch m.SubType {
+	case I_REQUEST_SIGNING:
+		h.send(h.c, m)
+	case I_GET_NONCE, I_GET_NONCE_RESPONSE:
+		logf(modHandler, LevelDebug, "Ignoring %s from node %d, nonces are exchanged by the gateway.", m.SubType, m.NodeID)
+	}
+	return nil
+}
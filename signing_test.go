@@ -0,0 +1,24 @@
+package mysensors
+
+import "testing"
+
+func TestSigningRequired(t *testing.T) {
+	for _, tc := range []struct {
+		payload string
+		want    bool
+	}{
+		{"0", false},
+		{"1", true},
+		{"0100", false},
+		{"0101", true},
+		{"0102", false},
+		{"0103", true},
+		{"010", false},
+		{"zz03", false},
+		{"", false},
+	} {
+		if got := signingRequired([]byte(tc.payload)); got != tc.want {
+			t.Errorf("signingRequired(%q) = %v, want %v", tc.payload, got, tc.want)
+		}
+	}
+}
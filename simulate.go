@@ -0,0 +1,177 @@
+// This file contains a simulated gateway for development and tests.
+package mysensors
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Simulator is a GatewayTransport simulating a gateway with a number of
+// virtual nodes. Each node requests an ID, presents itself and its
+// temperature and humidity sensors, then periodically reports readings
+// and its battery level. Alternatively, it plays a Scenario.
+type Simulator struct {
+	// Nodes is the number of virtual nodes.
+	Nodes int
+	// Interval is the time between readings, which must be positive.
+	Interval time.Duration
+	// Scenario, if set, is played instead of simulating nodes.
+	Scenario []ScenarioStep
+
+	mux  sync.Mutex
+	pr   *io.PipeReader
+	pw   *io.PipeWriter
+	ids  chan uint8
+	stop chan bool
+}
+
+// simNode is a virtual node of the Simulator.
+type simNode struct {
+	id      uint8
+	temp    float64
+	hum     float64
+	battery int
+}
+
+func (s *Simulator) Open() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.pr, s.pw = io.Pipe()
+	s.ids = make(chan uint8, 1)
+	s.stop = make(chan bool)
+	go s.run(s.pw, s.stop)
+	return nil
+}
+
+func (s *Simulator) run(pw *io.PipeWriter, stop chan bool) {
+	send := func(m *Message) bool {
+		_, err := pw.Write(m.Marshal())
+		return err == nil
+	}
+	if !send(&Message{NodeID: GatewayID, ChildSensorID: NoChild, Type: MsgInternal, SubType: I_GATEWAY_READY, Payload: []byte("Gateway startup complete.")}) {
+		return
+	}
+	if s.Scenario != nil {
+		s.playScenario(send, stop)
+		return
+	}
+	nodes := []*simNode{}
+	for i := 0; i < s.Nodes; i++ {
+		id, ok := s.requestID(send, stop)
+		if !ok {
+			return
+		}
+		n := &simNode{id: id, temp: 18 + rand.Float64()*6, hum: 40 + rand.Float64()*20, battery: 100}
+		for _, m := range n.presentation() {
+			if !send(m) {
+				return
+			}
+		}
+		nodes = append(nodes, n)
+		// Let the presentation be recorded before the next ID request.
+		time.Sleep(500 * time.Millisecond)
+	}
+	t := time.NewTicker(s.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			for _, n := range nodes {
+				for _, m := range n.readings() {
+					if !send(m) {
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// requestID requests a node ID from the controller, retrying until answered.
+func (s *Simulator) requestID(send func(*Message) bool, stop chan bool) (uint8, bool) {
+	for {
+		if !send(&Message{NodeID: NoChild, ChildSensorID: NoChild, Type: MsgInternal, SubType: I_ID_REQUEST}) {
+			return 0, false
+		}
+		select {
+		case id := <-s.ids:
+			return id, true
+		case <-stop:
+			return 0, false
+		case <-time.After(5 * time.Second):
+			logf(modTransport, LevelWarn, "Simulator: no ID response, retrying")
+		}
+	}
+}
+
+func (n *simNode) presentation() []*Message {
+	return []*Message{
+		{NodeID: n.id, ChildSensorID: NoChild, Type: MsgPresentation, SubType: S_ARDUINO_NODE, Payload: []byte("2.3.2")},
+		{NodeID: n.id, ChildSensorID: NoChild, Type: MsgInternal, SubType: I_SKETCH_NAME, Payload: []byte("Simulated Node")},
+		{NodeID: n.id, ChildSensorID: NoChild, Type: MsgInternal, SubType: I_SKETCH_VERSION, Payload: []byte("1.0")},
+		{NodeID: n.id, ChildSensorID: NoChild, Type: MsgInternal, SubType: I_CONFIG, Payload: []byte("0")},
+		{NodeID: n.id, ChildSensorID: 0, Type: MsgPresentation, SubType: S_TEMP, Payload: []byte("Temperature")},
+		{NodeID: n.id, ChildSensorID: 1, Type: MsgPresentation, SubType: S_HUM, Payload: []byte("Humidity")},
+	}
+}
+
+func (n *simNode) readings() []*Message {
+	n.temp += rand.Float64() - 0.5
+	n.hum += rand.Float64()*2 - 1
+	if rand.Intn(10) == 0 && n.battery > 0 {
+		n.battery--
+	}
+	return []*Message{
+		{NodeID: n.id, ChildSensorID: 0, Type: MsgSet, SubType: V_TEMP, Payload: []byte(fmt.Sprintf("%.1f", n.temp))},
+		{NodeID: n.id, ChildSensorID: 1, Type: MsgSet, SubType: V_HUM, Payload: []byte(fmt.Sprintf("%.1f", n.hum))},
+		{NodeID: n.id, ChildSensorID: NoChild, Type: MsgInternal, SubType: I_BATTERY_LEVEL, Payload: []byte(strconv.Itoa(n.battery))},
+	}
+}
+
+func (s *Simulator) Read(b []byte) (int, error) {
+	s.mux.Lock()
+	pr := s.pr
+	s.mux.Unlock()
+	return pr.Read(b)
+}
+
+// Write accepts messages from the controller, answering ID requests.
+func (s *Simulator) Write(b []byte) (int, error) {
+	m := &Message{}
+	if err := m.Unmarshal(b); errors.Is(err, ErrUnknownType) {
+		return len(b), nil
+	} else if err != nil {
+		return 0, err
+	}
+	if m.Type == MsgInternal && m.SubType == I_ID_RESPONSE {
+		if id, err := strconv.Atoi(string(m.Payload)); err == nil {
+			select {
+			case s.ids <- uint8(id):
+			default:
+			}
+		}
+	}
+	return len(b), nil
+}
+
+func (s *Simulator) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	select {
+	case <-s.stop:
+		// Already closed.
+	default:
+		close(s.stop)
+	}
+	return s.pw.Close()
+}
+
+// unpingable disables the gateway watchdog, as there is no gateway to ping.
+func (s *Simulator) unpingable() {}
@@ -0,0 +1,64 @@
+// This file contains the queue of commands to sleeping nodes.
+package mysensors
+
+import "strconv"
+
+// maxSleepQueue limits the commands queued for a sleeping node.
+const maxSleepQueue = 50
+
+const sleepQueueMetric = "mysensors_sleep_queued_messages"
+
+func init() {
+	fixedGauges[sleepQueueMetric] = fixedVec{
+		help:   "Commands held until a sleeping node wakes",
+		labels: []string{"node", "gateway"},
+	}
+}
+
+// sleepQueueLabels are the labels of the node's sleep queue series.
+func (nd *Node) sleepQueueLabels() []string {
+	return []string{strconv.Itoa(int(nd.ID)), nd.Gateway}
+}
+
+// hold queues a set or req message to a node that announced it is going to
+// sleep, returning whether it did. A newer set of the same variable replaces
+// a queued one. n.mux must be held.
+func (n *Network) hold(m *Message) bool {
+	nd, err := n.node(m.Gateway, m.NodeID)
+	if err != nil || !nd.Sleeping || (m.Type != MsgSet && m.Type != MsgReq) {
+		return false
+	}
+	for i, q := range nd.Queued {
+		if m.Type == MsgSet && q.Type == MsgSet && q.ChildSensorID == m.ChildSensorID && q.SubType == m.SubType {
+			nd.Queued = append(nd.Queued[:i], nd.Queued[i+1:]...)
+			break
+		}
+	}
+	nd.Queued = append(nd.Queued, m)
+	if len(nd.Queued) > maxSleepQueue {
+		logf(modNetwork, LevelWarn, "Sleep queue of node %d full, dropping: %s", nd.ID, nd.Queued[0])
+		nd.Queued = nd.Queued[1:]
+	}
+	nd.gauge(sleepQueueMetric).WithLabelValues(nd.sleepQueueLabels()...).Set(float64(len(nd.Queued)))
+	logf(modNetwork, LevelDebug, "Node %d is sleeping, queued: %s", nd.ID, m)
+	n.changed()
+	return true
+}
+
+// wake marks the node awake, as it sent a message, and sends the commands
+// queued for it. Smart sleep nodes send I_PRE_SLEEP_NOTIFICATION and wait
+// briefly for commands before sleeping, and a heartbeat on waking.
+// n.mux must be held.
+func (nd *Node) wake(tx chan *Message) {
+	nd.Sleeping = false
+	if len(nd.Queued) == 0 {
+		return
+	}
+	logf(modNetwork, LevelInfo, "Node %d is awake, sending %d queued messages.", nd.ID, len(nd.Queued))
+	for _, m := range nd.Queued {
+		Enqueue("tx", tx, m, nil)
+	}
+	nd.Queued = nil
+	nd.gauge(sleepQueueMetric).DeleteLabelValues(nd.sleepQueueLabels()...)
+	nd.network.changed()
+}
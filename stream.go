@@ -0,0 +1,108 @@
+// This file contains stream message parsing, eg for firmware updates.
+package mysensors
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var streamCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mysensors_stream_messages_total",
+	Help: "Stream messages received, by sub type",
+}, []string{"gateway", "subtype"})
+
+func init() {
+	mustRegister(streamCount)
+}
+
+// StreamPayload returns the decoded hex payload of a stream message.
+func (m *Message) StreamPayload() ([]byte, error) {
+	if m.Type != MsgStream {
+		return nil, fmt.Errorf("not a stream message: %s", m)
+	}
+	return hex.DecodeString(string(m.Payload))
+}
+
+// FirmwareConfig is the payload of firmware config requests and responses.
+type FirmwareConfig struct {
+	Type    uint16
+	Version uint16
+	Blocks  uint16
+	CRC     uint16
+	// BLVersion is the bootloader version, in requests only.
+	BLVersion uint16
+}
+
+// ParseFirmwareConfig parses the little endian fields of a firmware config
+// request or response payload.
+func ParseFirmwareConfig(b []byte) (FirmwareConfig, error) {
+	if len(b) < 8 {
+		return FirmwareConfig{}, fmt.Errorf("firmware config too short: %d bytes", len(b))
+	}
+	c := FirmwareConfig{
+		Type:    binary.LittleEndian.Uint16(b[0:]),
+		Version: binary.LittleEndian.Uint16(b[2:]),
+		Blocks:  binary.LittleEndian.Uint16(b[4:]),
+		CRC:     binary.LittleEndian.Uint16(b[6:]),
+	}
+	if len(b) >= 10 {
+		c.BLVersion = binary.LittleEndian.Uint16(b[8:])
+	}
+	return c, nil
+}
+
+// FirmwareBlock is the payload of a firmware request, or a response
+// without its data.
+type FirmwareBlock struct {
+	Type    uint16
+	Version uint16
+	Block   uint16
+}
+
+// ParseFirmwareBlock parses the little endian fields of a firmware request
+// or response payload, returning the block data of responses.
+func ParseFirmwareBlock(b []byte) (FirmwareBlock, []byte, error) {
+	if len(b) < 6 {
+		return FirmwareBlock{}, nil, fmt.Errorf("firmware block too short: %d bytes", len(b))
+	}
+	return FirmwareBlock{
+		Type:    binary.LittleEndian.Uint16(b[0:]),
+		Version: binary.LittleEndian.Uint16(b[2:]),
+		Block:   binary.LittleEndian.Uint16(b[4:]),
+	}, b[6:], nil
+}
+
+// processStream counts and logs stream messages, answering firmware
+// requests if the network serves updates.
+func (h *Handler) processStream(m *Message) *Message {
+	subType := m.SubType.(SubTypeStream)
+	if int(subType) >= len(subTypeStream) {
+		logf(modHandler, LevelWarn, "Unknown stream sub type %d from node %d", subType, m.NodeID)
+		return nil
+	}
+	streamCount.WithLabelValues(h.Gateway, subType.String()).Inc()
+	b, err := m.StreamPayload()
+	if err != nil {
+		logf(modHandler, LevelWarn, "Bad stream payload from node %d: %v", m.NodeID, err)
+		return nil
+	}
+	switch subType {
+	case ST_FIRMWARE_CONFIG_REQUEST, ST_FIRMWARE_CONFIG_RESPONSE:
+		if c, err := ParseFirmwareConfig(b); err == nil {
+			logf(modHandler, LevelDebug, "Node %d %s: %+v", m.NodeID, subType, c)
+		}
+	case ST_FIRMWARE_REQUEST, ST_FIRMWARE_RESPONSE:
+		if fb, data, err := ParseFirmwareBlock(b); err == nil {
+			logf(modHandler, LevelDebug, "Node %d %s: %+v, %d bytes", m.NodeID, subType, fb, len(data))
+		}
+	default:
+		logf(modHandler, LevelDebug, "Node %d %s: %d bytes", m.NodeID, subType, len(b))
+	}
+	if h.network != nil && h.network.OTA != nil {
+		return h.network.OTA.handle(h.Gateway, m, b)
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+// This file contains strict mode, accepting only declared nodes and sensors.
+package mysensors
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var quarantinedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mysensors_quarantined_messages_total",
+	Help: "Messages from undeclared nodes and sensors quarantined in strict mode",
+}, []string{"gateway"})
+
+func init() {
+	mustRegister(quarantinedCount)
+}
+
+// Inventory is the declared nodes and sensors, loaded from a file with one
+// entry per line: a node ID, accepting all its sensors, or node/sensor,
+// optionally after a gateway name and a space to declare it on only that
+// gateway. Blank lines and lines starting with # are ignored.
+type Inventory struct {
+	path string
+
+	mux     sync.Mutex
+	nodes   map[invKey]bool
+	sensors map[invKey]bool
+}
+
+// invKey is a node, or sensor, on a gateway, or on any if gateway is empty.
+type invKey struct {
+	gateway string
+	node    uint8
+	sensor  uint8
+}
+
+// LoadInventory loads the inventory file at path.
+func LoadInventory(path string) (*Inventory, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	inv := &Inventory{path: path, nodes: map[invKey]bool{}, sensors: map[invKey]bool{}}
+	s := bufio.NewScanner(f)
+	for i := 1; s.Scan(); i++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var k invKey
+		if fields := strings.Fields(line); len(fields) == 2 {
+			k.gateway, line = fields[0], fields[1]
+		}
+		parts := strings.SplitN(line, "/", 2)
+		if k.node, err = parseUint8(parts[0]); err != nil {
+			return nil, fmt.Errorf("%s:%d: bad node: %v", path, i, err)
+		}
+		if len(parts) == 1 {
+			k.sensor = NoChild
+			inv.nodes[k] = true
+			continue
+		}
+		if k.sensor, err = parseUint8(parts[1]); err != nil {
+			return nil, fmt.Errorf("%s:%d: bad sensor: %v", path, i, err)
+		}
+		inv.sensors[k] = true
+	}
+	return inv, s.Err()
+}
+
+// accepts returns whether the message is from a node or sensor declared on
+// the gateway, or on any. Node messages are accepted from nodes with any
+// declared sensor.
+func (inv *Inventory) accepts(gateway string, node, sensor uint8) bool {
+	inv.mux.Lock()
+	defer inv.mux.Unlock()
+	if node == GatewayID {
+		return true
+	}
+	for _, gw := range []string{"", gateway} {
+		if inv.nodes[invKey{gw, node, NoChild}] || inv.sensors[invKey{gw, node, sensor}] {
+			return true
+		}
+	}
+	if sensor != NoChild {
+		return false
+	}
+	for k := range inv.sensors {
+		if k.node == node && (k.gateway == "" || k.gateway == gateway) {
+			return true
+		}
+	}
+	return false
+}
+
+// add declares a node, or sensor if not NoChild, on the gateway, or on any
+// if empty, appending it to the file.
+func (inv *Inventory) add(gateway string, node, sensor uint8) error {
+	inv.mux.Lock()
+	defer inv.mux.Unlock()
+	entry := strconv.Itoa(int(node))
+	if sensor == NoChild {
+		inv.nodes[invKey{gateway, node, NoChild}] = true
+	} else {
+		inv.sensors[invKey{gateway, node, sensor}] = true
+		entry += "/" + strconv.Itoa(int(sensor))
+	}
+	if gateway != "" {
+		entry = gateway + " " + entry
+	}
+	f, err := os.OpenFile(inv.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintln(f, entry); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Quarantined is an undeclared sensor heard in strict mode.
+type Quarantined struct {
+	Node      uint8
+	Sensor    uint8
+	Gateway   string `json:",omitempty"`
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Messages  int
+	// LastMessage is the last message received, in serial format.
+	LastMessage string
+}
+
+// SetInventory enables strict mode: messages from nodes and sensors not in
+// inv are quarantined instead of handled, until approved.
+func (n *Network) SetInventory(inv *Inventory) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.inventory = inv
+	n.quarantine = map[invKey]*Quarantined{}
+}
+
+// Accepted reports whether the message is from a declared node or sensor,
+// or strict mode is off.
+func (n *Network) Accepted(m *Message) bool {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.inventory == nil || n.inventory.accepts(m.Gateway, m.NodeID, m.ChildSensorID)
+}
+
+// quarantined records the message if it is from an undeclared node or
+// sensor, and reports whether it did. n.mux must be held.
+func (n *Network) quarantined(m *Message) bool {
+	if n.inventory == nil || n.inventory.accepts(m.Gateway, m.NodeID, m.ChildSensorID) {
+		return false
+	}
+	k := invKey{m.Gateway, m.NodeID, m.ChildSensorID}
+	q, ok := n.quarantine[k]
+	if !ok {
+		q = &Quarantined{Node: m.NodeID, Sensor: m.ChildSensorID, Gateway: m.Gateway, FirstSeen: time.Now()}
+		n.quarantine[k] = q
+		logf(modNetwork, LevelWarn, "Quarantined undeclared sensor %d/%d on gateway %q.", m.NodeID, m.ChildSensorID, m.Gateway)
+	}
+	q.LastSeen = time.Now()
+	q.Messages++
+	q.LastMessage = strings.TrimSpace(string(m.Marshal()))
+	quarantinedCount.WithLabelValues(m.Gateway).Inc()
+	return true
+}
+
+// Quarantine returns the quarantined sensors awaiting approval.
+func (n *Network) Quarantine() []Quarantined {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	qs := []Quarantined{}
+	for _, q := range n.quarantine {
+		qs = append(qs, *q)
+	}
+	sort.Slice(qs, func(i, j int) bool {
+		if qs[i].Gateway != qs[j].Gateway {
+			return qs[i].Gateway < qs[j].Gateway
+		}
+		if qs[i].Node != qs[j].Node {
+			return qs[i].Node < qs[j].Node
+		}
+		return qs[i].Sensor < qs[j].Sensor
+	})
+	return qs
+}
+
+// Approve adds a node, or sensor if not NoChild, on the gateway to the
+// inventory file and releases it from quarantine. Its traffic is accepted
+// from then on. If gateway is empty, it is the gateway the node is
+// quarantined on, or any if none; it is an error if the node is quarantined
+// on several.
+func (n *Network) Approve(gateway string, node, sensor uint8) error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.inventory == nil {
+		return fmt.Errorf("strict mode is off")
+	}
+	gateway, err := n.quarantineGateway(gateway, node)
+	if err != nil {
+		return err
+	}
+	if err := n.inventory.add(gateway, node, sensor); err != nil {
+		return err
+	}
+	n.release(gateway, node, sensor)
+	logf(modNetwork, LevelInfo, "Approved sensor %d/%d on gateway %q.", node, sensor, gateway)
+	return nil
+}
+
+// Reject removes a node, or sensor if not NoChild, on the gateway from
+// quarantine. It is quarantined again if heard from. The gateway is found as
+// by Approve.
+func (n *Network) Reject(gateway string, node, sensor uint8) error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	gateway, err := n.quarantineGateway(gateway, node)
+	if err != nil {
+		return err
+	}
+	n.release(gateway, node, sensor)
+	return nil
+}
+
+// quarantineGateway returns gateway, or if empty the gateway the node is
+// quarantined on, or empty if none. It is an error if the node is
+// quarantined on several gateways. n.mux must be held.
+func (n *Network) quarantineGateway(gateway string, node uint8) (string, error) {
+	if gateway != "" {
+		return gateway, nil
+	}
+	found, ok := "", false
+	for k := range n.quarantine {
+		if k.node != node {
+			continue
+		}
+		if ok && k.gateway != found {
+			return "", fmt.Errorf("node %d is quarantined on gateways %s and %s, so the gateway must be given", node, found, k.gateway)
+		}
+		found, ok = k.gateway, true
+	}
+	return found, nil
+}
+
+// release removes a node, or sensor if not NoChild, on the gateway, or on
+// any if empty, from quarantine. n.mux must be held.
+func (n *Network) release(gateway string, node, sensor uint8) {
+	for k := range n.quarantine {
+		if k.node == node && (gateway == "" || k.gateway == gateway) && (sensor == NoChild || k.sensor == sensor) {
+			delete(n.quarantine, k)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package mysensors
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInventoryGateways(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inventory")
+	if err := ioutil.WriteFile(path, []byte("# declared\n3\nA 4/1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	inv, err := LoadInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NewNetwork()
+	n.SetInventory(inv)
+	for _, gw := range []string{"A", "B"} {
+		n.HandleMessage(&Message{NodeID: 5, ChildSensorID: 1, Type: MsgSet, SubType: V_TEMP, Payload: []byte("1"), Gateway: gw}, nil)
+	}
+	if err := n.Approve("", 5, NoChild); err == nil {
+		t.Error("approved node 5 quarantined on two gateways without naming one")
+	}
+	if err := n.Approve("A", 5, NoChild); err != nil {
+		t.Fatal(err)
+	}
+	if q := n.Quarantine(); len(q) != 1 || q[0].Gateway != "B" {
+		t.Errorf("quarantine %+v, want only node 5 on B", q)
+	}
+	if inv, err = LoadInventory(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		gateway      string
+		node, sensor uint8
+		want         bool
+	}{
+		{"A", 3, 1, true},
+		{"B", 3, 1, true},
+		{"A", 4, 1, true},
+		{"A", 4, NoChild, true},
+		{"B", 4, 1, false},
+		{"B", 4, NoChild, false},
+		{"A", 5, 1, true},
+		{"B", 5, 1, false},
+	} {
+		if got := inv.accepts(tc.gateway, tc.node, tc.sensor); got != tc.want {
+			t.Errorf("accepts(%q, %d, %d) = %t, want %t", tc.gateway, tc.node, tc.sensor, got, tc.want)
+		}
+	}
+}
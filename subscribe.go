@@ -0,0 +1,68 @@
+// This file contains fan out of gateway traffic to subscribers.
+package mysensors
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var subscriberDroppedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mysensors_subscriber_dropped_messages_total",
+	Help: "Messages dropped because a subscriber fell behind",
+}, []string{"gateway"})
+
+func init() {
+	mustRegister(subscriberDroppedCount)
+}
+
+// Traffic is a message received from or sent to a gateway.
+type Traffic struct {
+	// Time is when the message was received or sent.
+	Time time.Time
+	// Dir is the direction, "rx" or "tx".
+	Dir string
+	// Message is a copy of the message.
+	Message *Message
+}
+
+// Subscribe returns a channel receiving every message received from or sent
+// to the gateway, buffering up to size messages. Messages are dropped if
+// the subscriber falls behind.
+func (h *Handler) Subscribe(size int) <-chan Traffic {
+	ch := make(chan Traffic, size)
+	h.subMux.Lock()
+	defer h.subMux.Unlock()
+	if h.subs == nil {
+		h.subs = make(map[<-chan Traffic]chan Traffic)
+	}
+	h.subs[ch] = ch
+	return ch
+}
+
+// Unsubscribe stops sending messages to ch, and closes it.
+func (h *Handler) Unsubscribe(ch <-chan Traffic) {
+	h.subMux.Lock()
+	defer h.subMux.Unlock()
+	if c, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(c)
+	}
+}
+
+// publish passes a message to all subscribers.
+func (h *Handler) publish(dir string, m *Message) {
+	h.subMux.Lock()
+	defer h.subMux.Unlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	now := time.Now()
+	for _, c := range h.subs {
+		select {
+		case c <- Traffic{Time: now, Dir: dir, Message: m.Copy()}:
+		default:
+			subscriberDroppedCount.WithLabelValues(h.Gateway).Inc()
+		}
+	}
+}
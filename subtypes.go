@@ -0,0 +1,119 @@
+// This file contains set/req variables registered at runtime.
+package mysensors
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// CustomSubType is a set/req variable registered at runtime, for custom
+// sketches using V_VAR1..5 or V_CUSTOM, or vendor variables numbered beyond
+// the known ones.
+type CustomSubType struct {
+	// Name is the name used in logs, state and the API, eg V_FLOW_TEMP.
+	Name  string
+	Value uint8
+	// Float is whether values are numbers, else they are kept as strings.
+	Float bool `json:",omitempty"`
+	// Metric, if set, is the gauge to export float values as.
+	Metric string `json:",omitempty"`
+}
+
+var (
+	customMux      sync.RWMutex
+	customSubTypes = map[SubTypeSetReq]CustomSubType{}
+)
+
+// RegisterSubType registers or replaces a custom variable. Only V_VAR1..5,
+// V_CUSTOM and unknown values can be registered.
+func RegisterSubType(c CustomSubType) error {
+	t := SubTypeSetReq(c.Value)
+	switch {
+	case c.Name == "":
+		return fmt.Errorf("variable %d has no name", c.Value)
+	case int(t) < len(subTypeSetReq) && t != V_CUSTOM && (t < V_VAR1 || t > V_VAR5):
+		return fmt.Errorf("variable %d is %s, which cannot be redefined", c.Value, t)
+	case c.Metric != "" && !metricNameRE.MatchString(c.Metric):
+		return fmt.Errorf("invalid metric name %q for %s", c.Metric, c.Name)
+	case c.Metric != "" && !c.Float:
+		return fmt.Errorf("%s must be a float to be exported as %s", c.Name, c.Metric)
+	}
+	customMux.Lock()
+	defer customMux.Unlock()
+	for v, other := range customSubTypes {
+		if other.Name == c.Name && v != t {
+			return fmt.Errorf("%s is already variable %d", c.Name, v)
+		}
+	}
+	for i, name := range subTypeSetReq {
+		if name == c.Name && SubTypeSetReq(i) != t {
+			return fmt.Errorf("%s is already variable %d", c.Name, i)
+		}
+	}
+	customSubTypes[t] = c
+	logf(modNetwork, LevelInfo, "Registered variable %d as %s.", c.Value, c.Name)
+	return nil
+}
+
+// LoadSubTypes registers the custom variables in a JSON file, a list of
+// CustomSubType.
+func LoadSubTypes(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var cs []CustomSubType
+	if err := json.Unmarshal(data, &cs); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+	for _, c := range cs {
+		if err := RegisterSubType(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SubTypes returns the registered custom variables.
+func SubTypes() []CustomSubType {
+	customMux.RLock()
+	defer customMux.RUnlock()
+	cs := []CustomSubType{}
+	for _, c := range customSubTypes {
+		cs = append(cs, c)
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Value < cs[j].Value })
+	return cs
+}
+
+// custom returns the custom variable registered as t, if any.
+func (t SubTypeSetReq) custom() (CustomSubType, bool) {
+	customMux.RLock()
+	defer customMux.RUnlock()
+	c, ok := customSubTypes[t]
+	return c, ok
+}
+
+// known returns whether t is a known or registered variable.
+func (t SubTypeSetReq) known() bool {
+	if int(t) < len(subTypeSetReq) {
+		return true
+	}
+	_, ok := t.custom()
+	return ok
+}
+
+// customSubType returns the custom variable with the given name.
+func customSubType(name string) (SubTypeSetReq, bool) {
+	customMux.RLock()
+	defer customMux.RUnlock()
+	for t, c := range customSubTypes {
+		if c.Name == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,57 @@
+// This file contains raw frame tailing.
+package mysensors
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Frame is a raw serial protocol line sent to or received from a gateway.
+type Frame struct {
+	// Time is when the frame was sent or received.
+	Time time.Time
+	// Gateway is the name of the gateway.
+	Gateway string
+	// Dir is the direction, "rx" or "tx".
+	Dir string
+	// Data is the raw line, without the trailing newline.
+	Data string
+}
+
+func (f Frame) String() string {
+	return fmt.Sprintf("%s %s %s %s", f.Time.Format(time.RFC3339Nano), f.Gateway, f.Dir, f.Data)
+}
+
+// Tail returns a channel receiving every raw frame sent or received, and a
+// function to stop tailing. Frames are dropped if the receiver falls behind.
+func (h *Handler) Tail() (<-chan Frame, func()) {
+	ch := make(chan Frame, 100)
+	h.tailMux.Lock()
+	defer h.tailMux.Unlock()
+	if h.tails == nil {
+		h.tails = make(map[chan Frame]bool)
+	}
+	h.tails[ch] = true
+	return ch, func() {
+		h.tailMux.Lock()
+		defer h.tailMux.Unlock()
+		delete(h.tails, ch)
+	}
+}
+
+// tap passes a raw frame to all tails.
+func (h *Handler) tap(dir string, b []byte) {
+	h.tailMux.Lock()
+	defer h.tailMux.Unlock()
+	if len(h.tails) == 0 {
+		return
+	}
+	f := Frame{Time: time.Now(), Gateway: h.Gateway, Dir: dir, Data: strings.TrimSuffix(string(b), "\n")}
+	for ch := range h.tails {
+		select {
+		case ch <- f:
+		default:
+		}
+	}
+}
@@ -0,0 +1,274 @@
+// This file contains the time sources answering I_TIME requests.
+package mysensors
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	timeSourceSpec = flag.String("time_sources", "system", "Comma separated time sources for I_TIME replies, tried in order: system, ntp:host[:port], or gps:node/sensor for a child reporting GPS time")
+	timeZone       = flag.String("timezone", "Local", "IANA time zone, eg Europe/Berlin, for --time_local")
+	timeLocal      = flag.Bool("time_local", false, "Reply to I_TIME with local time seconds, the Unix time plus the --timezone offset, as sketches without time zone support expect")
+)
+
+// Clock is the system clock, used by the system time source and as the base
+// of the NTP time source. Tests can replace it.
+var Clock = time.Now
+
+const (
+	// ntpTimeout bounds NTP queries, which delay replies to nodes.
+	ntpTimeout = 2 * time.Second
+	// ntpRefresh is how long a measured NTP clock offset is used.
+	ntpRefresh = time.Minute
+	// ntpEpochOffset is the number of seconds from 1900 to 1970.
+	ntpEpochOffset = 2208988800
+	// gpsMaxAge is how long a GPS time report is trusted.
+	gpsMaxAge = time.Hour
+)
+
+var timeReplyCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mysensors_time_replies_total",
+	Help: "I_TIME replies, by the time source used",
+}, []string{"source"})
+
+func init() {
+	mustRegister(timeReplyCount)
+}
+
+// timeSource is a source of the current time.
+type timeSource interface {
+	now() (time.Time, error)
+	String() string
+}
+
+var (
+	timeSourcesOnce sync.Once
+	timeSourcesMux  sync.Mutex
+	timeSources     []timeSource
+)
+
+// SetTimeSources sets the time sources, overriding --time_sources.
+func SetTimeSources(spec string) error {
+	timeSourcesOnce.Do(func() {})
+	sources, err := parseTimeSources(spec)
+	if err != nil {
+		return err
+	}
+	timeSourcesMux.Lock()
+	defer timeSourcesMux.Unlock()
+	timeSources = sources
+	return nil
+}
+
+func parseTimeSources(spec string) ([]timeSource, error) {
+	var sources []timeSource
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		kv := strings.SplitN(s, ":", 2)
+		switch {
+		case s == "":
+		case s == "system":
+			sources = append(sources, systemClock{})
+		case kv[0] == "ntp" && len(kv) == 2:
+			addr := kv[1]
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				addr = net.JoinHostPort(addr, "123")
+			}
+			sources = append(sources, &ntpClock{addr: addr})
+		case kv[0] == "gps" && len(kv) == 2:
+			ids := strings.SplitN(kv[1], "/", 2)
+			if len(ids) != 2 {
+				return nil, fmt.Errorf("invalid GPS time source %q, want gps:node/sensor", s)
+			}
+			node, err := strconv.ParseUint(ids[0], 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid GPS node in %q", s)
+			}
+			sensor, err := strconv.ParseUint(ids[1], 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid GPS sensor in %q", s)
+			}
+			sources = append(sources, &gpsClock{node: uint8(node), sensor: uint8(sensor)})
+		default:
+			return nil, fmt.Errorf("unknown time source %q", s)
+		}
+	}
+	return sources, nil
+}
+
+// currentTimeSources returns the time sources, parsing --time_sources on
+// first use.
+func currentTimeSources() []timeSource {
+	timeSourcesOnce.Do(func() {
+		sources, err := parseTimeSources(*timeSourceSpec)
+		if err != nil {
+			logf(modHandler, LevelError, "Error in --time_sources, using the system clock: %v", err)
+		}
+		timeSourcesMux.Lock()
+		timeSources = sources
+		timeSourcesMux.Unlock()
+	})
+	timeSourcesMux.Lock()
+	defer timeSourcesMux.Unlock()
+	return timeSources
+}
+
+// currentTime returns the time from the first working time source, falling
+// back to the system clock.
+func currentTime() time.Time {
+	for _, s := range currentTimeSources() {
+		t, err := s.now()
+		if err == nil {
+			timeReplyCount.WithLabelValues(s.String()).Inc()
+			return t
+		}
+		logf(modHandler, LevelDebug, "Time source %s failed: %v", s, err)
+	}
+	timeReplyCount.WithLabelValues("fallback").Inc()
+	return Clock()
+}
+
+var (
+	locationOnce sync.Once
+	location     *time.Location
+)
+
+// replyLocation returns the --timezone location, or UTC if it is invalid.
+func replyLocation() *time.Location {
+	locationOnce.Do(func() {
+		loc, err := time.LoadLocation(*timeZone)
+		if err != nil {
+			logf(modHandler, LevelError, "Error in --timezone, using UTC: %v", err)
+			loc = time.UTC
+		}
+		location = loc
+	})
+	return location
+}
+
+// timeSeconds returns t as I_TIME seconds: Unix time, or with --time_local
+// the local time in --timezone as if it were UTC.
+func timeSeconds(t time.Time) int64 {
+	if !*timeLocal {
+		return t.Unix()
+	}
+	_, offset := t.In(replyLocation()).Zone()
+	return t.Unix() + int64(offset)
+}
+
+// observeTime records GPS time reports for the GPS time sources.
+func observeTime(m *Message) {
+	if m.Type != MsgSet || (m.SubType != V_TEXT && m.SubType != V_CUSTOM) {
+		return
+	}
+	for _, s := range currentTimeSources() {
+		if g, ok := s.(*gpsClock); ok && g.node == m.NodeID && g.sensor == m.ChildSensorID {
+			g.report(string(m.Payload))
+		}
+	}
+}
+
+// systemClock is the local clock.
+type systemClock struct{}
+
+func (systemClock) now() (time.Time, error) { return Clock(), nil }
+
+func (systemClock) String() string { return "system" }
+
+// ntpClock is the time of an NTP server, as an offset from the local clock
+// refreshed every ntpRefresh. Failures are also kept that long, so an
+// unreachable server does not delay every reply.
+type ntpClock struct {
+	addr    string
+	mux     sync.Mutex
+	offset  time.Duration
+	err     error
+	queried time.Time
+}
+
+func (c *ntpClock) now() (time.Time, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if time.Since(c.queried) > ntpRefresh {
+		c.offset, c.err = c.query()
+		c.queried = time.Now()
+	}
+	if c.err != nil {
+		return time.Time{}, c.err
+	}
+	return Clock().Add(c.offset), nil
+}
+
+// query returns the offset of the server's clock, by SNTP.
+func (c *ntpClock) query() (time.Duration, error) {
+	conn, err := net.DialTimeout("udp", c.addr, ntpTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ntpTimeout))
+	req := make([]byte, 48)
+	req[0] = 0x1b // Version 3, client mode.
+	sent := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	if n, err := conn.Read(resp); err != nil {
+		return 0, err
+	} else if n < 48 {
+		return 0, fmt.Errorf("short NTP reply of %d bytes", n)
+	}
+	received := time.Now()
+	if resp[1] == 0 {
+		return 0, errors.New("NTP server refused the query")
+	}
+	secs := binary.BigEndian.Uint32(resp[40:])
+	frac := binary.BigEndian.Uint32(resp[44:])
+	t := time.Unix(int64(secs)-ntpEpochOffset, int64(frac)*1e9>>32)
+	// Assume the network delay is symmetric.
+	return t.Sub(sent.Add(received.Sub(sent) / 2)), nil
+}
+
+func (c *ntpClock) String() string { return "ntp:" + c.addr }
+
+// gpsClock is the time reported by a node's GPS child, as Unix seconds in
+// V_TEXT or V_CUSTOM.
+type gpsClock struct {
+	node, sensor uint8
+	mux          sync.Mutex
+	reported     time.Time
+	received     time.Time
+}
+
+func (c *gpsClock) report(payload string) {
+	secs, err := strconv.ParseInt(strings.TrimSpace(payload), 10, 64)
+	if err != nil {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.reported, c.received = time.Unix(secs, 0), time.Now()
+}
+
+func (c *gpsClock) now() (time.Time, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	age := time.Since(c.received)
+	if c.received.IsZero() || age > gpsMaxAge {
+		return time.Time{}, errors.New("no recent GPS time")
+	}
+	return c.reported.Add(age), nil
+}
+
+func (c *gpsClock) String() string { return fmt.Sprintf("gps:%d/%d", c.node, c.sensor) }
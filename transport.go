@@ -0,0 +1,59 @@
+// This file contains gateway transports.
+package mysensors
+
+import (
+	"errors"
+	"io"
+)
+
+// GatewayTransport is a connection to a MySensors gateway, carrying serial
+// protocol lines.
+type GatewayTransport interface {
+	// Open opens the connection. It is called again to reconnect after Close.
+	Open() error
+	// Read reads serial protocol lines from the gateway.
+	Read(b []byte) (int, error)
+	// Write writes serial protocol lines to the gateway.
+	Write(b []byte) (int, error)
+	// Close closes the connection.
+	Close() error
+}
+
+// ErrNoReopen is returned by transports that cannot be reopened.
+var ErrNoReopen = errors.New("transport cannot be reopened")
+
+// StreamTransport is a GatewayTransport over an existing reader and writer,
+// eg for tests. It cannot be reopened once closed.
+type StreamTransport struct {
+	r      io.Reader
+	w      io.Writer
+	closed bool
+}
+
+// NewStreamTransport returns a transport reading from r and writing to w.
+func NewStreamTransport(r io.Reader, w io.Writer) *StreamTransport {
+	return &StreamTransport{r: r, w: w}
+}
+
+func (s *StreamTransport) Open() error {
+	if s.closed {
+		return ErrNoReopen
+	}
+	return nil
+}
+
+func (s *StreamTransport) Read(b []byte) (int, error) { return s.r.Read(b) }
+
+func (s *StreamTransport) Write(b []byte) (int, error) { return s.w.Write(b) }
+
+// Close closes the reader and writer if they are io.Closers.
+func (s *StreamTransport) Close() error {
+	s.closed = true
+	if c, ok := s.r.(io.Closer); ok {
+		c.Close()
+	}
+	if c, ok := s.w.(io.Closer); ok {
+		c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// This file contains the prioritised transmit queue.
+package mysensors
+
+// txQueue orders messages to send to the gateway. Internal messages, such as
+// ID, config and time responses, are sent before set and req traffic, as
+// sleeping nodes only listen briefly.
+type txQueue struct {
+	urgent []*Message
+	bulk   []*Message
+}
+
+func (q *txQueue) push(m *Message) {
+	if m.Type == MsgInternal {
+		q.urgent = append(q.urgent, m)
+	} else {
+		q.bulk = append(q.bulk, m)
+	}
+}
+
+// pop returns the next message to send, or nil if empty.
+func (q *txQueue) pop() *Message {
+	var m *Message
+	if len(q.urgent) > 0 {
+		m, q.urgent = q.urgent[0], q.urgent[1:]
+	} else if len(q.bulk) > 0 {
+		m, q.bulk = q.bulk[0], q.bulk[1:]
+	}
+	return m
+}
+
+func (q *txQueue) len() int {
+	return len(q.urgent) + len(q.bulk)
+}
+
+// next returns the next message to send, waiting for one on c if the queue
+// is empty. Messages already waiting on c are queued first, so internal
+// messages can jump ahead, up to --tx_queue_size of them so that c still
+// fills up and --queue_policy applies. It returns nil if the Handler is
+// stopped.
+func (q *txQueue) next(c chan *Message, done <-chan struct{}) *Message {
+	if q.len() == 0 {
+		select {
+		case m := <-c:
+			q.push(m)
+		case <-done:
+			return nil
+		}
+	}
+	for drained := false; !drained && q.len() < *txQueueSize; {
+		select {
+		case m := <-c:
+			q.push(m)
+		default:
+			drained = true
+		}
+	}
+	return q.pop()
+}
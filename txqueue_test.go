@@ -0,0 +1,54 @@
+package mysensors
+
+import "testing"
+
+func TestTxQueueNext(t *testing.T) {
+	size := *txQueueSize
+	defer func() { *txQueueSize = size }()
+	*txQueueSize = 2
+	c := make(chan *Message, 4)
+	for _, m := range []*Message{
+		{NodeID: 1, Type: MsgSet, SubType: V_STATUS},
+		{NodeID: 2, Type: MsgSet, SubType: V_STATUS},
+		{NodeID: 3, Type: MsgInternal, SubType: I_TIME},
+		{NodeID: 4, Type: MsgInternal, SubType: I_TIME},
+	} {
+		c <- m
+	}
+	var q txQueue
+	// Only --tx_queue_size messages are taken off c, so the reply to node
+	// 3 can't jump ahead yet.
+	if m := q.next(c, nil); m.NodeID != 1 {
+		t.Errorf("first sent to node %d, want 1", m.NodeID)
+	}
+	if len(c)+q.len() != 3 {
+		t.Errorf("%d on c and %d queued, want 3 in all", len(c), q.len())
+	}
+	for _, want := range []uint8{3, 4, 2} {
+		if m := q.next(c, nil); m.NodeID != want {
+			t.Errorf("sent to node %d, want %d", m.NodeID, want)
+		}
+	}
+}
+
+func TestTxQueueNextDefault(t *testing.T) {
+	// Messages waiting on the default sized Tx channel are reordered.
+	h := NewHandler(nil, nil, nil)
+	for _, m := range []*Message{
+		{NodeID: 1, Type: MsgSet, SubType: V_STATUS},
+		{NodeID: 2, Type: MsgSet, SubType: V_STATUS},
+		{NodeID: 3, Type: MsgInternal, SubType: I_TIME},
+	} {
+		select {
+		case h.Tx <- m:
+		default:
+			t.Fatalf("Tx full at node %d, with --tx_queue_size=%d", m.NodeID, *txQueueSize)
+		}
+	}
+	var q txQueue
+	for _, want := range []uint8{3, 1, 2} {
+		if m := q.next(h.Tx, nil); m.NodeID != want {
+			t.Errorf("sent to node %d, want %d", m.NodeID, want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// This file contains the units declared by nodes with V_UNIT_PREFIX.
+package mysensors
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var (
+	unitMetricNames = flag.Bool("unit_metric_names", false, "Suffix metric names with the unit declared by the sensor's V_UNIT_PREFIX, eg light_level_lux")
+	temperatureUnit = flag.String("temperature_unit", "", "Export V_TEMP in C or F, converting from the unit each node reports in, empty to export values as reported")
+)
+
+// unitSlugs names common units in metric names.
+var unitSlugs = map[string]string{
+	"%":     "percent",
+	"lx":    "lux",
+	"°c":    "celsius",
+	"c":     "celsius",
+	"°f":    "fahrenheit",
+	"f":     "fahrenheit",
+	"w":     "watts",
+	"kw":    "kilowatts",
+	"wh":    "watt_hours",
+	"kwh":   "kilowatt_hours",
+	"v":     "volts",
+	"mv":    "millivolts",
+	"a":     "amperes",
+	"ma":    "milliamperes",
+	"°":     "degrees",
+	"µs/cm": "microsiemens_per_cm",
+	"m":     "meters",
+	"cm":    "centimeters",
+	"mm":    "millimeters",
+	"in":    "inches",
+}
+
+// unitSlug returns the unit as a metric name suffix, eg "lux" for "lx".
+func unitSlug(unit string) string {
+	u := strings.ToLower(strings.TrimSpace(unit))
+	if s, ok := unitSlugs[u]; ok {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range u {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "_"):
+			b.WriteByte('_')
+		}
+	}
+	return strings.TrimSuffix(b.String(), "_")
+}
+
+// unit returns the unit the sensor declared with V_UNIT_PREFIX, if any.
+func (s *Sensor) unit() string {
+	if v, ok := s.Vars[V_UNIT_PREFIX.String()]; ok {
+		return strings.TrimSpace(v.Value())
+	}
+	return ""
+}
+
+// setUnit records the sensor's declared unit on its variables.
+func (s *Sensor) setUnit() {
+	unit := s.unit()
+	for _, v := range s.Vars {
+		if v.SubType != V_UNIT_PREFIX {
+			v.Unit = unit
+		}
+	}
+}
+
+// CheckTemperatureUnit returns an error if --temperature_unit is invalid.
+func CheckTemperatureUnit() error {
+	switch strings.ToUpper(*temperatureUnit) {
+	case "", "C", "F":
+		return nil
+	}
+	return fmt.Errorf("invalid --temperature_unit %q, want C, F or empty", *temperatureUnit)
+}
+
+// tempUnit returns --temperature_unit, C or F, or "" to not convert.
+func tempUnit() string {
+	switch u := strings.ToUpper(*temperatureUnit); u {
+	case "C", "F":
+		return u
+	}
+	return ""
+}
+
+// metricUnit returns the unit the variable is exported in: the declared unit,
+// that of --temperature_unit for temperatures, or meters for distances.
+func (s *Sensor) metricUnit(t SubTypeSetReq) string {
+	if u := tempUnit(); t == V_TEMP && u != "" {
+		return "°" + u
+	}
+	if t == V_DISTANCE {
+		return "m"
+	}
+	return s.unit()
+}
+
+// converted returns the value f of the variable in its metric unit. Nodes
+// report temperatures in the unit they declared with V_UNIT_PREFIX, else per
+// their I_CONFIG reply: Celsius for metric, Fahrenheit for imperial.
+// Distances are converted to meters, see meters.
+func (s *Sensor) converted(t SubTypeSetReq, f float64) float64 {
+	if t == V_DISTANCE {
+		return s.meters(f)
+	}
+	if to := tempUnit(); t == V_TEMP && to != "" {
+		return convertTemp(f, s.reportedTempUnit(), to)
+	}
+	return f
+}
+
+// reportedTempUnit returns the unit the sensor reports temperatures in, C or F.
+func (s *Sensor) reportedTempUnit() string {
+	switch unitSlug(s.unit()) {
+	case "fahrenheit":
+		return "F"
+	case "celsius":
+		return "C"
+	}
+	if s.node.config() == "I" {
+		return "F"
+	}
+	return "C"
+}
+
+// convertTemp converts the temperature f between C and F.
+func convertTemp(f float64, from, to string) float64 {
+	switch {
+	case from == to:
+		return f
+	case to == "F":
+		return f*9/5 + 32
+	}
+	return (f - 32) * 5 / 9
+}
+
+// meters returns the distance f in meters. Nodes report distances in the unit
+// they declared with V_UNIT_PREFIX, else per their I_CONFIG reply:
+// centimeters for metric, inches for imperial.
+func (s *Sensor) meters(f float64) float64 {
+	switch unitSlug(s.unit()) {
+	case "meters":
+		return f
+	case "millimeters":
+		return f / 1000
+	case "centimeters":
+		return f / 100
+	case "inches":
+		return f * 0.0254
+	}
+	if s.node.config() == "I" {
+		return f * 0.0254
+	}
+	return f / 100
+}
@@ -0,0 +1,114 @@
+// This file contains the gateway watchdog, detecting hung gateways.
+package mysensors
+
+import (
+	"flag"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	watchdogIdle    = flag.Duration("watchdog_idle", 5*time.Minute, "Ping the gateway when nothing is received for this long, 0 to disable")
+	watchdogTimeout = flag.Duration("watchdog_timeout", 10*time.Second, "Reconnect to the gateway if it doesn't answer a ping within this time")
+)
+
+var stalledGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "mysensors_gateway_stalled",
+	Help: "Whether the gateway stopped answering pings",
+}, []string{"gateway"})
+
+func init() {
+	mustRegister(stalledGauge)
+}
+
+// unpingable is implemented by transports without a real gateway to answer
+// pings, which the watchdog skips.
+type unpingable interface {
+	unpingable()
+}
+
+// touch records that data was received from the gateway.
+func (h *Handler) touch() {
+	h.rxMux.Lock()
+	defer h.rxMux.Unlock()
+	h.lastRx = time.Now()
+	if h.stalled {
+		h.stalled = false
+		stalledGauge.WithLabelValues(h.Gateway).Set(0)
+		logf(modHandler, LevelInfo, "Gateway responding again.")
+	}
+}
+
+// lastReceived returns when data was last received from the gateway.
+func (h *Handler) lastReceived() time.Time {
+	h.rxMux.Lock()
+	defer h.rxMux.Unlock()
+	return h.lastRx
+}
+
+// watchdog pings the gateway with an I_VERSION request after --watchdog_idle
+// without receiving anything, and reconnects if there is no response within
+// --watchdog_timeout.
+func (h *Handler) watchdog() {
+	if *watchdogIdle <= 0 {
+		return
+	}
+	stalledGauge.WithLabelValues(h.Gateway).Set(0)
+	h.touch()
+	interval := *watchdogTimeout / 2
+	if *watchdogIdle/2 < interval {
+		interval = *watchdogIdle / 2
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var pinged time.Time
+	for {
+		select {
+		case <-t.C:
+		case <-h.done:
+			return
+		}
+		last := h.lastReceived()
+		if !pinged.IsZero() && last.After(pinged) {
+			pinged = time.Time{}
+		}
+		if h.Elector != nil && !h.Elector.Leader() {
+			// Pings are not written, so can't be answered.
+			pinged = time.Time{}
+			continue
+		}
+		if t, _ := h.conn(); t != nil {
+			if _, ok := t.(unpingable); ok {
+				continue
+			}
+		}
+		if pinged.IsZero() {
+			if time.Since(last) < *watchdogIdle {
+				continue
+			}
+			logf(modHandler, LevelDebug, "Gateway idle for %v, pinging.", time.Since(last).Round(time.Second))
+			pinged = time.Now()
+			if !h.send(h.Tx, &Message{NodeID: GatewayID, ChildSensorID: NoChild, Type: MsgInternal, SubType: I_VERSION}) {
+				return
+			}
+			continue
+		}
+		if time.Since(pinged) < *watchdogTimeout {
+			continue
+		}
+		h.rxMux.Lock()
+		h.stalled = true
+		h.rxMux.Unlock()
+		stalledGauge.WithLabelValues(h.Gateway).Set(1)
+		logf(modHandler, LevelError, "Gateway not answering pings, reconnecting.")
+		_, gen := h.conn()
+		if !h.reconnect(gen) {
+			return
+		}
+		pinged = time.Time{}
+		h.rxMux.Lock()
+		h.lastRx = time.Now()
+		h.rxMux.Unlock()
+	}
+}
@@ -0,0 +1,103 @@
+// This file contains latching min/max watermarks of sensor values.
+package mysensors
+
+import "time"
+
+var watermarkLabels = append(sensorLabels, "variable")
+
+func init() {
+	fixedGauges["mysensors_watermark_max"] = fixedVec{
+		help:   "Highest value received since the watermarks were reset",
+		labels: watermarkLabels,
+	}
+	fixedGauges["mysensors_watermark_min"] = fixedVec{
+		help:   "Lowest value received since the watermarks were reset",
+		labels: watermarkLabels,
+	}
+	fixedGauges["mysensors_watermark_reset_time_seconds"] = fixedVec{
+		help:   "Unix timestamp the watermarks were last reset",
+		labels: watermarkLabels,
+	}
+}
+
+// updateWatermarks latches the value of v into its watermarks.
+func (s *Sensor) updateWatermarks(v *Var) {
+	if v.Max == nil || v.FloatVal > *v.Max {
+		max := v.FloatVal
+		v.Max = &max
+	}
+	if v.Min == nil || v.FloatVal < *v.Min {
+		min := v.FloatVal
+		v.Min = &min
+	}
+	s.exportWatermarks(v)
+}
+
+// exportWatermarks sets the watermark gauges of v.
+func (s *Sensor) exportWatermarks(v *Var) {
+	l := append(s.labels(), v.SubType.String())
+	if v.Max != nil {
+		s.export("mysensors_watermark_max", l, s.converted(v.SubType, *v.Max))
+	}
+	if v.Min != nil {
+		s.export("mysensors_watermark_min", l, s.converted(v.SubType, *v.Min))
+	}
+	if v.WatermarkSince != nil {
+		s.export("mysensors_watermark_reset_time_seconds", l, float64(v.WatermarkSince.Unix()))
+	}
+}
+
+// deleteWatermarks removes the watermark series of v.
+func (s *Sensor) deleteWatermarks(v *Var) {
+	l := append(s.labels(), v.SubType.String())
+	for _, metric := range []string{"mysensors_watermark_max", "mysensors_watermark_min", "mysensors_watermark_reset_time_seconds"} {
+		s.unexport(Series{Metric: metric, Labels: l})
+	}
+}
+
+// ResetWatermarks clears the watermarks of the given sensor, all sensors of
+// the node if sensor is -1, or all sensors of the gateway, or of all if
+// gateway is empty, if node is also -1. The node is found as by SetIgnored.
+// It returns the number of variables reset.
+func (n *Network) ResetWatermarks(gateway string, node, sensor int) (int, error) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	var nodes []*Node
+	if node != -1 {
+		nd, err := n.node(gateway, uint8(node))
+		if err != nil {
+			return 0, err
+		}
+		nodes = append(nodes, nd)
+	} else {
+		for _, nd := range n.Nodes {
+			if gateway == "" || nd.Gateway == gateway {
+				nodes = append(nodes, nd)
+			}
+		}
+	}
+	now := time.Now()
+	count := 0
+	for _, nd := range nodes {
+		for _, s := range nd.Sensors {
+			if sensor != -1 && int(s.ID) != sensor {
+				continue
+			}
+			for _, v := range s.Vars {
+				if v.Type != varFloat {
+					continue
+				}
+				s.deleteWatermarks(v)
+				v.Min, v.Max = nil, nil
+				v.WatermarkSince = &now
+				if !s.Ignored {
+					s.exportWatermarks(v)
+				}
+				count++
+			}
+		}
+	}
+	n.changed()
+	logf(modNetwork, LevelInfo, "Reset %d watermarks.", count)
+	return count, nil
+}
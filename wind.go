@@ -0,0 +1,133 @@
+// This file contains wind sensor handling.
+package mysensors
+
+import (
+	"flag"
+	"math"
+	"sort"
+	"time"
+)
+
+var windWindow = flag.Duration("wind_average_window", 10*time.Minute, "Window to vector-average wind directions over, 0 to disable")
+
+func init() {
+	fixedGauges["mysensors_wind_direction_average_degrees"] = fixedVec{
+		help:   "Wind direction vector-averaged over --wind_average_window, weighted by wind speed",
+		labels: sensorLabels,
+	}
+}
+
+// windSample is a wind direction reading.
+type windSample struct {
+	time      time.Time
+	direction float64
+	speed     float64
+}
+
+// updateWind records a wind direction reading and exports the average
+// direction.
+func (s *Sensor) updateWind(direction float64) {
+	if *windWindow <= 0 {
+		return
+	}
+	now := time.Now()
+	ws := windSample{time: now, direction: direction, speed: 1}
+	if v, ok := s.Vars[V_WIND.String()]; ok {
+		ws.speed = v.FloatVal
+	}
+	s.wind = append(s.wind, ws)
+	i := 0
+	for i < len(s.wind) && now.Sub(s.wind[i].time) > *windWindow {
+		i++
+	}
+	s.wind = s.wind[i:]
+	if avg, ok := s.windAverage(); ok {
+		s.export("mysensors_wind_direction_average_degrees", s.labels(), avg)
+	}
+}
+
+// windAverage returns the wind direction averaged as vectors, weighted by
+// speed, so that eg 350° and 10° average to 0° rather than 180°. Calm
+// readings are averaged unweighted.
+func (s *Sensor) windAverage() (float64, bool) {
+	if len(s.wind) == 0 {
+		return 0, false
+	}
+	average := func(weighted bool) (float64, float64) {
+		var x, y float64
+		for _, ws := range s.wind {
+			w := 1.0
+			if weighted {
+				w = ws.speed
+			}
+			rad := ws.direction * math.Pi / 180
+			x += w * math.Cos(rad)
+			y += w * math.Sin(rad)
+		}
+		return x, y
+	}
+	x, y := average(true)
+	if x == 0 && y == 0 {
+		x, y = average(false)
+	}
+	if x == 0 && y == 0 {
+		return 0, false
+	}
+	deg := math.Atan2(y, x) * 180 / math.Pi
+	if deg < 0 {
+		deg += 360
+	}
+	return deg, true
+}
+
+// WindInfo is the state of a wind sensor.
+type WindInfo struct {
+	Node     uint8
+	Sensor   uint8
+	Location string `json:",omitempty"`
+	Gateway  string `json:",omitempty"`
+	// Speed, Gust and Direction are the last values, or nil if unknown.
+	Speed     *float64 `json:",omitempty"`
+	Gust      *float64 `json:",omitempty"`
+	Direction *float64 `json:",omitempty"`
+	// AverageDirection is the vector-averaged direction, or nil if unknown.
+	AverageDirection *float64 `json:",omitempty"`
+}
+
+// Wind returns the state of all wind sensors.
+func (n *Network) Wind() []WindInfo {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	info := []WindInfo{}
+	for _, nd := range n.Nodes {
+		for _, s := range nd.Sensors {
+			if s.Ignored {
+				continue
+			}
+			wi := WindInfo{Node: nd.ID, Sensor: s.ID, Location: nd.Location, Gateway: nd.Gateway}
+			for _, f := range []struct {
+				t SubTypeSetReq
+				v **float64
+			}{{V_WIND, &wi.Speed}, {V_GUST, &wi.Gust}, {V_DIRECTION, &wi.Direction}} {
+				if v, ok := s.Vars[f.t.String()]; ok && v.Type == varFloat {
+					val := v.FloatVal
+					*f.v = &val
+				}
+			}
+			if avg, ok := s.windAverage(); ok {
+				wi.AverageDirection = &avg
+			}
+			isWind := s.Presentation != nil && *s.Presentation == S_WIND
+			if isWind || wi.Speed != nil || wi.Gust != nil || wi.Direction != nil {
+				info = append(info, wi)
+			}
+		}
+	}
+	sort.Slice(info, func(i, j int) bool {
+		if info[i].Node != info[j].Node {
+			return info[i].Node < info[j].Node
+		}
+		return info[i].Sensor < info[j].Sensor
+	})
+	return info
+}